@@ -1,60 +1,123 @@
 package main
 
 import (
-	"errors"
+	"context"
+	"flag"
 	"fmt"
 	"go-storj-solution/pkg/client"
-	"go-storj-solution/pkg/wire"
-	"io"
+	"go-storj-solution/pkg/lan"
 	"log"
-	"net"
 	"os"
-	"path"
+	"os/signal"
 )
 
 func main() {
+	request := flag.Bool("request", false, "request a code for a sender to push a file to, instead of receiving with the sender's code")
+	direct := flag.Bool("direct", false, "try connecting directly to the sender, falling back to the relay")
+	local := flag.Bool("local", false, "discover the sender on the local network instead of using a relay")
+	maxSize := flag.Int64("max-size", 0, "reject files and directories larger than this many bytes, 0 is unlimited")
+	extract := flag.Bool("extract", false, "unpack a received tar or tar.gz archive into the output directory")
+	flag.Parse()
 
-	if len(os.Args) != 4 {
-		log.Fatalln("Usage: receive <relay-host>:<relay-port> <secret-code> <output-directory>")
+	opts := []client.Option{client.WithDirect(*direct), client.WithMaxSize(*maxSize), client.WithExtract(*extract)}
+
+	if *local {
+		if flag.NArg() != 2 {
+			log.Fatalln("Usage: receive -local [-max-size <bytes>] [-extract] <secret-code> <output-directory>")
+		}
+		if err := runLocal(flag.Arg(0), flag.Arg(1), client.WithMaxSize(*maxSize), client.WithExtract(*extract)); err != nil {
+			fmt.Fprintf(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *request {
+		if flag.NArg() != 2 {
+			log.Fatalln("Usage: receive -request [-direct] [-max-size <bytes>] [-extract] <relay-host>:<relay-port> <output-directory>")
+		}
+		if err := runRequest(flag.Arg(0), flag.Arg(1), opts); err != nil {
+			fmt.Fprintf(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
 	}
 
-	addr := os.Args[1]
-	secret := os.Args[2]
-	dir := os.Args[3]
+	if flag.NArg() != 3 {
+		log.Fatalln("Usage: receive [-request] [-direct] [-local] [-max-size <bytes>] [-extract] <relay-host>:<relay-port> <secret-code> <output-directory>")
+	}
 
-	if err := run(addr, secret, dir); err != nil {
+	addr := flag.Arg(0)
+	secret := flag.Arg(1)
+	dir := flag.Arg(2)
+
+	if err := run(addr, secret, dir, opts); err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
-func run(addr string, secret string, dir string) error {
+func run(addr string, secret string, dir string, opts []client.Option) error {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
-		return errors.New("no such directory")
+	c, err := client.Dial(ctx, addr, opts...)
+	if err != nil {
+		return fmt.Errorf("new service: %w", err)
+	}
+	defer c.Close()
+
+	if _, err := c.ReceiveTo(ctx, secret, dir); err != nil {
+		return fmt.Errorf("receiving file: %w", err)
 	}
+	fmt.Fprintf(os.Stderr, "received over %v\n", c.Path())
+	return nil
+}
 
-	con, err := net.Dial("tcp", addr)
+func runRequest(addr string, dir string, opts []client.Option) error {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := client.Dial(ctx, addr, opts...)
 	if err != nil {
 		return fmt.Errorf("new service: %w", err)
 	}
-	defer con.Close()
+	defer c.Close()
 
-	s := client.NewService(wire.NewEncoder(con), wire.NewDecoder(con))
+	requesting, err := c.Request(ctx, dir)
+	if err != nil {
+		return fmt.Errorf("requesting: %w", err)
+	}
 
-	r, err := s.Recv(secret)
+	fmt.Println(requesting.Secret)
+
+	if _, err := requesting.Wait(); err != nil {
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "received over %v\n", c.Path())
+	return nil
+}
+
+// runLocal discovers the sender's relay on the local network, and receives from it
+func runLocal(secret string, dir string, opts ...client.Option) error {
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	addr, err := lan.Discover(ctx, secret, lan.Options{})
 	if err != nil {
-		return fmt.Errorf("starting receive: %w", err)
+		return fmt.Errorf("finding sender: %w", err)
 	}
 
-	filePath := path.Join(dir, r.Name)
-	file, err := os.Create(filePath)
+	c, err := lan.Dial(ctx, addr, secret, opts...)
 	if err != nil {
-		return fmt.Errorf("creating output file: %w", err)
+		return fmt.Errorf("new service: %w", err)
 	}
-	defer file.Close()
+	defer c.Close()
 
-	if _, err := io.Copy(file, r.Body); err != nil {
+	if _, err := c.ReceiveTo(ctx, secret, dir); err != nil {
 		return fmt.Errorf("receiving file: %w", err)
 	}
 	return nil
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/proxy"
+	"go-storj-solution/pkg/transport"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// config of the relay, read from an optional JSON file and overridden by flags
+type config struct {
+	// Listen addresses for clients, see transport.Parse
+	Listen []string `json:"listen"`
+
+	TLS      tlsConfig      `json:"tls"`
+	Admin    adminConfig    `json:"admin"`
+	Metrics  metricsConfig  `json:"metrics"`
+	Limits   limitsConfig   `json:"limits"`
+	Timeouts timeoutsConfig `json:"timeouts"`
+	Secrets  secretsConfig  `json:"secrets"`
+	Policy   policyConfig   `json:"policy"`
+	Store    storeConfig    `json:"store"`
+	Cluster  clusterConfig  `json:"cluster"`
+	Log      logConfig      `json:"log"`
+
+	// file the config was read from, if any
+	file string
+}
+
+// tlsConfig is the certificate for "tls://" listen addresses
+type tlsConfig struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// adminConfig is the admin HTTP API, disabled without a listen address
+type adminConfig struct {
+	Listen string `json:"listen"`
+	Token  string `json:"token"`
+}
+
+// metricsConfig is the metrics HTTP endpoint, disabled without a listen address
+type metricsConfig struct {
+	Listen string `json:"listen"`
+}
+
+// limitsConfig is reloadable
+type limitsConfig struct {
+	MaxTransfers int `json:"max_transfers"`
+	BufferSize   int `json:"buffer_size"`
+}
+
+// timeoutsConfig is reloadable
+type timeoutsConfig struct {
+	Handshake    duration `json:"handshake"`
+	Wait         duration `json:"wait"`
+	SlowReceiver duration `json:"slow_receiver"`
+}
+
+// secretsConfig selects the secret generator
+type secretsConfig struct {
+	// Generator is either "random" or "fixed"
+	Generator string `json:"generator"`
+
+	// Length of random secrets
+	Length int `json:"length"`
+
+	// Fixed secret, for testing only
+	Fixed string `json:"fixed"`
+}
+
+// policyConfig is reloadable
+type policyConfig struct {
+	// AllowCustomCodes lets senders choose their own codes
+	AllowCustomCodes bool `json:"allow_custom_codes"`
+}
+
+// storeConfig enables uploads for receivers to fetch later, disabled without a directory
+type storeConfig struct {
+	Dir       string   `json:"dir"`
+	Quota     int64    `json:"quota"`
+	MaxSize   int64    `json:"max_size"`
+	Retention duration `json:"retention"`
+}
+
+// clusterConfig joins relays sharing a directory, disabled without a directory
+type clusterConfig struct {
+	// Directory shared by the relays, such as on a network file system
+	Directory string `json:"directory"`
+
+	// Advertise is the address other relays dial to reach this relay, see transport.Parse
+	Advertise string `json:"advertise"`
+}
+
+// logConfig is reloadable
+type logConfig struct {
+	Format string `json:"format"`
+	Level  string `json:"level"`
+}
+
+// duration is a time.Duration written as a string in JSON, such as "30s"
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return fmt.Errorf("duration must be a string: %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func defaultConfig() *config {
+	return &config{
+		Timeouts: timeoutsConfig{
+			Handshake:    duration(30 * time.Second),
+			SlowReceiver: duration(10 * time.Second),
+		},
+		Secrets: secretsConfig{
+			Generator: "random",
+			Length:    6,
+		},
+		Log: logConfig{
+			Format: "logfmt",
+			Level:  "info",
+		},
+	}
+}
+
+// flags binds a flag set to the config fields
+func (c *config) flags() *flag.FlagSet {
+	fs := flag.NewFlagSet("relay", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %v [flags] [tcp://|tls://|unix://|ws://]<address>...\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&c.file, "config", c.file, "path to a JSON config file, flags override the file")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "certificate file for tls:// addresses")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "private key file for tls:// addresses")
+	fs.StringVar(&c.Admin.Listen, "admin", c.Admin.Listen, "listen address for the admin HTTP API, disabled if empty")
+	fs.StringVar(&c.Admin.Token, "admin-token", envOr(adminTokenEnv, c.Admin.Token), "bearer token for the admin HTTP API, defaults to $"+adminTokenEnv+" and then the config file, which can't also set it when $"+adminTokenEnv+" is set")
+	fs.StringVar(&c.Metrics.Listen, "metrics", c.Metrics.Listen, "listen address for the metrics HTTP endpoint, disabled if empty")
+	fs.IntVar(&c.Limits.MaxTransfers, "max-transfers", c.Limits.MaxTransfers, "maximum waiting and active transfers, zero is unlimited")
+	fs.IntVar(&c.Limits.BufferSize, "buffer-size", c.Limits.BufferSize, "size in bytes of the buffers relaying transfers, zero is the default")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Handshake), "handshake-timeout", time.Duration(c.Timeouts.Handshake), "time allowed for a client to onboard, zero is unlimited")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.Wait), "wait-timeout", time.Duration(c.Timeouts.Wait), "time a sender waits for a receiver, zero is unlimited")
+	fs.DurationVar((*time.Duration)(&c.Timeouts.SlowReceiver), "slow-receiver-timeout", time.Duration(c.Timeouts.SlowReceiver), "time a broadcast waits for a lagging receiver before dropping it")
+	fs.StringVar(&c.Secrets.Generator, "secret-generator", c.Secrets.Generator, "secret generator, either random or fixed")
+	fs.IntVar(&c.Secrets.Length, "secret-length", c.Secrets.Length, "length of random secrets")
+	fs.StringVar(&c.Secrets.Fixed, "secret-fixed", c.Secrets.Fixed, "secret for the fixed generator, for testing only")
+	fs.BoolVar(&c.Policy.AllowCustomCodes, "allow-custom-codes", c.Policy.AllowCustomCodes, "allow senders to choose their own codes")
+	fs.StringVar(&c.Store.Dir, "store-dir", c.Store.Dir, "directory to keep uploads in until they are received, uploads are disabled if empty")
+	fs.Int64Var(&c.Store.Quota, "store-quota", c.Store.Quota, "total bytes of kept uploads, zero is unlimited")
+	fs.Int64Var(&c.Store.MaxSize, "store-max-size", c.Store.MaxSize, "largest upload in bytes, zero is unlimited")
+	fs.DurationVar((*time.Duration)(&c.Store.Retention), "store-retention", time.Duration(c.Store.Retention), "time uploads are kept for, zero keeps them until received")
+	fs.StringVar(&c.Cluster.Directory, "cluster-directory", c.Cluster.Directory, "directory shared by a cluster of relays, clustering is disabled if empty")
+	fs.StringVar(&c.Cluster.Advertise, "cluster-advertise", c.Cluster.Advertise, "address other relays of the cluster dial to reach this relay")
+	fs.StringVar(&c.Log.Format, "log-format", c.Log.Format, "log output format, either logfmt or json")
+	fs.StringVar(&c.Log.Level, "log-level", c.Log.Level, "minimum log level, one of debug, info, warn or error")
+	return fs
+}
+
+// adminTokenEnv is the environment variable with the admin token, so it needn't be in a flag or the config file
+const adminTokenEnv = "RELAY_ADMIN_TOKEN"
+
+// envOr returns the environment variable, or the fallback if it isn't set
+func envOr(key string, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
+
+// loadConfig builds the config from defaults, the config file and then flags.
+// Positional arguments are listen addresses and replace those in the config file.
+func loadConfig(args []string, output io.Writer) (*config, error) {
+	c := defaultConfig()
+	fs := c.flags()
+	fs.SetOutput(output)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if c.file != "" {
+		// start again from the file, then apply flags on top
+		file := c.file
+		c = defaultConfig()
+		if err := c.read(file); err != nil {
+			return nil, err
+		}
+		// the environment would silently replace the token in the file, so only one may set it
+		if _, ok := os.LookupEnv(adminTokenEnv); ok && c.Admin.Token != "" {
+			return nil, fmt.Errorf("admin token is set in both %v and $%v", file, adminTokenEnv)
+		}
+		fs = c.flags()
+		fs.SetOutput(output)
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+	}
+
+	if fs.NArg() > 0 {
+		c.Listen = fs.Args()
+	}
+
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// read a JSON config file, rejecting unknown fields
+func (c *config) read(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(c); err != nil {
+		return fmt.Errorf("parsing config %v: %w", file, err)
+	}
+	return nil
+}
+
+// validate reports all problems with the config at once
+func (c *config) validate() error {
+	var problems []string
+
+	if len(c.Listen) == 0 {
+		problems = append(problems, "no listen addresses")
+	}
+	usesTLS := false
+	for _, addr := range c.Listen {
+		if strings.HasPrefix(addr, "tls://") {
+			usesTLS = true
+		}
+	}
+	if usesTLS || c.TLS.Cert != "" || c.TLS.Key != "" {
+		if _, err := c.tlsConfig(); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if c.Admin.Listen != "" && c.Admin.Token == "" {
+		problems = append(problems, "admin API requires a token")
+	}
+	if c.Limits.MaxTransfers < 0 {
+		problems = append(problems, "max transfers must not be negative")
+	}
+	if b := c.Limits.BufferSize; b != 0 && (b < proxy.MinBufferSize || b > proxy.MaxBufferSize) {
+		problems = append(problems, fmt.Sprintf("buffer size must be between %v and %v", proxy.MinBufferSize, proxy.MaxBufferSize))
+	}
+	if c.Timeouts.Handshake < 0 || c.Timeouts.Wait < 0 || c.Timeouts.SlowReceiver < 0 {
+		problems = append(problems, "timeouts must not be negative")
+	}
+	if c.Store.Quota < 0 || c.Store.MaxSize < 0 || c.Store.Retention < 0 {
+		problems = append(problems, "store limits must not be negative")
+	}
+	if c.Cluster.Directory != "" && c.Cluster.Advertise == "" {
+		problems = append(problems, "cluster requires an address to advertise")
+	}
+	switch c.Secrets.Generator {
+	case "random":
+		// secrets are sent as short strings
+		if c.Secrets.Length < 1 || c.Secrets.Length > 255 {
+			problems = append(problems, "secret length must be between 1 and 255")
+		}
+	case "fixed":
+		if c.Secrets.Fixed == "" {
+			problems = append(problems, "fixed secret generator requires a secret")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown secret generator: %v", c.Secrets.Generator))
+	}
+	if _, err := newLogger(c.Log.Format, c.Log.Level); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// tlsConfig loads the certificate for TLS listeners
+func (c *config) tlsConfig() (*tls.Config, error) {
+	if c.TLS.Cert == "" || c.TLS.Key == "" {
+		return nil, errors.New("tls requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.Cert, c.TLS.Key)
+	if err != nil {
+		return nil, fmt.Errorf("loading tls certificate: %w", err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+}
+
+// secrets creates the configured secret generator
+func (c *config) secrets() proxy.Secrets {
+	if c.Secrets.Generator == "fixed" {
+		return proxy.NewFixedSecret(c.Secrets.Fixed)
+	}
+	return proxy.NewRandomSecrets(c.Secrets.Length, time.Now().UnixNano())
+}
+
+// store opens the configured store, which is nil when uploads are disabled
+func (c *config) store(logger log.Logger) (*proxy.Store, error) {
+	if c.Store.Dir == "" {
+		return nil, nil
+	}
+	return proxy.NewStore(c.Store.Dir, proxy.StoreOptions{
+		Quota:     c.Store.Quota,
+		MaxSize:   c.Store.MaxSize,
+		Retention: time.Duration(c.Store.Retention),
+	}, logger)
+}
+
+// cluster joins the configured cluster, which is nil when the relay runs alone
+func (c *config) cluster() (*proxy.Cluster, error) {
+	if c.Cluster.Directory == "" {
+		return nil, nil
+	}
+	opts := proxy.FileDirectoryOptions{Reachable: reachable}
+	if c.Timeouts.Wait > 0 {
+		// a transfer can't be joined once it has waited this long, so neither can its entry
+		opts.TTL = time.Duration(c.Timeouts.Handshake + c.Timeouts.Wait)
+	}
+	dir, err := proxy.NewFileDirectory(c.Cluster.Directory, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &proxy.Cluster{Directory: dir, Addr: c.Cluster.Advertise}, nil
+}
+
+// reachableTimeout limits how long checking another relay of the cluster holds up registering a secret
+const reachableTimeout = 500 * time.Millisecond
+
+// reachable dials the relay at addr to check it is still running
+func reachable(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), reachableTimeout)
+	defer cancel()
+	t, a := transport.Parse(addr)
+	conn, err := t.Dial(ctx, a)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// options are the reloadable settings of the proxy.Service
+func (c *config) options() proxy.Options {
+	return proxy.Options{
+		MaxTransfers:        c.Limits.MaxTransfers,
+		HandshakeTimeout:    time.Duration(c.Timeouts.Handshake),
+		WaitTimeout:         time.Duration(c.Timeouts.Wait),
+		AllowCustomCodes:    c.Policy.AllowCustomCodes,
+		SlowReceiverTimeout: time.Duration(c.Timeouts.SlowReceiver),
+		BufferSize:          c.Limits.BufferSize,
+	}
+}
+
+// restartRequired lists the sections that differ and can't be reloaded
+func (c *config) restartRequired(other *config) []string {
+	var changed []string
+	if strings.Join(c.Listen, ",") != strings.Join(other.Listen, ",") {
+		changed = append(changed, "listen")
+	}
+	if c.TLS != other.TLS {
+		changed = append(changed, "tls")
+	}
+	if c.Admin != other.Admin {
+		changed = append(changed, "admin")
+	}
+	if c.Metrics != other.Metrics {
+		changed = append(changed, "metrics")
+	}
+	if c.Secrets != other.Secrets {
+		changed = append(changed, "secrets")
+	}
+	if c.Store != other.Store {
+		changed = append(changed, "store")
+	}
+	if c.Cluster != other.Cluster {
+		changed = append(changed, "cluster")
+	}
+	return changed
+}
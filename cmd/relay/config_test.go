@@ -0,0 +1,144 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a config file for the test
+func writeConfig(t *testing.T, contents string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "relay.json")
+	if err := os.WriteFile(file, []byte(contents), 0600); err != nil {
+		t.Fatalf("write config: %v", err)
+	}
+	return file
+}
+
+func TestLoadConfig_FileAndFlags(t *testing.T) {
+	file := writeConfig(t, `{
+		"listen": [":8080", "ws://:8081/relay"],
+		"limits": {"max_transfers": 10},
+		"timeouts": {"wait": "5m"},
+		"log": {"format": "json", "level": "debug"}
+	}`)
+
+	c, err := loadConfig([]string{"-config", file, "-log-level", "warn"}, io.Discard)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(c.Listen) != 2 || c.Listen[1] != "ws://:8081/relay" {
+		t.Fatalf("unexpected listen: %v", c.Listen)
+	}
+	if c.Limits.MaxTransfers != 10 {
+		t.Fatalf("want 10, got %v", c.Limits.MaxTransfers)
+	}
+	if time.Duration(c.Timeouts.Wait) != 5*time.Minute {
+		t.Fatalf("want 5m, got %v", time.Duration(c.Timeouts.Wait))
+	}
+	if c.Log.Format != "json" {
+		t.Fatalf("want json, got %v", c.Log.Format)
+	}
+	// flag overrides file
+	if c.Log.Level != "warn" {
+		t.Fatalf("want warn, got %v", c.Log.Level)
+	}
+	// default kept when not in file
+	if c.Secrets.Length != 6 {
+		t.Fatalf("want 6, got %v", c.Secrets.Length)
+	}
+
+	// positional addresses replace those in the file
+	c, err = loadConfig([]string{"-config", file, ":9000"}, io.Discard)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if len(c.Listen) != 1 || c.Listen[0] != ":9000" {
+		t.Fatalf("unexpected listen: %v", c.Listen)
+	}
+}
+
+func TestLoadConfig_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		file string
+		want string
+	}{
+		{"no listen", nil, "", "no listen addresses"},
+		{"admin without token", []string{"-admin", ":9090", "-admin-token", "", ":8080"}, "", "admin API requires a token"},
+		{"tls without certificate", []string{"tls://:8443"}, "", "tls requires both a certificate and a key"},
+		{"bad secret length", []string{"-secret-length", "0", ":8080"}, "", "secret length"},
+		{"bad generator", []string{"-secret-generator", "dice", ":8080"}, "", "unknown secret generator"},
+		{"bad log level", []string{"-log-level", "loud", ":8080"}, "", "unknown log level"},
+		{"negative limit", []string{"-max-transfers", "-1", ":8080"}, "", "max transfers"},
+		{"small buffer size", []string{"-buffer-size", "16", ":8080"}, "", "buffer size"},
+		{"negative store quota", []string{"-store-quota", "-1", ":8080"}, "", "store limits"},
+		{"cluster without address", []string{"-cluster-directory", "/tmp/relays", ":8080"}, "", "cluster requires an address"},
+		{"unknown field", nil, `{"listen": [":8080"], "colour": "blue"}`, "unknown field"},
+		{"bad duration", nil, `{"listen": [":8080"], "timeouts": {"wait": "soon"}}`, "invalid duration"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := tt.args
+			if tt.file != "" {
+				args = append([]string{"-config", writeConfig(t, tt.file)}, args...)
+			}
+			_, err := loadConfig(args, io.Discard)
+			if err == nil {
+				t.Fatal("expected error")
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("want %q in %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_AdminToken(t *testing.T) {
+	if err := os.Setenv(adminTokenEnv, "from-env"); err != nil {
+		t.Fatalf("setenv: %v", err)
+	}
+	t.Cleanup(func() { os.Unsetenv(adminTokenEnv) })
+
+	// the environment is used unless a flag overrides it
+	c, err := loadConfig([]string{"-admin", ":9090", ":8080"}, io.Discard)
+	if err != nil || c.Admin.Token != "from-env" {
+		t.Fatalf("want from-env, got %v: %v", c, err)
+	}
+	c, err = loadConfig([]string{"-admin", ":9090", "-admin-token", "from-flag", ":8080"}, io.Discard)
+	if err != nil || c.Admin.Token != "from-flag" {
+		t.Fatalf("want from-flag, got %v: %v", c, err)
+	}
+
+	// and a config file can't also set it
+	file := writeConfig(t, `{"listen": [":8080"], "admin": {"listen": ":9090", "token": "from-file"}}`)
+	if _, err := loadConfig([]string{"-config", file}, io.Discard); err == nil || !strings.Contains(err.Error(), adminTokenEnv) {
+		t.Fatalf("want the token rejected, got %v", err)
+	}
+}
+
+func TestConfig_RestartRequired(t *testing.T) {
+	a := defaultConfig()
+	a.Listen = []string{":8080"}
+	b := defaultConfig()
+	b.Listen = []string{":8080"}
+	b.Log.Level = "debug"
+	b.Limits.MaxTransfers = 5
+
+	if changed := a.restartRequired(b); len(changed) != 0 {
+		t.Fatalf("reloadable changes require restart: %v", changed)
+	}
+
+	b.Listen = []string{":9000"}
+	b.Secrets.Length = 8
+	changed := a.restartRequired(b)
+	if strings.Join(changed, ",") != "listen,secrets" {
+		t.Fatalf("want listen,secrets, got %v", changed)
+	}
+}
@@ -1,53 +1,201 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"go-storj-solution/pkg/proxy"
+	"go-storj-solution/pkg/transport"
 	"net"
+	"net/http"
 	"os"
-	"time"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
 )
 
 func main() {
 
-	if len(os.Args) != 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %v :<port>", os.Args[0])
+	args := os.Args[1:]
+
+	cfg, err := loadConfig(args, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
 		os.Exit(1)
 	}
 
-	addr := os.Args[1]
-
-	if err := run(addr); err != nil {
+	if err := run(cfg, args); err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
-func run(addr string) error {
+// newLogger creates a levelled logger writing to stderr
+func newLogger(format string, minLevel string) (log.Logger, error) {
+	w := log.NewSyncWriter(os.Stderr)
+
+	var logger log.Logger
+	switch format {
+	case "logfmt":
+		logger = log.NewLogfmtLogger(w)
+	case "json":
+		logger = log.NewJSONLogger(w)
+	default:
+		return nil, fmt.Errorf("unknown log format: %v", format)
+	}
+
+	var allow level.Option
+	switch minLevel {
+	case "debug":
+		allow = level.AllowDebug()
+	case "info":
+		allow = level.AllowInfo()
+	case "warn":
+		allow = level.AllowWarn()
+	case "error":
+		allow = level.AllowError()
+	default:
+		return nil, fmt.Errorf("unknown log level: %v", minLevel)
+	}
+	return level.NewFilter(logger, allow), nil
+}
+
+// reloadableLogger delegates to a logger that can be replaced while in use
+type reloadableLogger struct {
+	v atomic.Value
+}
+
+func (l *reloadableLogger) set(logger log.Logger) {
+	// atomic.Value requires a consistent concrete type
+	l.v.Store(&logger)
+}
+
+func (l *reloadableLogger) Log(keyvals ...interface{}) error {
+	return (*l.v.Load().(*log.Logger)).Log(keyvals...)
+}
+
+func run(cfg *config, args []string) error {
 
-	l, err := net.Listen("tcp", addr)
+	base, err := newLogger(cfg.Log.Format, cfg.Log.Level)
 	if err != nil {
-		return fmt.Errorf("net listen: %w", err)
+		return err
 	}
-	defer l.Close()
+	reloadable := &reloadableLogger{}
+	reloadable.set(base)
+	logger := log.With(reloadable, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
 
-	w := log.NewSyncWriter(os.Stderr)
-	logger := log.NewLogfmtLogger(w)
-	logger = log.With(logger, "ts", log.DefaultTimestampUTC, "caller", log.DefaultCaller)
+	var listeners []net.Listener
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	for _, addr := range cfg.Listen {
+		t, a := transport.Parse(addr)
+		if strings.HasPrefix(addr, "tls://") {
+			config, err := cfg.tlsConfig()
+			if err != nil {
+				return err
+			}
+			t = transport.NewTLS(config)
+		}
+		l, err := t.Listen(a)
+		if err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	store, err := cfg.store(logger)
+	if err != nil {
+		return err
+	}
+	cluster, err := cfg.cluster()
+	if err != nil {
+		return err
+	}
 
-	//secrets := NewFixedSecret("abc123")
-	secrets := proxy.NewRandomSecrets(6, time.Now().UnixNano())
-	service := proxy.New(secrets, logger)
+	service := proxy.New(cfg.secrets(), logger)
 
 	go service.Run()
 
-	for {
-		conn, err := l.Accept()
+	opts := cfg.options()
+	opts.Store = store
+	opts.Cluster = cluster
+	service.Configure(opts)
+
+	errs := make(chan error, len(listeners)+2)
+
+	if cfg.Admin.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Admin.Listen)
+		if err != nil {
+			return fmt.Errorf("admin listen: %w", err)
+		}
+		defer l.Close()
+		go func() {
+			errs <- fmt.Errorf("admin API: %w", http.Serve(l, proxy.NewAdminHandler(service, cfg.Admin.Token)))
+		}()
+	}
+
+	if cfg.Metrics.Listen != "" {
+		l, err := net.Listen("tcp", cfg.Metrics.Listen)
 		if err != nil {
-			return fmt.Errorf("accepting connection: %w", err)
+			return fmt.Errorf("metrics listen: %w", err)
 		}
+		defer l.Close()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", proxy.NewMetricsHandler(service))
+		go func() {
+			errs <- fmt.Errorf("metrics: %w", http.Serve(l, mux))
+		}()
+	}
+
+	// SIGHUP reloads logging, limits, timeouts and policy
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	go func() {
+		for range hup {
+			next, err := loadConfig(args, os.Stderr)
+			if err != nil {
+				level.Error(logger).Log("msg", "reloading config failed", "err", err)
+				continue
+			}
+			if changed := cfg.restartRequired(next); len(changed) > 0 {
+				level.Warn(logger).Log("msg", "config changes require a restart", "sections", strings.Join(changed, ","))
+			}
+			// validated by loadConfig
+			base, _ := newLogger(next.Log.Format, next.Log.Level)
+			reloadable.set(base)
+			// the store and cluster can't be reloaded, so keep those already open
+			opts := next.options()
+			opts.Store = store
+			opts.Cluster = cluster
+			service.Configure(opts)
+			level.Info(logger).Log("msg", "reloaded config")
+		}
+	}()
 
-		go service.Onboard(conn)
+	for _, l := range listeners {
+		go func(l net.Listener) {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					errs <- fmt.Errorf("accepting connection: %w", err)
+					return
+				}
+
+				go service.Onboard(conn)
+			}
+		}(l)
 	}
+
+	return <-errs
 }
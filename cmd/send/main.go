@@ -1,67 +1,165 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
+	kitlog "github.com/go-kit/log"
 	"go-storj-solution/pkg/client"
-	"go-storj-solution/pkg/wire"
+	"go-storj-solution/pkg/lan"
 	"log"
-	"net"
 	"os"
+	"os/signal"
 )
 
 func main() {
-	if len(os.Args) != 3 {
-		log.Fatalln("Usage: send <relay-host>:<relay-port> <file-to-send>")
+	code := flag.String("code", "", "code for the receiver, instead of one generated by the relay")
+	receivers := flag.Int("receivers", 0, "number of receivers to broadcast to")
+	window := flag.Duration("window", 0, "time for more receivers to join a broadcast after the first")
+	store := flag.Bool("store", false, "upload for the relay to keep until received, instead of waiting for the receiver")
+	direct := flag.Bool("direct", false, "try connecting directly to the receiver, falling back to the relay")
+	local := flag.Bool("local", false, "announce the transfer on the local network instead of using a relay")
+	streams := flag.Int("streams", 0, "number of connections to send a file over in parallel, for high latency links")
+	asTar := flag.Bool("tar", false, "send a directory as a tar archive, which the receiver unpacks")
+	flag.Parse()
+
+	if *local {
+		if flag.NArg() != 1 {
+			log.Fatalln("Usage: send -local [-tar] <file-or-directory-to-send>")
+		}
+		if err := runLocal(flag.Arg(0), *asTar); err != nil {
+			fmt.Fprintf(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if flag.NArg() != 2 && flag.NArg() != 3 {
+		log.Fatalln("Usage: send [-code <code>] [-receivers <n>] [-window <duration>] [-store] [-direct] [-local] [-streams <n>] [-tar] <relay-host>:<relay-port> [<requested-code>] <file-or-directory-to-send>")
 	}
 
-	addr := os.Args[1]
-	filePath := os.Args[2]
+	addr := flag.Arg(0)
+	filePath := flag.Arg(flag.NArg() - 1)
+
+	var opts []client.Option
+	if flag.NArg() == 3 {
+		// push to a receiver that requested a file with receive -request
+		opts = append(opts, client.WithTo(flag.Arg(1)))
+	}
+	if *code != "" {
+		opts = append(opts, client.WithCode(*code))
+	}
+	if *store {
+		opts = append(opts, client.WithStore(true))
+	}
+	if *direct {
+		opts = append(opts, client.WithDirect(true))
+	}
+	if *receivers > 0 || *window > 0 {
+		opts = append(opts, client.WithReceivers(*receivers), client.WithWindow(*window))
+	}
+	if *streams > 1 {
+		opts = append(opts, client.WithStreams(*streams))
+	}
 
-	if err := run(addr, filePath); err != nil {
+	if err := run(addr, filePath, *asTar, opts); err != nil {
 		fmt.Fprintf(os.Stderr, err.Error())
 		os.Exit(1)
 	}
 }
 
-func run(addr string, filePath string) error {
+func run(addr string, filePath string, asTar bool, opts []client.Option) error {
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return fmt.Errorf("stating file: %w", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	c, err := client.Dial(ctx, addr, opts...)
+	if err != nil {
+		return fmt.Errorf("new service: %w", err)
+	}
+	defer c.Close()
 
-	file, err := os.Open(filePath)
+	sending, err := send(ctx, c, filePath, info, asTar)
 	if err != nil {
-		log.Fatalln("failed to opening file:", err)
+		return err
 	}
-	defer file.Close()
 
-	info, err := file.Stat()
+	fmt.Println(sending.Secret)
+
+	if err := sending.Wait(); err != nil {
+		return fmt.Errorf("failed sending file: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "sent over %v\n", sending.Path())
+	return nil
+}
+
+// runLocal sends through a relay of our own, announced on the local network
+func runLocal(filePath string, asTar bool) error {
+
+	info, err := os.Stat(filePath)
 	if err != nil {
-		log.Fatalln("stating file:", err)
+		return fmt.Errorf("stating file: %w", err)
 	}
 
-	request := &client.SendRequest{
-		Body:   file,
-		Name:   file.Name(),
-		Length: info.Size(),
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	relay, err := lan.Listen(":0", kitlog.NewNopLogger())
+	if err != nil {
+		return fmt.Errorf("local relay: %w", err)
 	}
+	defer relay.Close()
 
-	con, err := net.Dial("tcp", addr)
+	c, err := relay.Dial(ctx)
 	if err != nil {
 		return fmt.Errorf("new service: %w", err)
 	}
-	defer con.Close()
-
-	s := client.NewService(wire.NewEncoder(con), wire.NewDecoder(con))
+	defer c.Close()
 
-	response, err := s.Send(request)
+	sending, err := send(ctx, c, filePath, info, asTar)
 	if err != nil {
-		log.Fatalln("sending:", err)
+		return err
 	}
 
-	fmt.Println(response.Secret)
+	fmt.Println(sending.Secret)
 
-	select {
-	case err, gotError := <-response.Errors:
-		if gotError {
-			log.Fatalln("failed sending file:", err)
+	advertising, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		if err := relay.Advertise(advertising, sending.Secret, lan.Options{}); err != nil {
+			fmt.Fprintf(os.Stderr, "announcing transfer: %v\n", err)
 		}
+	}()
+
+	if err := sending.Wait(); err != nil {
+		return fmt.Errorf("failed sending file: %w", err)
 	}
+	// the receiver may not have everything the relay has read from us yet
+	relay.Wait()
 	return nil
 }
+
+// send starts sending a file or directory, or a directory as a tar archive
+func send(ctx context.Context, c *client.Client, filePath string, info os.FileInfo, asTar bool) (*client.Sending, error) {
+	var sending *client.Sending
+	var err error
+	if asTar && !info.IsDir() {
+		return nil, fmt.Errorf("%v isn't a directory to send as a tar archive", filePath)
+	}
+	if asTar {
+		sending, err = c.SendTar(ctx, filePath)
+	} else if info.IsDir() {
+		sending, err = c.SendDir(ctx, filePath)
+	} else {
+		sending, err = c.SendFile(ctx, filePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("sending: %w", err)
+	}
+	return sending, nil
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"log"
+	"os"
+)
+
+func main() {
+
+	args := os.Args[1:]
+	if len(args) > 1 {
+		log.Fatalln("Usage: wiredump [<captured-file>]")
+	}
+
+	var r io.Reader = os.Stdin
+	if len(args) == 1 {
+		file, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "opening file: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		r = file
+	}
+
+	w := bufio.NewWriter(os.Stdout)
+	err := wire.Dump(w, bufio.NewReader(r))
+	_ = w.Flush()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
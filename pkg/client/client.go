@@ -0,0 +1,656 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-storj-solution/pkg/transport"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrUsed is returned when a Client is used for more than one transfer
+var ErrUsed = errors.New("client: already used for a transfer")
+
+// ErrTooLarge is returned when a received file is larger than WithMaxSize allows
+var ErrTooLarge = errors.New("client: file too large")
+
+// ErrNoSpace is returned when there isn't enough free space for a received file
+var ErrNoSpace = errors.New("client: not enough free space")
+
+// Option configures a Client
+type Option func(*options)
+
+type options struct {
+	// transport to dial the relay with, chosen from the address if nil
+	transport transport.Transport
+
+	// dialTimeout limits connecting to the relay, zero is unlimited
+	dialTimeout time.Duration
+
+	// overwrite existing files when receiving
+	overwrite bool
+
+	// code chosen for sending, generated by the relay if empty
+	code string
+
+	// to is a code requested by a receiver to push to
+	to string
+
+	// receivers and window for broadcasting
+	receivers int
+	window    time.Duration
+
+	// store uploads sends for the relay to keep
+	store bool
+
+	// direct tries connecting directly to the peer, falling back to the relay
+	direct bool
+
+	// streams to send files over in parallel
+	streams int
+
+	// maxSize of files to receive in bytes, zero is unlimited
+	maxSize int64
+
+	// extract received tar archives into the output directory
+	extract bool
+}
+
+// WithTransport dials the relay with a specific transport instead of choosing one from the address
+func WithTransport(t transport.Transport) Option {
+	return func(o *options) {
+		o.transport = t
+	}
+}
+
+// WithDialTimeout limits how long connecting to the relay can take
+func WithDialTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.dialTimeout = d
+	}
+}
+
+// WithOverwrite allows received files to replace existing files
+func WithOverwrite(overwrite bool) Option {
+	return func(o *options) {
+		o.overwrite = overwrite
+	}
+}
+
+// WithCode sends with a code chosen by the sender instead of one generated by the relay.
+// The relay may reject the code with a *CodeError.
+func WithCode(code string) Option {
+	return func(o *options) {
+		o.code = code
+	}
+}
+
+// WithTo pushes a send to a receiver that requested a file with the code, see Client.Request
+func WithTo(code string) Option {
+	return func(o *options) {
+		o.to = code
+	}
+}
+
+// WithReceivers broadcasts a send to n receivers, see SendRequest.Receivers
+func WithReceivers(n int) Option {
+	return func(o *options) {
+		o.receivers = n
+	}
+}
+
+// WithWindow limits how long a broadcast waits for more receivers, see SendRequest.Window
+func WithWindow(d time.Duration) Option {
+	return func(o *options) {
+		o.window = d
+	}
+}
+
+// WithStore uploads sends for the relay to keep until they are received, see SendRequest.Store.
+// Sending.Wait returns once the relay has stored the upload, rather than once it has been received.
+func WithStore(store bool) Option {
+	return func(o *options) {
+		o.store = store
+	}
+}
+
+// WithDirect tries connecting directly to the peer for sends and receives, such as when both are on the same network.
+// The relay is used if either peer doesn't try, or a direct connection can't be made. See Sending.Path and Client.Path.
+func WithDirect(direct bool) Option {
+	return func(o *options) {
+		o.direct = direct
+	}
+}
+
+// WithStreams sends files split into ranges over n connections to the relay in parallel, up to MaxStreams,
+// for links where a single connection can't fill the bandwidth. Directories are sent over one connection.
+// Receivers open as many connections as the sender chose, whatever this option.
+func WithStreams(n int) Option {
+	return func(o *options) {
+		o.streams = n
+	}
+}
+
+// WithMaxSize rejects received files and directories larger than n bytes, before any of them is received.
+// The sender sees the rejection. Zero is unlimited.
+func WithMaxSize(n int64) Option {
+	return func(o *options) {
+		o.maxSize = n
+	}
+}
+
+// WithExtract unpacks a received tar archive, gzipped or not, into the output directory as it is received,
+// instead of writing the archive. Entries are sanitised and overwritten as for directories, and WithMaxSize and
+// the free space of the output directory limit the size of the unpacked entries rather than the archive.
+func WithExtract(extract bool) Option {
+	return func(o *options) {
+		o.extract = extract
+	}
+}
+
+// Client is a connection to the relay proxy for a single transfer.
+// The relay pairs one sender connection with one receiver connection, so a Client
+// can only be used for one send, receive or session, and must be closed afterwards.
+type Client struct {
+	conn    net.Conn
+	service Service
+	opts    options
+
+	// dial opens more connections to the relay, for parallel streams
+	dial StreamDialer
+
+	// guards used and path
+	sync.Mutex
+	used bool
+
+	// path a file was received over
+	path Path
+}
+
+// Dial connects to the relay proxy at addr. See transport.Parse for supported addresses.
+func Dial(ctx context.Context, addr string, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	t := o.transport
+	if t == nil {
+		t, addr = transport.Parse(addr)
+	}
+
+	dialCtx := ctx
+	if o.dialTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+		defer cancel()
+	}
+
+	conn, err := t.Dial(dialCtx, addr)
+	if err != nil {
+		return nil, fmt.Errorf("client.Dial: %w", err)
+	}
+
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		if o.dialTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, o.dialTimeout)
+			defer cancel()
+		}
+		return t.Dial(ctx, addr)
+	}
+
+	service := NewConnService(conn)
+	if o.direct {
+		service = NewDirectService(conn)
+	}
+
+	return &Client{
+		conn:    conn,
+		service: service,
+		opts:    o,
+		dial:    dial,
+	}, nil
+}
+
+// Close closes the connection to the relay proxy
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// use marks the Client as used, failing if it already was
+func (c *Client) use() error {
+	defer c.Unlock()
+	c.Lock()
+	if c.used {
+		return ErrUsed
+	}
+	c.used = true
+	return nil
+}
+
+// Sending is a send waiting for a receiver or in progress
+type Sending struct {
+	// Secret the receiver needs to receive the file
+	Secret string
+
+	errs     <-chan error
+	response *SendResponse
+
+	// body is closed when the send ends
+	body io.Closer
+
+	// client is closed when the send ends
+	client *Client
+}
+
+// Wait blocks until the send has finished, and closes the file and connection
+func (s *Sending) Wait() error {
+	err := <-s.errs
+	_ = s.body.Close()
+	_ = s.client.Close()
+	return err
+}
+
+// Path reports how the file travelled to the receiver, once Wait has returned
+func (s *Sending) Path() Path {
+	return s.response.Path()
+}
+
+// SendFile sends a single file.
+// Only the base name of the file is sent, not the directories in its path.
+func (c *Client) SendFile(ctx context.Context, path string) (*Sending, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("opening file: %w", err)
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("stating file: %w", err)
+	}
+	if info.IsDir() {
+		_ = file.Close()
+		return nil, fmt.Errorf("%v is a directory", path)
+	}
+
+	return c.send(ctx, &SendRequest{
+		Body:    file,
+		Name:    filepath.Base(path),
+		Length:  info.Size(),
+		Streams: c.opts.streams,
+		Dial:    c.dial,
+	}, file)
+}
+
+// SendDir sends a directory and the regular files and directories within it.
+// Other file types, such as symbolic links, are skipped.
+func (c *Client) SendDir(ctx context.Context, path string) (*Sending, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+
+	entries, length, err := scanDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("scanning directory: %w", err)
+	}
+
+	body := newDirReader(path, entries)
+	return c.send(ctx, &SendRequest{
+		Body:   body,
+		Name:   filepath.Base(path) + "/",
+		Length: length,
+	}, body)
+}
+
+// SendTar sends a directory as a tar archive written as it is sent, for receivers to unpack.
+// The archive is named after the directory with a .tar extension, and its entries are under the directory's name.
+// Only regular files and directories are archived, as with SendDir.
+func (c *Client) SendTar(ctx context.Context, path string) (*Sending, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(path); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("no such directory: %v", path)
+	}
+	// the archive is named after the directory, which a relative path such as "." doesn't have
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("no such directory: %w", err)
+	}
+
+	body := newTarReader(path)
+	return c.send(ctx, &SendRequest{
+		Body:   body,
+		Name:   filepath.Base(path) + ".tar",
+		Length: -1,
+		Tar:    true,
+	}, body)
+}
+
+func (c *Client) send(ctx context.Context, r *SendRequest, body io.Closer) (*Sending, error) {
+	r.Code = c.opts.code
+	r.To = c.opts.to
+	r.Receivers = c.opts.receivers
+	r.Window = c.opts.window
+	r.Store = c.opts.store
+	response, err := c.service.SendContext(ctx, r)
+	if err != nil {
+		_ = body.Close()
+		return nil, err
+	}
+	return &Sending{
+		Secret:   response.Secret,
+		errs:     response.Errors,
+		response: response,
+		body:     body,
+		client:   c,
+	}, nil
+}
+
+// ReceiveTo receives a file or directory into dir, and returns the path of what was written.
+// Names sent by the sender are sanitised so nothing is written outside of dir.
+// Partially received files are removed if the transfer fails.
+func (c *Client) ReceiveTo(ctx context.Context, secret string, dir string) (string, error) {
+	if err := c.use(); err != nil {
+		return "", err
+	}
+	defer c.Close()
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("no such directory: %v", dir)
+	}
+
+	r, err := c.service.RecvContext(ctx, secret)
+	if err != nil {
+		return "", fmt.Errorf("starting receive: %w", err)
+	}
+
+	return c.save(ctx, r, dir)
+}
+
+// Requesting is a request for a file, waiting for a sender to push it
+type Requesting struct {
+	// Secret the sender needs to push the file
+	Secret string
+
+	response *RequestResponse
+	client   *Client
+	dir      string
+
+	// ctx the request was made with
+	ctx context.Context
+}
+
+// Wait blocks until a sender has pushed a file, and returns the path of what was written.
+// The connection is closed afterwards.
+func (r *Requesting) Wait() (string, error) {
+	defer r.client.Close()
+
+	recv, err := r.response.Wait()
+	if err != nil {
+		return "", fmt.Errorf("starting receive: %w", err)
+	}
+	return r.client.save(r.ctx, recv, r.dir)
+}
+
+// Request asks the relay for a code that a sender can push a file to, with WithTo.
+// The pushed file or directory is written to dir, as with ReceiveTo.
+func (c *Client) Request(ctx context.Context, dir string) (*Requesting, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		_ = c.Close()
+		return nil, fmt.Errorf("no such directory: %v", dir)
+	}
+
+	response, err := c.service.RequestContext(ctx)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("requesting code: %w", err)
+	}
+
+	return &Requesting{
+		Secret:   response.Secret,
+		response: response,
+		client:   c,
+		dir:      dir,
+		ctx:      ctx,
+	}, nil
+}
+
+// OpenSession opens a two-way session that a peer can join with the session's Secret.
+// Closing the session closes the Client.
+func (c *Client) OpenSession(ctx context.Context) (*Session, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+	session, err := c.service.OpenSessionContext(ctx)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("opening session: %w", err)
+	}
+	return session, nil
+}
+
+// JoinSession joins a two-way session opened by a peer.
+// Closing the session closes the Client.
+func (c *Client) JoinSession(ctx context.Context, secret string) (*Session, error) {
+	if err := c.use(); err != nil {
+		return nil, err
+	}
+	session, err := c.service.JoinSessionContext(ctx, secret)
+	if err != nil {
+		_ = c.Close()
+		return nil, fmt.Errorf("joining session: %w", err)
+	}
+	return session, nil
+}
+
+// Path reports how a received file travelled from the sender, once it has been received
+func (c *Client) Path() Path {
+	defer c.Unlock()
+	c.Lock()
+	if c.path == "" {
+		return PathRelay
+	}
+	return c.path
+}
+
+// save writes a received file or directory into dir
+func (c *Client) save(ctx context.Context, r *RecvResponse, dir string) (string, error) {
+	c.Lock()
+	c.path = r.Path
+	c.Unlock()
+
+	// the sender is told if the file won't fit, rather than sending it for nothing
+	if err := c.checkSize(r, dir); err != nil {
+		_ = r.Reject(err.Error())
+		return "", err
+	}
+
+	if r.Tar || (c.opts.extract && !strings.HasSuffix(r.Name, "/")) {
+		return c.extract(r, dir)
+	}
+
+	if c.opts.maxSize > 0 && r.Length < 0 && r.Body != nil {
+		// the size can only be checked as the body arrives
+		r.Body = &maxReader{r: r.Body, max: c.opts.maxSize}
+	}
+
+	if strings.HasSuffix(r.Name, "/") {
+		target, err := safeJoin(dir, strings.TrimSuffix(r.Name, "/"))
+		if err != nil {
+			return "", err
+		}
+		if err := receiveDir(r.Body, target, c.opts.overwrite); err != nil {
+			return "", err
+		}
+		return target, nil
+	}
+
+	target, err := safeJoin(dir, r.Name)
+	if err != nil {
+		return "", err
+	}
+	if r.Streams > 0 {
+		if err := c.receiveStreams(ctx, r, target); err != nil {
+			return "", err
+		}
+		return target, nil
+	}
+	if err := receiveFile(r.Body, r.Length, target, c.opts.overwrite); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
+// extract unpacks a received archive into dir. Returns the directory a tagged archive
+// of a directory was unpacked to, or dir for other archives.
+func (c *Client) extract(r *RecvResponse, dir string) (string, error) {
+	if r.Body == nil {
+		// ranges arrive out of order, so can't be unpacked as they are received
+		err := errors.New("can't extract an archive sent in parallel streams")
+		_ = r.Reject(err.Error())
+		return "", err
+	}
+	target := dir
+	if r.Tar {
+		var err error
+		if target, err = safeJoin(dir, strings.TrimSuffix(r.Name, ".tar")); err != nil {
+			_ = r.Reject(err.Error())
+			return "", err
+		}
+	}
+
+	// the archive's length says little about what it unpacks to, so the limits apply to what is written
+	free, err := freeSpace(dir)
+	if err != nil {
+		return "", fmt.Errorf("checking free space: %w", err)
+	}
+	limit := extractLimit{maxSize: c.opts.maxSize, free: free}
+	if err := extractArchive(r.Body, dir, c.opts.overwrite, limit); err != nil {
+		return "", fmt.Errorf("extracting %v: %w", r.Name, err)
+	}
+	return target, nil
+}
+
+// maxReader fails with ErrTooLarge once more than max bytes have been read, for bodies of unknown length
+type maxReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (m *maxReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if m.n > m.max {
+		return n, fmt.Errorf("%w: more than %v bytes", ErrTooLarge, m.max)
+	}
+	return n, err
+}
+
+// checkSize checks a received file is within the maximum size, and fits in the free space of dir
+func (c *Client) checkSize(r *RecvResponse, dir string) error {
+	if c.opts.maxSize > 0 && r.Length > c.opts.maxSize {
+		return fmt.Errorf("%w: %v bytes, the maximum is %v", ErrTooLarge, r.Length, c.opts.maxSize)
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("checking free space: %w", err)
+	}
+	if free >= 0 && r.Length > free {
+		return fmt.Errorf("%w: %v bytes, but %v are free in %v", ErrNoSpace, r.Length, free, dir)
+	}
+	return nil
+}
+
+// safeJoin joins a slash separated name sent by a peer to dir, rejecting names that escape dir
+func safeJoin(dir string, name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("unsafe name: %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("unsafe name: %q", name)
+		}
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+// receiveFile writes r to a new file at path, removing the file if writing fails.
+// Space for length bytes is reserved first, so a full disk fails before anything is received.
+func receiveFile(r io.Reader, length int64, path string, overwrite bool) error {
+	file, err := createFile(path, overwrite)
+	if err != nil {
+		return err
+	}
+	if err := preallocate(file, 0, length); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("creating output file: %w", err)
+	}
+
+	if _, err := io.Copy(file, r); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// receiveStreams writes a file sent in parallel streams to a new file at path, removing the file if writing fails
+func (c *Client) receiveStreams(ctx context.Context, r *RecvResponse, path string) error {
+	file, err := createFile(path, c.opts.overwrite)
+	if err != nil {
+		return err
+	}
+	if err := preallocate(file, 0, r.Length); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("creating output file: %w", err)
+	}
+
+	if err := r.ReceiveStreams(ctx, file, c.dial); err != nil {
+		_ = file.Close()
+		_ = os.Remove(path)
+		return fmt.Errorf("receiving file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("closing output file: %w", err)
+	}
+	return nil
+}
+
+// createFile creates a file to receive into, failing if it exists unless overwriting
+func createFile(path string, overwrite bool) (*os.File, error) {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	file, err := os.OpenFile(path, flags, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("creating output file: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,672 @@
+package client_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/proxy"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// startRelay runs a relay on an in-memory transport until the test ends
+func startRelay(t *testing.T) transport.Transport {
+	t.Helper()
+	tr := transport.NewMemory()
+	l, err := tr.Listen("relay")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	service := proxy.New(proxy.NewRandomSecrets(6, 1), log.NewNopLogger())
+	go service.Run()
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go service.Onboard(conn)
+		}
+	}()
+	return tr
+}
+
+// transfer sends with the send function and receives into dir
+func transfer(t *testing.T, tr transport.Transport, dir string,
+	send func(c *client.Client) (*client.Sending, error), opts ...client.Option) (string, error) {
+	t.Helper()
+	ctx := context.Background()
+
+	sender, err := client.Dial(ctx, "relay", client.WithTransport(tr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := send(sender)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	receiver, err := client.Dial(ctx, "relay", append(opts, client.WithTransport(tr))...)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	path, recvErr := receiver.ReceiveTo(ctx, sending.Secret, dir)
+	if recvErr != nil {
+		sender.Close()
+	}
+
+	if err := sending.Wait(); err != nil && recvErr == nil {
+		t.Fatalf("wait: %v", err)
+	}
+	return path, recvErr
+}
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	return string(bs)
+}
+
+func TestClient_SendFile(t *testing.T) {
+	tr := startRelay(t)
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dst := t.TempDir()
+
+	send := func(c *client.Client) (*client.Sending, error) {
+		return c.SendFile(context.Background(), src)
+	}
+
+	path, err := transfer(t, tr, dst, send)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if path != filepath.Join(dst, "hello.txt") {
+		t.Fatalf("want %v, got %v", filepath.Join(dst, "hello.txt"), path)
+	}
+	if got := readFile(t, path); got != "hello world" {
+		t.Fatalf("want hello world, got %v", got)
+	}
+
+	// receiving again doesn't overwrite by default
+	if _, err := transfer(t, tr, dst, send); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("want %v, got %v", fs.ErrExist, err)
+	}
+
+	if _, err := transfer(t, tr, dst, send, client.WithOverwrite(true)); err != nil {
+		t.Fatalf("overwrite: %v", err)
+	}
+}
+
+func TestClient_SendFileParallel(t *testing.T) {
+	tr := startRelay(t)
+	ctx := context.Background()
+
+	for _, tt := range []struct {
+		name    string
+		length  int
+		streams int
+	}{
+		{"uneven ranges", 1000003, 4},
+		{"more streams than bytes", 3, 8},
+		{"empty", 0, 2},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body := make([]byte, tt.length)
+			for i := range body {
+				body[i] = byte(i * 7)
+			}
+			src := filepath.Join(t.TempDir(), "data.bin")
+			if err := os.WriteFile(src, body, 0644); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			dst := t.TempDir()
+
+			sender, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithStreams(tt.streams))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			sending, err := sender.SendFile(ctx, src)
+			if err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			// the receiver opens as many streams as the sender chose
+			receiver, err := client.Dial(ctx, "relay", client.WithTransport(tr))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			path, err := receiver.ReceiveTo(ctx, sending.Secret, dst)
+			if err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+			if err := sending.Wait(); err != nil {
+				t.Fatalf("wait: %v", err)
+			}
+			if got := readFile(t, path); got != string(body) {
+				t.Fatalf("received %v bytes differ from the %v sent", len(got), len(body))
+			}
+		})
+	}
+}
+
+func TestClient_SendFileParallelIncomplete(t *testing.T) {
+	tr := startRelay(t)
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "data.bin")
+	if err := os.WriteFile(src, []byte(strings.Repeat("x", 1000)), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	sender, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithStreams(2))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := sender.SendFile(ctx, src)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	conn, err := tr.Dial(ctx, "relay")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	recv, err := client.NewConnService(conn).Recv(sending.Secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Streams != 2 || recv.Length != 1000 {
+		t.Fatalf("want 2 streams of 1000 bytes, got %v of %v", recv.Streams, recv.Length)
+	}
+
+	// a receiver writing to a file that fails part way through doesn't acknowledge its range
+	dial := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return tr.Dial(ctx, "relay")
+	}
+	if err := recv.ReceiveStreams(ctx, failingWriter{}, dial); err == nil {
+		t.Fatal("expected receiving to fail")
+	}
+	if err := sending.Wait(); err == nil {
+		t.Fatal("expected sending to fail")
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) WriteAt(p []byte, off int64) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func TestClient_SendDir(t *testing.T) {
+	tr := startRelay(t)
+
+	src := filepath.Join(t.TempDir(), "bundle")
+	files := map[string]string{
+		"a.txt":         "first",
+		"sub/b.txt":     "second",
+		"sub/deep/c.md": "third",
+		"empty.txt":     "",
+		// paths longer than a short string
+		strings.Repeat("directory-name/", 20) + "deep.txt": "fourth",
+		strings.Repeat("каталог/", 20) + "файл.txt":        "fifth",
+	}
+	for name, contents := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := os.Mkdir(filepath.Join(src, "nothing"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	dst := t.TempDir()
+
+	path, err := transfer(t, tr, dst, func(c *client.Client) (*client.Sending, error) {
+		return c.SendDir(context.Background(), src)
+	})
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if path != filepath.Join(dst, "bundle") {
+		t.Fatalf("want %v, got %v", filepath.Join(dst, "bundle"), path)
+	}
+
+	for name, contents := range files {
+		if got := readFile(t, filepath.Join(path, filepath.FromSlash(name))); got != contents {
+			t.Fatalf("%v: want %v, got %v", name, contents, got)
+		}
+	}
+	if info, err := os.Stat(filepath.Join(path, "nothing")); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not received: %v", err)
+	}
+}
+
+func TestClient_MaxSize(t *testing.T) {
+	tr := startRelay(t)
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "big.bin")
+	if err := os.WriteFile(src, make([]byte, 1000), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dst := t.TempDir()
+
+	sender, err := client.Dial(ctx, "relay", client.WithTransport(tr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := sender.SendFile(ctx, src)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	receiver, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithMaxSize(999))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if _, err := receiver.ReceiveTo(ctx, sending.Secret, dst); !errors.Is(err, client.ErrTooLarge) {
+		t.Fatalf("want %v, got %v", client.ErrTooLarge, err)
+	}
+
+	// the sender is told why
+	var rejected *client.RejectedError
+	if err := sending.Wait(); !errors.As(err, &rejected) || !strings.Contains(rejected.Reason, "too large") {
+		t.Fatalf("want rejected as too large, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "big.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want nothing written, got %v", err)
+	}
+
+	// a file within the limit is received
+	send := func(c *client.Client) (*client.Sending, error) {
+		return c.SendFile(ctx, src)
+	}
+	if _, err := transfer(t, tr, dst, send, client.WithMaxSize(1000)); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+}
+
+func TestClient_Extract(t *testing.T) {
+	tr := startRelay(t)
+
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	for name, contents := range map[string]string{"site/index.html": "<h1>hi</h1>", "site/css/main.css": "h1 {}"} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(contents))}); err != nil {
+			t.Fatalf("header: %v", err)
+		}
+		if _, err := tw.Write([]byte(contents)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	src := filepath.Join(t.TempDir(), "site.tar.gz")
+	if err := os.WriteFile(src, archive.Bytes(), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dst := t.TempDir()
+
+	path, err := transfer(t, tr, dst, func(c *client.Client) (*client.Sending, error) {
+		return c.SendFile(context.Background(), src)
+	}, client.WithExtract(true))
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if path != dst {
+		t.Fatalf("want %v, got %v", dst, path)
+	}
+	if got := readFile(t, filepath.Join(dst, "site", "css", "main.css")); got != "h1 {}" {
+		t.Fatalf("want h1 {}, got %v", got)
+	}
+	// the archive itself isn't written
+	if _, err := os.Stat(filepath.Join(dst, "site.tar.gz")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want no archive, got %v", err)
+	}
+}
+
+func TestClient_ExtractMaxSize(t *testing.T) {
+	tr := startRelay(t)
+
+	// a megabyte of zeros compresses to well under the limit, but unpacks to far more
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	if err := tw.WriteHeader(&tar.Header{Name: "zeros.bin", Mode: 0644, Size: 1 << 20}); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 1<<20)); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	const maxSize = 1 << 16
+	if archive.Len() >= maxSize {
+		t.Fatalf("archive of %v bytes doesn't compress", archive.Len())
+	}
+	src := filepath.Join(t.TempDir(), "bomb.tar.gz")
+	if err := os.WriteFile(src, archive.Bytes(), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dst := t.TempDir()
+
+	_, err := transfer(t, tr, dst, func(c *client.Client) (*client.Sending, error) {
+		return c.SendFile(context.Background(), src)
+	}, client.WithExtract(true), client.WithMaxSize(maxSize))
+	if !errors.Is(err, client.ErrTooLarge) {
+		t.Fatalf("want %v, got %v", client.ErrTooLarge, err)
+	}
+	if _, err := os.Stat(filepath.Join(dst, "zeros.bin")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("want nothing unpacked, got %v", err)
+	}
+}
+
+func TestClient_SendTar(t *testing.T) {
+	tr := startRelay(t)
+
+	src := filepath.Join(t.TempDir(), "bundle")
+	files := map[string]string{
+		"a.txt":     "first",
+		"sub/b.txt": strings.Repeat("second", 20000),
+		"empty.txt": "",
+		// names longer than the 100 bytes of a plain tar header
+		strings.Repeat("directory-name/", 10) + "deep.txt": "third",
+	}
+	for name, contents := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	send := func(c *client.Client) (*client.Sending, error) {
+		return c.SendTar(context.Background(), src)
+	}
+
+	// the archive is tagged, so it is unpacked without asking
+	dst := t.TempDir()
+	path, err := transfer(t, tr, dst, send)
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if path != filepath.Join(dst, "bundle") {
+		t.Fatalf("want %v, got %v", filepath.Join(dst, "bundle"), path)
+	}
+	for name, contents := range files {
+		if got := readFile(t, filepath.Join(path, filepath.FromSlash(name))); got != contents {
+			t.Fatalf("%v: want %v bytes, got %v", name, len(contents), len(got))
+		}
+	}
+
+	// its length isn't known up front, so the limit applies as it arrives
+	if _, err := transfer(t, tr, t.TempDir(), send, client.WithMaxSize(10000)); !errors.Is(err, client.ErrTooLarge) {
+		t.Fatalf("want %v, got %v", client.ErrTooLarge, err)
+	}
+}
+
+func TestClient_SendTarWorkingDir(t *testing.T) {
+	tr := startRelay(t)
+
+	src := filepath.Join(t.TempDir(), "bundle")
+	if err := os.MkdirAll(src, 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("first"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(src); err != nil {
+		t.Fatalf("chdir: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	// the working directory is sent under its own name
+	dst := t.TempDir()
+	path, err := transfer(t, tr, dst, func(c *client.Client) (*client.Sending, error) {
+		return c.SendTar(context.Background(), ".")
+	})
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if path != filepath.Join(dst, "bundle") {
+		t.Fatalf("want %v, got %v", filepath.Join(dst, "bundle"), path)
+	}
+	if got := readFile(t, filepath.Join(path, "a.txt")); got != "first" {
+		t.Fatalf("want first, got %v", got)
+	}
+}
+
+func TestClient_Used(t *testing.T) {
+	tr := startRelay(t)
+
+	c, err := client.Dial(context.Background(), "relay", client.WithTransport(tr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "f")
+	if err := os.WriteFile(src, nil, 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := c.SendFile(context.Background(), src); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if _, err := c.ReceiveTo(context.Background(), "abc", dir); err != client.ErrUsed {
+		t.Fatalf("want %v, got %v", client.ErrUsed, err)
+	}
+}
+
+func TestClient_Request(t *testing.T) {
+	tr := startRelay(t)
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	dst := t.TempDir()
+
+	receiver, err := client.Dial(ctx, "relay", client.WithTransport(tr))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	requesting, err := receiver.Request(ctx, dst)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+
+	sender, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithTo(requesting.Secret))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := sender.SendFile(ctx, src)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	path, err := requesting.Wait()
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if err := sending.Wait(); err != nil {
+		t.Fatalf("send wait: %v", err)
+	}
+	if got := readFile(t, path); got != "hello world" {
+		t.Fatalf("want hello world, got %v", got)
+	}
+}
+
+func TestClient_Direct(t *testing.T) {
+	tests := []struct {
+		name     string
+		sender   bool
+		receiver bool
+		want     client.Path
+	}{
+		{name: "both direct", sender: true, receiver: true, want: client.PathDirect},
+		{name: "only sender direct", sender: true, want: client.PathRelay},
+		{name: "only receiver direct", receiver: true, want: client.PathRelay},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := startRelay(t)
+			ctx := context.Background()
+
+			src := filepath.Join(t.TempDir(), "hello.txt")
+			if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+
+			sender, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithDirect(tt.sender))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			sending, err := sender.SendFile(ctx, src)
+			if err != nil {
+				t.Fatalf("send: %v", err)
+			}
+
+			// the relay is in memory, so a direct connection is made over loopback
+			receiver, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithDirect(tt.receiver))
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			path, err := receiver.ReceiveTo(ctx, sending.Secret, t.TempDir())
+			if err != nil {
+				t.Fatalf("receive: %v", err)
+			}
+			if err := sending.Wait(); err != nil {
+				t.Fatalf("wait: %v", err)
+			}
+
+			if got := readFile(t, path); got != "hello world" {
+				t.Fatalf("want hello world, got %v", got)
+			}
+			if sending.Path() != tt.want || receiver.Path() != tt.want {
+				t.Fatalf("want %v, got sender %v and receiver %v", tt.want, sending.Path(), receiver.Path())
+			}
+		})
+	}
+}
+
+func TestClient_DirectFallback(t *testing.T) {
+	tr := startRelay(t)
+	ctx := context.Background()
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	sender, err := client.Dial(ctx, "relay", client.WithTransport(tr), client.WithDirect(true))
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := sender.SendFile(ctx, src)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// a receiver offering an address nothing listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	unreachable := l.Addr().String()
+	l.Close()
+
+	conn, err := tr.Dial(ctx, "relay")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+	enc, dec := wire.NewEncoder(conn), wire.NewDecoder(conn)
+	for _, b := range []client.Side{client.MsgDirect, client.MsgRecv} {
+		if err := enc.EncodeByte(byte(b)); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+	if err := enc.EncodeString(sending.Secret); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if b, err := dec.DecodeByte(); b != byte(client.MsgDirect) || err != nil {
+		t.Fatalf("want direct, got %v: %v", b, err)
+	}
+	if err := enc.EncodeString(unreachable); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeString("nonce"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	// the sender falls back to the relay
+	if b, err := dec.DecodeByte(); b != 'r' || err != nil {
+		t.Fatalf("want relay path, got %v: %v", b, err)
+	}
+	if name, err := dec.DecodeString(); name != "hello.txt" || err != nil {
+		t.Fatalf("want hello.txt, got %v: %v", name, err)
+	}
+	// the file is announced with its length, and sent once it is accepted
+	if n, err := dec.DecodeInt64(); n != int64(len("hello world")) || err != nil {
+		t.Fatalf("want length %v, got %v: %v", len("hello world"), n, err)
+	}
+	if err := enc.EncodeByte('a'); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	body, err := dec.DecodeReader()
+	if err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if bs, err := io.ReadAll(body); string(bs) != "hello world" || err != nil {
+		t.Fatalf("want hello world, got %s: %v", bs, err)
+	}
+	conn.Close()
+
+	if err := sending.Wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if sending.Path() != client.PathRelay {
+		t.Fatalf("want relay, got %v", sending.Path())
+	}
+}
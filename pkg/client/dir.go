@@ -0,0 +1,356 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A directory is sent as a single body containing a sequence of entries.
+// Each entry starts with a byte for its kind followed by its slash separated path
+// relative to the directory. File entries are then followed by a stream of the file contents.
+// Sparse file entries are followed by the size of the file, a list of the extents holding data,
+// and a stream of the data of those extents, so the holes between them aren't sent.
+// The sequence ends with a single entryEnd byte.
+const (
+	entryFile   byte = 'f'
+	entrySparse byte = 's'
+	entryDir    byte = 'd'
+	entryEnd    byte = 'e'
+)
+
+// entry of a directory being sent
+type entry struct {
+	kind byte
+
+	// path relative to the directory, slash separated
+	path string
+
+	// size of a file
+	size int64
+
+	// extents holding the data of a sparse file
+	extents []extent
+}
+
+// extent of a sparse file holding data
+type extent struct {
+	Offset int64 `wire:"1"`
+	Length int64 `wire:"2"`
+}
+
+// dataLength is the bytes of data in the extents
+func dataLength(extents []extent) int64 {
+	var n int64
+	for _, e := range extents {
+		n += e.Length
+	}
+	return n
+}
+
+// encodedLength is the number of bytes the entry takes in a directory body
+func (e entry) encodedLength() int64 {
+	// kind frame + path frame
+	n := 2 + wire.LongStringLength(e.path)
+	switch e.kind {
+	case entryFile:
+		// stream frame type + int64 length + contents
+		n += 1 + 8 + e.size
+	case entrySparse:
+		// size frame + extents + stream frame type + int64 length + data
+		n += 1 + 8 + extentsLength(e.extents) + 1 + 8 + dataLength(e.extents)
+	}
+	return n
+}
+
+// extentsLength is the number of bytes the extents take when encoded
+func extentsLength(extents []extent) int64 {
+	w := &countingWriter{}
+	// encoding a slice of records to a counter can't fail
+	_ = wire.NewEncoder(w).Encode(extents)
+	return w.n
+}
+
+// countingWriter counts the bytes written to it
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// scanDir lists the entries of a directory and the length of the body that sends them
+func scanDir(root string) ([]entry, int64, error) {
+	var entries []entry
+	length := int64(2) // end frame
+
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == root {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		e := entry{path: filepath.ToSlash(rel)}
+		if len(e.path) > wire.DefaultMaxLongString {
+			return fmt.Errorf("path too long: %v", path)
+		}
+		switch {
+		case d.IsDir():
+			e.kind = entryDir
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			e.kind = entryFile
+			e.size = info.Size()
+			if e.extents, err = sparseExtents(path, e.size); err != nil {
+				return err
+			}
+			if e.extents != nil {
+				e.kind = entrySparse
+			}
+		default:
+			return nil
+		}
+		entries = append(entries, e)
+		length += e.encodedLength()
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return entries, length, nil
+}
+
+// sparseExtents lists the extents holding data of a file with holes, or nil if it has none
+func sparseExtents(path string, size int64) ([]extent, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	extents, err := dataExtents(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("finding holes in %v: %w", path, err)
+	}
+	if dataLength(extents) == size {
+		return nil, nil
+	}
+	if extents == nil {
+		// the file is a single hole
+		extents = []extent{}
+	}
+	return extents, nil
+}
+
+// dirReader streams the entries of a directory as a body
+type dirReader struct {
+	*io.PipeReader
+}
+
+func newDirReader(root string, entries []entry) *dirReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeDir(pw, root, entries))
+	}()
+	return &dirReader{PipeReader: pr}
+}
+
+// writeDir encodes the entries and their file contents
+func writeDir(w io.Writer, root string, entries []entry) error {
+	enc := wire.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.EncodeByte(e.kind); err != nil {
+			return err
+		}
+		if err := enc.EncodeLongString(e.path); err != nil {
+			return err
+		}
+		path := filepath.Join(root, filepath.FromSlash(e.path))
+		switch e.kind {
+		case entryFile:
+			if err := writeFile(enc, path, e.size); err != nil {
+				return err
+			}
+		case entrySparse:
+			if err := writeSparse(enc, path, e); err != nil {
+				return err
+			}
+		}
+	}
+	return enc.EncodeByte(entryEnd)
+}
+
+// writeFile encodes the contents of a file, which must not have changed size since being scanned
+func writeFile(enc wire.Encoder, path string, size int64) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := enc.EncodeReader(file, size); err != nil {
+		return fmt.Errorf("sending %v: %w", path, err)
+	}
+	return nil
+}
+
+// writeSparse encodes the size, extents and data of a sparse file, which must not have changed since being scanned
+func writeSparse(enc wire.Encoder, path string, e entry) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := enc.EncodeInt64(e.size); err != nil {
+		return err
+	}
+	if err := enc.Encode(e.extents); err != nil {
+		return err
+	}
+	readers := make([]io.Reader, len(e.extents))
+	for i, x := range e.extents {
+		readers[i] = io.NewSectionReader(file, x.Offset, x.Length)
+	}
+	if err := enc.EncodeReader(io.MultiReader(readers...), dataLength(e.extents)); err != nil {
+		return fmt.Errorf("sending %v: %w", path, err)
+	}
+	return nil
+}
+
+// receiveDir decodes directory entries from r into the target directory
+func receiveDir(r io.Reader, target string, overwrite bool) error {
+	if err := os.Mkdir(target, 0755); err != nil && !(overwrite && errors.Is(err, fs.ErrExist)) {
+		return fmt.Errorf("creating output directory: %w", err)
+	}
+
+	dec := wire.NewDecoder(r)
+	for {
+		kind, err := dec.DecodeByte()
+		if err != nil {
+			return fmt.Errorf("receiving entry: %w", err)
+		}
+		if kind == entryEnd {
+			return nil
+		}
+
+		name, err := dec.DecodeLongString()
+		if err != nil {
+			return fmt.Errorf("receiving entry path: %w", err)
+		}
+		path, err := safeJoin(target, name)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case entryDir:
+			if err := os.Mkdir(path, 0755); err != nil && !(overwrite && errors.Is(err, fs.ErrExist)) {
+				return fmt.Errorf("creating directory: %w", err)
+			}
+		case entryFile:
+			body, err := dec.DecodeReader()
+			if err != nil {
+				return fmt.Errorf("receiving %v: %w", name, err)
+			}
+			if err := receiveFile(body, streamLength(body), path, overwrite); err != nil {
+				return err
+			}
+		case entrySparse:
+			if err := receiveSparse(dec, name, path, overwrite); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown entry kind: %v", kind)
+		}
+	}
+}
+
+// receiveSparse decodes a sparse file and writes the data of its extents, leaving holes between them
+func receiveSparse(dec wire.Decoder, name string, path string, overwrite bool) error {
+	size, err := dec.DecodeInt64()
+	if err != nil {
+		return fmt.Errorf("receiving size of %v: %w", name, err)
+	}
+	var extents []extent
+	if err := dec.Decode(&extents); err != nil {
+		return fmt.Errorf("receiving extents of %v: %w", name, err)
+	}
+	if err := checkExtents(extents, size); err != nil {
+		return fmt.Errorf("receiving %v: %w", name, err)
+	}
+	body, err := dec.DecodeReader()
+	if err != nil {
+		return fmt.Errorf("receiving %v: %w", name, err)
+	}
+	if n := streamLength(body); n != dataLength(extents) {
+		return fmt.Errorf("receiving %v: %v bytes of data for extents of %v", name, n, dataLength(extents))
+	}
+
+	file, err := createFile(path, overwrite)
+	if err != nil {
+		return err
+	}
+	err = writeExtents(file, body, size, extents)
+	if closeErr := file.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("closing output file: %w", closeErr)
+	}
+	if err != nil {
+		_ = os.Remove(path)
+		return fmt.Errorf("receiving %v: %w", name, err)
+	}
+	return nil
+}
+
+// checkExtents checks extents are in order, don't overlap, and are within a file of size bytes
+func checkExtents(extents []extent, size int64) error {
+	if size < 0 {
+		return fmt.Errorf("bad size: %v", size)
+	}
+	var end int64
+	for _, x := range extents {
+		if x.Offset < end || x.Length <= 0 || x.Offset+x.Length > size || x.Offset+x.Length < x.Offset {
+			return fmt.Errorf("bad extent of %v bytes at %v", x.Length, x.Offset)
+		}
+		end = x.Offset + x.Length
+	}
+	return nil
+}
+
+// writeExtents sizes the file, leaving it a hole, and then writes the data of each extent from r
+func writeExtents(file *os.File, r io.Reader, size int64, extents []extent) error {
+	if err := file.Truncate(size); err != nil {
+		return err
+	}
+	for _, x := range extents {
+		if err := preallocate(file, x.Offset, x.Length); err != nil {
+			return err
+		}
+	}
+	for _, x := range extents {
+		if _, err := io.CopyN(&offsetWriter{w: file, offset: x.Offset}, r, x.Length); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamLength is the bytes remaining of a stream decoded by wire.Decoder.DecodeReader, or -1 if unknown
+func streamLength(r io.Reader) int64 {
+	if s, ok := r.(interface{ Len() int64 }); ok {
+		return s.Len()
+	}
+	return -1
+}
@@ -0,0 +1,63 @@
+package client
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeJoin(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+		ok   bool
+	}{
+		{"file", "a.txt", filepath.Join("out", "a.txt"), true},
+		{"nested", "a/b.txt", filepath.Join("out", "a", "b.txt"), true},
+		{"empty", "", "", false},
+		{"absolute", "/etc/passwd", "", false},
+		{"parent", "../a.txt", "", false},
+		{"nested parent", "a/../../b.txt", "", false},
+		{"dot", ".", "", false},
+		{"empty element", "a//b", "", false},
+		{"backslash", "..\\a.txt", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := safeJoin("out", tt.in)
+			if tt.ok != (err == nil) {
+				t.Fatalf("want ok %v, got err %v", tt.ok, err)
+			}
+			if got != tt.want {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestScanDir_Length(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "sub", "a.txt"), []byte("abc"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	entries, length, err := scanDir(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, newDirReader(root, entries)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if int64(buf.Len()) != length {
+		t.Fatalf("want %v, got %v", length, buf.Len())
+	}
+}
@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Path is how the bytes of a transfer travelled between the peers
+type Path string
+
+const (
+	// PathRelay is through the relay proxy
+	PathRelay Path = "relay"
+
+	// PathDirect is over a TCP connection straight between the peers
+	PathDirect Path = "direct"
+)
+
+// After the relay tells both peers to try connecting directly, the receiver offers its candidate
+// addresses and a nonce through the relay. The sender connects to the first candidate it can and
+// proves it's the peer by sending the nonce, then tells the receiver which path it chose.
+const (
+	pathRelay  byte = 'r'
+	pathDirect byte = 'd'
+)
+
+// directTimeout limits connecting directly to each candidate address, and proving the nonce
+const directTimeout = 2 * time.Second
+
+// encodeSide tells the relay proxy which side we are, prefixed with MsgDirect if we can connect directly
+func (s *service) encodeSide(side Side) error {
+	if s.direct {
+		if err := s.enc.EncodeByte(byte(MsgDirect)); err != nil {
+			return err
+		}
+	}
+	return s.enc.EncodeByte(byte(side))
+}
+
+// connectDirect is the sender trying to connect directly to the receiver.
+// Returns the encoder and decoder to send the file with, and a connection to close afterwards if it is direct.
+func (s *service) connectDirect(ctx context.Context) (wire.Encoder, wire.Decoder, io.Closer, Path, error) {
+	list, err := s.dec.DecodeString()
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("receiving candidates: %w", err)
+	}
+	nonce, err := s.dec.DecodeString()
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("receiving nonce: %w", err)
+	}
+
+	var conn net.Conn
+	for _, addr := range strings.Split(list, ",") {
+		if addr == "" {
+			continue
+		}
+		if conn, err = dialCandidate(ctx, addr, nonce); err == nil {
+			break
+		}
+	}
+
+	if conn == nil {
+		if err := s.enc.EncodeByte(pathRelay); err != nil {
+			return nil, nil, nil, "", fmt.Errorf("sending path: %w", err)
+		}
+		return s.enc, s.dec, nil, PathRelay, nil
+	}
+	if err := s.enc.EncodeByte(pathDirect); err != nil {
+		_ = conn.Close()
+		return nil, nil, nil, "", fmt.Errorf("sending path: %w", err)
+	}
+	return wire.NewEncoder(conn), wire.NewDecoder(conn), conn, PathDirect, nil
+}
+
+// dialCandidate connects to an address of the receiver, and proves we are its peer with the nonce
+func dialCandidate(ctx context.Context, addr string, nonce string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: directTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Now().Add(directTimeout))
+	if err := wire.NewEncoder(conn).EncodeString(nonce); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if b, err := wire.NewDecoder(conn).DecodeByte(); b != byte(MsgRecv) || err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("bad candidate [%v]: %w", b, err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// acceptDirect is the receiver offering the sender addresses to connect directly to.
+// Returns the encoder and decoder to receive the file with, and a connection to close afterwards if it is direct.
+func (s *service) acceptDirect() (wire.Encoder, wire.Decoder, io.Closer, Path, error) {
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, nil, nil, "", err
+	}
+
+	// without a listener there are no candidates, and the sender falls back to the relay
+	var list string
+	verified := make(chan net.Conn, 1)
+	accepting := make(chan struct{})
+	ctx, cancel := context.WithCancel(context.Background())
+	l, err := net.Listen("tcp", ":0")
+	if err == nil {
+		list = candidates(s.local, l.Addr().(*net.TCPAddr).Port)
+		go func() {
+			defer close(accepting)
+			acceptCandidates(ctx, l, nonce, verified)
+		}()
+	} else {
+		close(accepting)
+	}
+	// stop accepting, and close a connection the sender verified but we didn't use
+	defer func() {
+		cancel()
+		if l != nil {
+			_ = l.Close()
+		}
+		<-accepting
+		select {
+		case conn := <-verified:
+			_ = conn.Close()
+		default:
+		}
+	}()
+
+	if err := s.enc.EncodeString(list); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("sending candidates: %w", err)
+	}
+	if err := s.enc.EncodeString(nonce); err != nil {
+		return nil, nil, nil, "", fmt.Errorf("sending nonce: %w", err)
+	}
+
+	b, err := s.dec.DecodeByte()
+	if err != nil {
+		return nil, nil, nil, "", fmt.Errorf("receiving path: %w", err)
+	}
+	if b != pathDirect {
+		// the sender may have connected, but gave up before it knew, which is closed when we return
+		return s.enc, s.dec, nil, PathRelay, nil
+	}
+
+	// the sender only chooses the direct path once we have verified its connection
+	select {
+	case conn := <-verified:
+		return wire.NewEncoder(conn), wire.NewDecoder(conn), conn, PathDirect, nil
+	case <-time.After(directTimeout):
+		return nil, nil, nil, "", fmt.Errorf("sender chose a direct connection that wasn't made")
+	}
+}
+
+// acceptCandidates accepts connections until one proves it's the sender, or the listener is closed.
+// A connection still proving itself when ctx is done is closed.
+func acceptCandidates(ctx context.Context, l net.Listener, nonce string, verified chan<- net.Conn) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		stop := closeOnDone(ctx, conn)
+		_ = conn.SetDeadline(time.Now().Add(directTimeout))
+		got, err := wire.NewDecoder(conn).DecodeString()
+		ok := err == nil && subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) == 1
+		if ok {
+			ok = wire.NewEncoder(conn).EncodeByte(byte(MsgRecv)) == nil
+		}
+		stop()
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
+		_ = conn.SetDeadline(time.Time{})
+		verified <- conn
+		return
+	}
+}
+
+// candidates lists addresses the sender might reach us on, most likely first.
+// The address used to reach the relay comes first, then other interfaces, and then loopback
+// if the relay was reached over loopback, as only then may the sender be on this host.
+// The list is comma separated, and only as many fit as can be sent as a short string.
+func candidates(local net.Addr, port int) string {
+	var ips []net.IP
+	if tcp, ok := local.(*net.TCPAddr); ok && !tcp.IP.IsLoopback() && !tcp.IP.IsUnspecified() {
+		ips = append(ips, tcp.IP)
+	}
+	sameHost := overLoopback(local)
+	var loopback []net.IP
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() || ipNet.IP.IsUnspecified() {
+				continue
+			}
+			if ipNet.IP.IsLoopback() {
+				if sameHost {
+					loopback = append(loopback, ipNet.IP)
+				}
+				continue
+			}
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	ips = append(ips, loopback...)
+
+	var list []string
+	seen := make(map[string]bool)
+	length := 0
+	for _, ip := range ips {
+		addr := net.JoinHostPort(ip.String(), strconv.Itoa(port))
+		if seen[addr] || length+len(addr)+1 > 255 {
+			continue
+		}
+		seen[addr] = true
+		length += len(addr) + 1
+		list = append(list, addr)
+	}
+	return strings.Join(list, ",")
+}
+
+// overLoopback is true if local is the address of a connection that didn't leave this host
+func overLoopback(local net.Addr) bool {
+	switch a := local.(type) {
+	case *net.TCPAddr:
+		return a.IP.IsLoopback()
+	case *net.UnixAddr:
+		return true
+	}
+	// such as an in-process pipe
+	return local != nil && local.Network() == "pipe"
+}
+
+// newNonce is a random value only the peers know, as it's sent through the relay
+func newNonce() (string, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+	return hex.EncodeToString(bs), nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"go-storj-solution/pkg/wire"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCandidates(t *testing.T) {
+	tests := []struct {
+		name     string
+		local    net.Addr
+		loopback bool
+	}{
+		{"over loopback", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}, true},
+		{"over the network", &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}, false},
+		{"in process", pipeAddr(t), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			list := candidates(tt.local, 4321)
+			if got := strings.Contains(list, "127.0.0.1:4321"); got != tt.loopback {
+				t.Fatalf("want loopback %v, got %q", tt.loopback, list)
+			}
+		})
+	}
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func pipeAddr(t *testing.T) net.Addr {
+	a, b := net.Pipe()
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	return a.LocalAddr()
+}
+
+func TestAcceptDirect_RelayPath(t *testing.T) {
+	relay, conn := net.Pipe()
+	defer relay.Close()
+	defer conn.Close()
+	s := &service{
+		enc:    wire.NewEncoder(conn),
+		dec:    wire.NewDecoder(conn),
+		direct: true,
+		local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)},
+	}
+	type result struct {
+		path Path
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		_, _, _, path, err := s.acceptDirect()
+		done <- result{path: path, err: err}
+	}()
+
+	enc, dec := wire.NewEncoder(relay), wire.NewDecoder(relay)
+	list, err := dec.DecodeString()
+	if err != nil {
+		t.Fatalf("candidates: %v", err)
+	}
+	if _, err := dec.DecodeString(); err != nil {
+		t.Fatalf("nonce: %v", err)
+	}
+	var addr string
+	for _, a := range strings.Split(list, ",") {
+		if strings.HasPrefix(a, "127.0.0.1:") {
+			addr = a
+		}
+	}
+	if addr == "" {
+		t.Fatalf("want a loopback candidate, got %q", list)
+	}
+
+	// a sender still proving itself when the relay path is chosen is cut off
+	peer, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer peer.Close()
+	// give the receiver time to accept it
+	time.Sleep(20 * time.Millisecond)
+	if err := enc.EncodeByte(pathRelay); err != nil {
+		t.Fatalf("path: %v", err)
+	}
+	select {
+	case res := <-done:
+		if res.err != nil || res.path != PathRelay {
+			t.Fatalf("want relay, got %v: %v", res.path, res.err)
+		}
+	case <-time.After(directTimeout / 2):
+		t.Fatal("waited on the sender's handshake")
+	}
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	// closed, or reset if it was never accepted
+	if _, err := peer.Read(make([]byte, 1)); err == nil || isTimeout(err) {
+		t.Fatalf("want the connection closed, got %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// whence values for finding the data and holes of sparse files with Seek
+const (
+	seekData = 3
+	seekHole = 4
+)
+
+// preallocate reserves disk space for length bytes of file from offset, failing straight away if there isn't room.
+// File systems that can't preallocate are left to allocate as the file is written.
+func preallocate(file *os.File, offset int64, length int64) error {
+	if length <= 0 {
+		return nil
+	}
+	err := syscall.Fallocate(int(file.Fd()), 0, offset, length)
+	switch {
+	case err == nil, errors.Is(err, syscall.EOPNOTSUPP), errors.Is(err, syscall.ENOSYS):
+		return nil
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EFBIG):
+		return fmt.Errorf("not enough disk space for %v bytes: %w", length, err)
+	}
+	return fmt.Errorf("preallocating %v bytes: %w", length, err)
+}
+
+// freeSpace on the file system of dir that can be written without privileges, in bytes
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(uint64(st.Bavail) * uint64(st.Bsize)), nil
+}
+
+// dataExtents lists the ranges of file holding data, skipping its holes.
+// A file system that doesn't report holes has a single extent for the whole file.
+func dataExtents(file *os.File, size int64) ([]extent, error) {
+	var extents []extent
+	for offset := int64(0); offset < size; {
+		start, err := file.Seek(offset, seekData)
+		if errors.Is(err, syscall.ENXIO) {
+			// the rest of the file is a hole
+			break
+		}
+		if err != nil {
+			return []extent{{Offset: 0, Length: size}}, nil
+		}
+		end, err := file.Seek(start, seekHole)
+		if err != nil {
+			return []extent{{Offset: 0, Length: size}}, nil
+		}
+		if end > size {
+			end = size
+		}
+		if end > start {
+			extents = append(extents, extent{Offset: start, Length: end - start})
+		}
+		offset = end
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return extents, nil
+}
@@ -0,0 +1,99 @@
+//go:build linux
+// +build linux
+
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// allocated is the bytes of disk allocated to a file
+func allocated(t *testing.T, path string) int64 {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+func TestDir_Sparse(t *testing.T) {
+	root := t.TempDir()
+	image := filepath.Join(root, "disk.img")
+	file, err := os.Create(image)
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	// 64MiB with data at the start, in the middle, and a hole at the end
+	data := bytes.Repeat([]byte("vm"), 32*1024)
+	for _, offset := range []int64{0, 32 << 20} {
+		if _, err := file.WriteAt(data, offset); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := file.Truncate(64 << 20); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if allocated(t, image) >= 64<<20 {
+		t.Skip("temporary directory doesn't support sparse files")
+	}
+
+	entries, length, err := scanDir(root)
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if len(entries) != 1 || entries[0].kind != entrySparse {
+		t.Fatalf("want a sparse entry, got %+v", entries)
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, newDirReader(root, entries)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if int64(buf.Len()) != length {
+		t.Fatalf("want %v, got %v", length, buf.Len())
+	}
+	if length > 1<<20 {
+		t.Fatalf("holes were sent, body is %v bytes", length)
+	}
+
+	target := filepath.Join(t.TempDir(), "out")
+	if err := receiveDir(&buf, target, false); err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	received := filepath.Join(target, "disk.img")
+	want, _ := os.ReadFile(image)
+	got, _ := os.ReadFile(received)
+	if !bytes.Equal(want, got) {
+		t.Fatal("received file differs")
+	}
+	if n := allocated(t, received); n >= 64<<20 {
+		t.Fatalf("received file isn't sparse, %v bytes allocated", n)
+	}
+}
+
+func TestPreallocate_NoSpace(t *testing.T) {
+	file, err := os.Create(filepath.Join(t.TempDir(), "huge"))
+	if err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	defer file.Close()
+
+	// far more than any disk, so reserving it fails rather than filling the disk
+	err = preallocate(file, 0, 1<<62)
+	if err == nil {
+		t.Skip("file system doesn't preallocate")
+	}
+	if !errors.Is(err, syscall.ENOSPC) && !errors.Is(err, syscall.EFBIG) {
+		t.Fatalf("want no space, got %v", err)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package client
+
+import (
+	"os"
+)
+
+// preallocate is left to the file system, which allocates as the file is written
+func preallocate(file *os.File, offset int64, length int64) error {
+	return nil
+}
+
+// freeSpace on the file system of dir is unknown, which is -1
+func freeSpace(dir string) (int64, error) {
+	return -1, nil
+}
+
+// dataExtents is a single extent for the whole file, as holes can't be found
+func dataExtents(file *os.File, size int64) ([]extent, error) {
+	if size == 0 {
+		return nil, nil
+	}
+	return []extent{{Offset: 0, Length: size}}, nil
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"sync"
+)
+
+// A file can be sent in parallel over several connections, for links where one stream can't fill the bandwidth.
+// The sender sends the file name and a FileHeader with the number of streams over its connection instead of
+// the body, once a receiver has joined. The file is split into one contiguous range per stream, and both peers then open a connection
+// to the relay for each stream, identified with the MsgStream side, the secret, their role and the stream index.
+// The relay pairs the connections of each stream. The sender sends the offset of its range and then the range,
+// and the receiver replies with a single MsgRecv byte once the range has been written.
+const (
+	// MsgStream identifies a connection carrying one range of a file sent in parallel
+	MsgStream Side = 'T'
+
+	// MaxStreams is the most connections a file can be sent over in parallel
+	MaxStreams = 16
+)
+
+// StreamDialer opens another connection to the relay proxy, for a stream of a parallel send or receive
+type StreamDialer func(ctx context.Context) (io.ReadWriteCloser, error)
+
+// byteRange of a file sent by one stream
+type byteRange struct {
+	offset int64
+	length int64
+}
+
+// splitRanges splits a file of length bytes into n contiguous ranges, which are empty if the file is short
+func splitRanges(length int64, n int) []byteRange {
+	ranges := make([]byteRange, n)
+	size := length / int64(n)
+	for i := range ranges {
+		ranges[i].offset = int64(i) * size
+		ranges[i].length = size
+	}
+	// the last range has the remainder
+	ranges[n-1].length = length - ranges[n-1].offset
+	return ranges
+}
+
+// joinStream identifies a stream connection of a transfer to the relay proxy
+func joinStream(conn io.Writer, secret string, role Side, index int) error {
+	enc := wire.NewEncoder(conn)
+	if err := enc.EncodeByte(byte(MsgStream)); err != nil {
+		return fmt.Errorf("sending msg stream byte: %w", err)
+	}
+	if err := enc.EncodeString(secret); err != nil {
+		return fmt.Errorf("sending secret: %w", err)
+	}
+	if err := enc.EncodeByte(byte(role)); err != nil {
+		return fmt.Errorf("sending role: %w", err)
+	}
+	if err := enc.EncodeByte(byte(index)); err != nil {
+		return fmt.Errorf("sending stream index: %w", err)
+	}
+	return nil
+}
+
+// sendStreams sends the ranges of body over parallel streams, returning once the receiver has written them all
+func sendStreams(ctx context.Context, dial StreamDialer, secret string, body io.ReaderAt, length int64, streams int) error {
+	return eachStream(ctx, dial, secret, MsgSend, splitRanges(length, streams), func(conn io.ReadWriter, rng byteRange) error {
+		enc := wire.NewEncoder(conn)
+		if err := enc.EncodeInt64(rng.offset); err != nil {
+			return fmt.Errorf("sending offset: %w", err)
+		}
+		if err := enc.EncodeReader(io.NewSectionReader(body, rng.offset, rng.length), rng.length); err != nil {
+			return fmt.Errorf("sending range: %w", err)
+		}
+		if b, err := wire.NewDecoder(conn).DecodeByte(); err != nil || Side(b) != MsgRecv {
+			return fmt.Errorf("bad range acknowledgement [%v]: %w", b, err)
+		}
+		return nil
+	})
+}
+
+// receiveStreams writes the ranges of a file sent over parallel streams to w, at their offsets.
+// Returns once every range has been written in full.
+func receiveStreams(ctx context.Context, dial StreamDialer, secret string, w io.WriterAt, length int64, streams int) error {
+	return eachStream(ctx, dial, secret, MsgRecv, splitRanges(length, streams), func(conn io.ReadWriter, rng byteRange) error {
+		dec := wire.NewDecoder(conn)
+		offset, err := dec.DecodeInt64()
+		if err != nil {
+			return fmt.Errorf("receiving offset: %w", err)
+		}
+		if offset != rng.offset {
+			return fmt.Errorf("range at offset %v, want %v", offset, rng.offset)
+		}
+		r, err := dec.DecodeReader()
+		if err != nil {
+			return fmt.Errorf("receiving range: %w", err)
+		}
+		n, err := io.Copy(&offsetWriter{w: w, offset: offset}, r)
+		if err != nil {
+			return fmt.Errorf("receiving range: %w", err)
+		}
+		if n != rng.length {
+			return fmt.Errorf("range at offset %v has %v bytes, want %v", offset, n, rng.length)
+		}
+		if err := wire.NewEncoder(conn).EncodeByte(byte(MsgRecv)); err != nil {
+			return fmt.Errorf("acknowledging range: %w", err)
+		}
+		return nil
+	})
+}
+
+// eachStream dials a stream for each range and runs fn on them in parallel, failing if any fails.
+// Every stream is closed if one fails or ctx is done.
+func eachStream(ctx context.Context, dial StreamDialer, secret string, role Side, ranges []byteRange, fn func(conn io.ReadWriter, rng byteRange) error) error {
+	if dial == nil {
+		return errors.New("no dialer for parallel streams")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	errs := make(chan error, len(ranges))
+	var wg sync.WaitGroup
+	for i, rng := range ranges {
+		wg.Add(1)
+		go func(i int, rng byteRange) {
+			defer wg.Done()
+			err := func() error {
+				conn, err := dial(ctx)
+				if err != nil {
+					return err
+				}
+				defer conn.Close()
+				defer closeOnDone(ctx, conn)()
+				if err := joinStream(conn, secret, role, i); err != nil {
+					return err
+				}
+				return fn(conn, rng)
+			}()
+			if err != nil {
+				errs <- fmt.Errorf("stream %v: %w", i, ctxErr(ctx, err))
+				cancel()
+			}
+		}(i, rng)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// offsetWriter writes to w sequentially from offset
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
@@ -1,9 +1,15 @@
 package client
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"go-storj-solution/pkg/wire"
 	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
 )
 
 const (
@@ -12,6 +18,31 @@ const (
 
 	// MsgRecv identifies receiver
 	MsgRecv Side = 'R'
+
+	// MsgSendCode identifies a sender that chooses its own code
+	MsgSendCode Side = 'C'
+
+	// MsgBroadcast identifies a sender with multiple receivers
+	MsgBroadcast Side = 'M'
+
+	// MsgRecvRequest identifies a receiver requesting a code for a sender to push a file to
+	MsgRecvRequest Side = 'Q'
+
+	// MsgSendTo identifies a sender pushing a file to a receiver's code
+	MsgSendTo Side = 'P'
+
+	// MsgSessionOpen identifies a peer opening a two-way session
+	MsgSessionOpen Side = 'O'
+
+	// MsgSessionJoin identifies a peer joining a two-way session
+	MsgSessionJoin Side = 'J'
+
+	// MsgStore identifies a sender uploading a file for the relay to keep until it is received
+	MsgStore Side = 'U'
+
+	// MsgDirect prefixes the side of a client that can connect directly to its peer.
+	// The relay also sends it instead of MsgRecv when both peers can, so they try to.
+	MsgDirect Side = 'D'
 )
 
 // Side of a transfer
@@ -23,11 +54,119 @@ func (s Side) String() string {
 		return "sender"
 	case MsgRecv:
 		return "receiver"
+	case MsgSendCode:
+		return "sender with code"
+	case MsgBroadcast:
+		return "broadcaster"
+	case MsgRecvRequest:
+		return "requesting receiver"
+	case MsgSendTo:
+		return "pushing sender"
+	case MsgSessionOpen:
+		return "session opener"
+	case MsgSessionJoin:
+		return "session joiner"
+	case MsgStore:
+		return "uploader"
+	case MsgDirect:
+		return "direct"
+	case MsgStream:
+		return "stream"
+	default:
+		return fmt.Sprintf("unknown [%v]", byte(s))
+	}
+}
+
+// Direct checks if a client of this side can connect directly to its peer
+func (s Side) Direct() bool {
+	switch s {
+	case MsgSend, MsgSendCode, MsgBroadcast, MsgSendTo, MsgRecv, MsgRecvRequest:
+		return true
+	default:
+		return false
+	}
+}
+
+// CodeStatus is the relay's reply to a sender that chose its own code
+type CodeStatus byte
+
+const (
+	// CodeAccepted means the code is reserved for the sender
+	CodeAccepted CodeStatus = 'A'
+
+	// CodeTaken means another transfer is using the code
+	CodeTaken CodeStatus = 'T'
+
+	// CodeInvalid means the code has the wrong length or characters
+	CodeInvalid CodeStatus = 'I'
+
+	// CodeForbidden means the relay doesn't allow senders to choose codes, or to upload files
+	CodeForbidden CodeStatus = 'F'
+
+	// CodeTooLarge means the relay won't store an upload this large, or has no room left for it
+	CodeTooLarge CodeStatus = 'L'
+)
+
+func (s CodeStatus) String() string {
+	switch s {
+	case CodeAccepted:
+		return "accepted"
+	case CodeTaken:
+		return "taken"
+	case CodeInvalid:
+		return "invalid"
+	case CodeForbidden:
+		return "forbidden"
+	case CodeTooLarge:
+		return "too large"
 	default:
 		return fmt.Sprintf("unknown [%v]", byte(s))
 	}
 }
 
+// CodeError is a code chosen by a sender that the relay rejected
+type CodeError struct {
+	Code   string
+	Status CodeStatus
+}
+
+func (e *CodeError) Error() string {
+	return fmt.Sprintf("code %q rejected: %v", e.Code, e.Status)
+}
+
+// A sender sending to a single receiver announces the file before sending it, with its length, or with
+// a FileHeader for a file sent in parallel streams or as a tar archive. The receiver replies with AcceptFile,
+// or with RejectFile and the reason as a long string, such as when there isn't room for the file.
+// The body only follows an accepted file. Broadcasts aren't announced, as they have many receivers.
+// A receiver asked to Confirm replies with ReceivedFile once it has read the whole body.
+const (
+	AcceptFile   byte = 'a'
+	RejectFile   byte = 'x'
+	ReceivedFile byte = 'd'
+)
+
+// FileHeader announces a file in place of its length. The body follows unless the file is sent in parallel Streams.
+type FileHeader struct {
+	Length  int64 `wire:"1"`
+	Streams int   `wire:"2"`
+
+	// Tar is set for a tar archive of a directory, which the receiver unpacks
+	Tar bool `wire:"3"`
+
+	// Confirm asks the receiver to reply once it has the whole body, such as for a relay
+	// that removes a stored upload once it has been fetched
+	Confirm bool `wire:"4"`
+}
+
+// RejectedError is a file the receiver wouldn't accept
+type RejectedError struct {
+	Reason string
+}
+
+func (e *RejectedError) Error() string {
+	return fmt.Sprintf("receiver rejected the file: %v", e.Reason)
+}
+
 type SendRequest struct {
 	// Body of file to send
 	Body io.Reader
@@ -35,18 +174,173 @@ type SendRequest struct {
 	// Name of file to send
 	Name string
 
-	// Length of file to send
+	// Length of file to send, or -1 if it isn't known until Body ends, which can't be stored or sent in parallel
 	Length int64
+
+	// Tar marks Body as a tar archive of a directory, so receivers unpack it
+	Tar bool
+
+	// Code the receiver will need, chosen by the sender.
+	// If empty then the relay generates a code.
+	Code string
+
+	// To is a code requested by a receiver, for pushing the file to that receiver.
+	// Receivers get codes with Service.Request.
+	To string
+
+	// Receivers to broadcast to. Zero or one is a normal single receiver send.
+	// The send starts when this many receivers have joined, or the Window has passed.
+	Receivers int
+
+	// Window is how long other receivers can join after the first receiver before
+	// the send starts, even if fewer than Receivers have joined. Zero waits for all Receivers.
+	Window time.Duration
+
+	// Store uploads the file for the relay to keep, so the receiver can fetch it after the sender has gone.
+	// The control channel reports when the relay has stored the whole file.
+	Store bool
+
+	// Streams splits the file into ranges sent over this many connections to the relay in parallel, up to
+	// MaxStreams, for links where a single connection can't fill the bandwidth. Zero or one sends over this
+	// connection alone. Body must be an io.ReaderAt, Dial opens the other connections, and the file isn't
+	// sent in parallel if it goes over a direct connection.
+	Streams int
+	Dial    StreamDialer
+}
+
+// parallel checks if the request is for sending over parallel streams
+func (r *SendRequest) parallel() bool {
+	return r.Streams > 1
+}
+
+// broadcast checks if the request is for multiple receivers
+func (r *SendRequest) broadcast() bool {
+	return r.Receivers > 1 || r.Window > 0
 }
 
 type SendResponse struct {
 	Secret string
 	Errors <-chan error
+
+	// path is set before Errors is closed
+	path Path
+}
+
+// Path reports how the file travelled to the receiver, once Errors is closed
+func (r *SendResponse) Path() Path {
+	if r.path == "" {
+		return PathRelay
+	}
+	return r.path
 }
 
 type RecvResponse struct {
+	// Body of the file, nil if the file is sent in parallel Streams.
+	// Reading the body accepts the file, unless it has been rejected with Reject.
 	Body io.Reader
 	Name string
+
+	// Path is how the file is travelling from the sender
+	Path Path
+
+	// Streams the file is sent over in parallel, zero if it is sent in Body. Use ReceiveStreams.
+	Streams int
+
+	// Length of the file in bytes, known before the body is read, or -1 if the sender didn't know it
+	Length int64
+
+	// Tar is set when the body is a tar archive of a directory, sent with SendRequest.Tar
+	Tar bool
+
+	// secret of the transfer, which the streams join with
+	secret string
+	stop   func()
+
+	// reply to a sender that announced the file, nil if it didn't
+	reply    wire.Encoder
+	accepted bool
+
+	// confirm is set when the sender waits for the receiver to confirm it has the whole body
+	confirm bool
+}
+
+// ReceiveStreams receives a file sent in parallel Streams, writing each range to w at its offset.
+// dial opens a connection to the relay proxy for each stream. Returns once the whole file has been written.
+func (r *RecvResponse) ReceiveStreams(ctx context.Context, w io.WriterAt, dial StreamDialer) error {
+	if r.Streams == 0 {
+		return errors.New("file isn't sent in parallel streams")
+	}
+	defer r.stop()
+	if err := r.accept(); err != nil {
+		return fmt.Errorf("accepting file: %w", ctxErr(ctx, err))
+	}
+	return receiveStreams(ctx, dial, r.secret, w, r.Length, r.Streams)
+}
+
+// Reject tells the sender the file won't be received, and why, instead of reading the body.
+// The sender's send fails with a *RejectedError. A sender that didn't announce the file,
+// such as a broadcaster, only sees the connection close.
+func (r *RecvResponse) Reject(reason string) error {
+	defer r.stop()
+	if r.reply == nil || r.accepted {
+		return nil
+	}
+	if err := r.reply.EncodeByte(RejectFile); err != nil {
+		return fmt.Errorf("rejecting file: %w", err)
+	}
+	if err := r.reply.EncodeLongString(reason); err != nil {
+		return fmt.Errorf("rejecting file: %w", err)
+	}
+	return nil
+}
+
+// accept tells a sender that announced the file to send it
+func (r *RecvResponse) accept() error {
+	if r.reply == nil || r.accepted {
+		return nil
+	}
+	r.accepted = true
+	return r.reply.EncodeByte(AcceptFile)
+}
+
+// acceptReader accepts an announced file when it is first read, and then reads its body
+type acceptReader struct {
+	response *RecvResponse
+	dec      wire.Decoder
+	body     io.Reader
+	err      error
+}
+
+func (a *acceptReader) Read(p []byte) (int, error) {
+	if a.body == nil && a.err == nil {
+		a.body, a.err = a.start()
+	}
+	if a.err != nil {
+		return 0, a.err
+	}
+	n, err := a.body.Read(p)
+	if errors.Is(err, io.EOF) && a.response.confirm {
+		a.response.confirm = false
+		if replyErr := a.response.reply.EncodeByte(ReceivedFile); replyErr != nil {
+			return n, fmt.Errorf("confirming file: %w", replyErr)
+		}
+	}
+	return n, err
+}
+
+// start accepts the file and decodes its body
+func (a *acceptReader) start() (io.Reader, error) {
+	if err := a.response.accept(); err != nil {
+		return nil, fmt.Errorf("accepting file: %w", err)
+	}
+	body, err := a.dec.DecodeReader()
+	if err != nil {
+		return nil, fmt.Errorf("receiving body: %w", err)
+	}
+	if n := streamLength(body); n != a.response.Length {
+		return nil, fmt.Errorf("receiving body: %v bytes, but %v were announced", n, a.response.Length)
+	}
+	return body, nil
 }
 
 //Service for clients to send and receive files through the relay proxy
@@ -58,19 +352,56 @@ type Service interface {
 	// the file was successfully sent. If an error occurred then it will be available on the channel.
 	Send(request *SendRequest) (*SendResponse, error)
 
+	// SendContext is Send that can be cancelled. Cancelling the context while waiting for a receiver
+	// or sending the file closes the connection and reports context.Canceled on the control channel.
+	SendContext(ctx context.Context, request *SendRequest) (*SendResponse, error)
+
 	// Recv receives files through the relay proxy. Files can only be received with
 	// the correct secret. If the secret is valid, then a reader to stream the file is returned
 	// and also a file name.
 	Recv(secret string) (*RecvResponse, error)
+
+	// RecvContext is Recv that can be cancelled. Cancelling the context during the handshake
+	// or while reading the body closes the connection and reading the body reports the context error.
+	RecvContext(ctx context.Context, secret string) (*RecvResponse, error)
+
+	// Request asks the relay proxy for a code that a sender can push a file to, using SendRequest.To.
+	// This is the inverse of Send, with the receiver getting the code instead of the sender.
+	Request() (*RequestResponse, error)
+
+	// RequestContext is Request that can be cancelled, including while waiting for a sender.
+	RequestContext(ctx context.Context) (*RequestResponse, error)
+
+	// OpenSession asks the relay proxy for a code that a peer can join a two-way session with.
+	// The session can be used straight away, with sends and receives waiting for the peer to join.
+	OpenSession() (*Session, error)
+
+	// OpenSessionContext is OpenSession that can be cancelled, at any point until the session is closed.
+	OpenSessionContext(ctx context.Context) (*Session, error)
+
+	// JoinSession joins a two-way session opened by a peer with OpenSession.
+	JoinSession(secret string) (*Session, error)
+
+	// JoinSessionContext is JoinSession that can be cancelled, at any point until the session is closed.
+	JoinSessionContext(ctx context.Context, secret string) (*Session, error)
 }
 
 //service client service
 type service struct {
 	enc wire.Encoder
 	dec wire.Decoder
+
+	// closer closes the connection when a context is cancelled, may be nil
+	closer io.Closer
+
+	// direct is set to try connecting directly to peers, from the local address used to reach the relay
+	direct bool
+	local  net.Addr
 }
 
-//NewService creates a new client service
+//NewService creates a new client service.
+//Without access to the connection cancelled contexts are only noticed between messages,
+//so prefer NewConnService.
 func NewService(enc wire.Encoder, dec wire.Decoder) Service {
 	return &service{
 		enc: enc,
@@ -78,16 +409,107 @@ func NewService(enc wire.Encoder, dec wire.Decoder) Service {
 	}
 }
 
+//NewConnService creates a new client service for a connection to the relay proxy.
+//The connection is closed if a context is cancelled.
+func NewConnService(conn io.ReadWriteCloser) Service {
+	return &service{
+		enc:    wire.NewEncoder(conn),
+		dec:    wire.NewDecoder(conn),
+		closer: conn,
+	}
+}
+
+//NewDirectService creates a new client service for a connection to the relay proxy, like NewConnService,
+//that also tries to connect directly to peers that can, such as on the same network.
+//The relay proxy is used if a direct connection can't be made.
+func NewDirectService(conn net.Conn) Service {
+	return &service{
+		enc:    wire.NewEncoder(conn),
+		dec:    wire.NewDecoder(conn),
+		closer: conn,
+		direct: true,
+		local:  conn.LocalAddr(),
+	}
+}
+
+// watch closes the connection if ctx is done before the returned stop function is called
+func (s *service) watch(ctx context.Context) (stop func()) {
+	return closeOnDone(ctx, s.closer)
+}
+
+// closeOnDone closes c if ctx is done before the returned stop function is called. c may be nil.
+func closeOnDone(ctx context.Context, c io.Closer) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			if c != nil {
+				_ = c.Close()
+			}
+		case <-done:
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// ctxErr prefers the context error over err, because errors from a
+// connection closed by cancellation are only a symptom
+func ctxErr(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
 func (s *service) Send(r *SendRequest) (*SendResponse, error) {
-	// Tell relay proxy we are the sender
-	if err := s.enc.EncodeByte(byte(MsgSend)); err != nil {
-		return nil, fmt.Errorf("sending msg send byte: %w", err)
+	return s.SendContext(context.Background(), r)
+}
+
+func (s *service) SendContext(ctx context.Context, r *SendRequest) (*SendResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
 	}
+	stop := s.watch(ctx)
 
-	// Receive secret from relay proxy
-	secret, err := s.dec.DecodeString()
-	if err != nil {
-		return nil, fmt.Errorf("receiving secret: %w", err)
+	if r.Store {
+		return s.upload(ctx, r, stop)
+	}
+
+	if r.parallel() {
+		if err := checkParallel(r); err != nil {
+			stop()
+			return nil, err
+		}
+	}
+
+	var secret string
+	if r.To != "" {
+		if err := s.pushCode(r.To); err != nil {
+			stop()
+			return nil, ctxErr(ctx, err)
+		}
+		secret = r.To
+	} else if r.broadcast() {
+		var err error
+		if secret, err = s.broadcastCode(r); err != nil {
+			stop()
+			return nil, ctxErr(ctx, err)
+		}
+	} else if r.Code == "" {
+		var err error
+		if secret, err = s.generatedCode(); err != nil {
+			stop()
+			return nil, ctxErr(ctx, err)
+		}
+	} else {
+		if err := s.chosenCode(r.Code); err != nil {
+			stop()
+			return nil, ctxErr(ctx, err)
+		}
+		secret = r.Code
 	}
 
 	errs := make(chan error, 1)
@@ -99,22 +521,60 @@ func (s *service) Send(r *SendRequest) (*SendResponse, error) {
 
 	go func() {
 		defer close(errs)
+		defer stop()
 
 		// Wait for receiver to join relay proxy
-		if b, err := s.dec.DecodeByte(); b != byte(MsgRecv) || err != nil {
+		b, err := s.dec.DecodeByte()
+		if err != nil || (b != byte(MsgRecv) && b != byte(MsgDirect)) {
+			if ctx.Err() != nil {
+				errs <- fmt.Errorf("waiting for receiver: %w", ctx.Err())
+				return
+			}
 			errs <- fmt.Errorf("bad receiver [%v]: %w", b, err)
 			return
 		}
 
+		enc, dec := s.enc, s.dec
+		response.path = PathRelay
+		if b == byte(MsgDirect) {
+			// the receiver can connect directly too
+			var conn io.Closer
+			if enc, dec, conn, response.path, err = s.connectDirect(ctx); err != nil {
+				errs <- fmt.Errorf("connecting directly: %w", ctxErr(ctx, err))
+				return
+			}
+			if conn != nil {
+				defer conn.Close()
+				defer closeOnDone(ctx, conn)()
+			}
+		}
+
 		// Send file name
-		if err := s.enc.EncodeString(r.Name); err != nil {
-			errs <- fmt.Errorf("sending file name: %w", err)
+		if err := enc.EncodeLongString(r.Name); err != nil {
+			errs <- fmt.Errorf("sending file name: %w", ctxErr(ctx, err))
+			return
+		}
+
+		// a single receiver is told about the file first, so it can reject it
+		parallel := r.parallel() && response.path == PathRelay
+		if !r.broadcast() {
+			if err := announce(enc, dec, r, parallel); err != nil {
+				errs <- ctxErr(ctx, err)
+				return
+			}
+		}
+
+		if parallel {
+			// this connection is held open until the receiver has every range, as closing it ends the transfer
+			if err := sendStreams(ctx, r.Dial, secret, r.Body.(io.ReaderAt), r.Length, r.Streams); err != nil {
+				errs <- fmt.Errorf("sending streams: %w", err)
+			}
 			return
 		}
 
 		// Send file body
-		if err := s.enc.EncodeReader(r.Body, r.Length); err != nil {
-			errs <- fmt.Errorf("sending body: %w", err)
+		if err := encodeBody(enc, r); err != nil {
+			errs <- fmt.Errorf("sending body: %w", ctxErr(ctx, err))
 			return
 		}
 	}()
@@ -122,31 +582,383 @@ func (s *service) Send(r *SendRequest) (*SendResponse, error) {
 	return response, nil
 }
 
+// announce tells the receiver the length of the file, or how it is sent in parallel,
+// and waits for the receiver to accept it
+func announce(enc wire.Encoder, dec wire.Decoder, r *SendRequest, parallel bool) error {
+	var err error
+	switch {
+	case parallel:
+		err = enc.Encode(FileHeader{Length: r.Length, Streams: r.Streams, Tar: r.Tar})
+	case r.Tar:
+		err = enc.Encode(FileHeader{Length: r.Length, Tar: true})
+	default:
+		err = enc.EncodeInt64(r.Length)
+	}
+	if err != nil {
+		return fmt.Errorf("announcing file: %w", err)
+	}
+
+	b, err := dec.DecodeByte()
+	if err != nil {
+		return fmt.Errorf("waiting for receiver to accept: %w", err)
+	}
+	switch b {
+	case AcceptFile:
+		return nil
+	case RejectFile:
+		reason, err := dec.DecodeLongString()
+		if err != nil {
+			return fmt.Errorf("receiving rejection: %w", err)
+		}
+		return &RejectedError{Reason: reason}
+	}
+	return fmt.Errorf("bad reply from receiver [%v]", b)
+}
+
+// encodeBody sends the body of a request, as an unsized stream if its length isn't known
+func encodeBody(enc wire.Encoder, r *SendRequest) error {
+	if r.Length < 0 {
+		return enc.EncodeUnsizedReader(r.Body)
+	}
+	return enc.EncodeReader(r.Body, r.Length)
+}
+
+// checkParallel checks a request can be sent over parallel streams
+func checkParallel(r *SendRequest) error {
+	switch {
+	case r.Streams > MaxStreams:
+		return fmt.Errorf("too many streams: %v", r.Streams)
+	case r.broadcast() || r.Store:
+		return errors.New("only single receiver sends can use parallel streams")
+	case r.Dial == nil:
+		return errors.New("parallel streams need a dialer")
+	case r.Length < 0:
+		return errors.New("parallel streams need the length of the file")
+	}
+	if _, ok := r.Body.(io.ReaderAt); !ok {
+		return errors.New("parallel streams need a body that is an io.ReaderAt")
+	}
+	return nil
+}
+
+// generatedCode asks the relay proxy to generate the code for a send
+func (s *service) generatedCode() (string, error) {
+	// Tell relay proxy we are the sender
+	if err := s.encodeSide(MsgSend); err != nil {
+		return "", fmt.Errorf("sending msg send byte: %w", err)
+	}
+
+	// Receive secret from relay proxy
+	secret, err := s.dec.DecodeString()
+	if err != nil {
+		return "", fmt.Errorf("receiving secret: %w", err)
+	}
+	return secret, nil
+}
+
+// chosenCode asks the relay proxy to reserve a code chosen by the sender
+func (s *service) chosenCode(code string) error {
+	if err := s.encodeSide(MsgSendCode); err != nil {
+		return fmt.Errorf("sending msg send code byte: %w", err)
+	}
+	if err := s.enc.EncodeString(code); err != nil {
+		return fmt.Errorf("sending code: %w", err)
+	}
+
+	b, err := s.dec.DecodeByte()
+	if err != nil {
+		return fmt.Errorf("receiving code status: %w", err)
+	}
+	if status := CodeStatus(b); status != CodeAccepted {
+		return &CodeError{Code: code, Status: status}
+	}
+	return nil
+}
+
+// pushCode tells the relay proxy we are pushing to a receiver's code
+func (s *service) pushCode(code string) error {
+	if err := s.encodeSide(MsgSendTo); err != nil {
+		return fmt.Errorf("sending msg send to byte: %w", err)
+	}
+	if err := s.enc.EncodeString(code); err != nil {
+		return fmt.Errorf("sending code: %w", err)
+	}
+	return nil
+}
+
+// broadcastCode asks the relay proxy for a code for a send to multiple receivers.
+// The code is either generated by the relay, or chosen by the sender.
+func (s *service) broadcastCode(r *SendRequest) (string, error) {
+	if r.Receivers > 255 {
+		return "", fmt.Errorf("too many receivers: %v", r.Receivers)
+	}
+	if err := s.encodeSide(MsgBroadcast); err != nil {
+		return "", fmt.Errorf("sending msg broadcast byte: %w", err)
+	}
+	if err := s.enc.EncodeByte(byte(r.Receivers)); err != nil {
+		return "", fmt.Errorf("sending receivers: %w", err)
+	}
+	window := ""
+	if r.Window > 0 {
+		window = r.Window.String()
+	}
+	if err := s.enc.EncodeString(window); err != nil {
+		return "", fmt.Errorf("sending window: %w", err)
+	}
+	if err := s.enc.EncodeString(r.Code); err != nil {
+		return "", fmt.Errorf("sending code: %w", err)
+	}
+
+	b, err := s.dec.DecodeByte()
+	if err != nil {
+		return "", fmt.Errorf("receiving code status: %w", err)
+	}
+	if status := CodeStatus(b); status != CodeAccepted {
+		return "", &CodeError{Code: r.Code, Status: status}
+	}
+	secret, err := s.dec.DecodeString()
+	if err != nil {
+		return "", fmt.Errorf("receiving secret: %w", err)
+	}
+	return secret, nil
+}
+
+// upload sends a file for the relay proxy to store, instead of waiting for a receiver
+func (s *service) upload(ctx context.Context, r *SendRequest, stop func()) (*SendResponse, error) {
+	if r.Length < 0 {
+		stop()
+		return nil, errors.New("stored uploads need the length of the file")
+	}
+	if err := s.enc.EncodeByte(byte(MsgStore)); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending msg store byte: %w", ctxErr(ctx, err))
+	}
+	if err := s.enc.EncodeLongString(r.Name); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending file name: %w", ctxErr(ctx, err))
+	}
+	if err := s.enc.EncodeString(strconv.FormatInt(r.Length, 10)); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending size: %w", ctxErr(ctx, err))
+	}
+
+	b, err := s.dec.DecodeByte()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("receiving upload status: %w", ctxErr(ctx, err))
+	}
+	if status := CodeStatus(b); status != CodeAccepted {
+		stop()
+		return nil, &CodeError{Status: status}
+	}
+	secret, err := s.dec.DecodeString()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("receiving secret: %w", ctxErr(ctx, err))
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		defer stop()
+
+		if err := s.enc.EncodeReader(r.Body, r.Length); err != nil {
+			errs <- fmt.Errorf("sending body: %w", ctxErr(ctx, err))
+			return
+		}
+
+		// Wait for the relay proxy to store the file
+		if b, err := s.dec.DecodeByte(); CodeStatus(b) != CodeAccepted || err != nil {
+			errs <- fmt.Errorf("storing upload [%v]: %w", b, ctxErr(ctx, err))
+		}
+	}()
+
+	return &SendResponse{
+		Secret: secret,
+		Errors: errs,
+	}, nil
+}
+
 func (s *service) Recv(secret string) (*RecvResponse, error) {
-	if err := s.enc.EncodeByte(byte(MsgRecv)); err != nil {
-		return nil, fmt.Errorf("sending msg recv byte: %w", err)
+	return s.RecvContext(context.Background(), secret)
+}
+
+func (s *service) RecvContext(ctx context.Context, secret string) (*RecvResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := s.watch(ctx)
+
+	if err := s.encodeSide(MsgRecv); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending msg recv byte: %w", ctxErr(ctx, err))
 	}
 
 	// send secret
 	if err := s.enc.EncodeString(secret); err != nil {
-		return nil, fmt.Errorf("sending secret: %w", err)
+		stop()
+		return nil, fmt.Errorf("sending secret: %w", ctxErr(ctx, err))
+	}
+
+	return s.receive(ctx, stop, secret)
+}
+
+// receive reads the file name and body once the relay proxy has paired us with a sender.
+// The context is watched until the body has been read, or the parallel streams have been received.
+func (s *service) receive(ctx context.Context, stop func(), secret string) (*RecvResponse, error) {
+	enc, dec := s.enc, s.dec
+	path := PathRelay
+	if s.direct {
+		// the relay proxy says whether the sender can connect directly too
+		b, err := s.dec.DecodeByte()
+		if err != nil || (b != byte(MsgRecv) && b != byte(MsgDirect)) {
+			stop()
+			return nil, fmt.Errorf("bad sender [%v]: %w", b, ctxErr(ctx, err))
+		}
+		if b == byte(MsgDirect) {
+			var conn io.Closer
+			if enc, dec, conn, path, err = s.acceptDirect(); err != nil {
+				stop()
+				return nil, fmt.Errorf("connecting directly: %w", ctxErr(ctx, err))
+			}
+			if conn != nil {
+				// the direct connection is closed once the body has been read, or ctx is done
+				stopRelay, stopDirect := stop, closeOnDone(ctx, conn)
+				stop = func() {
+					stopRelay()
+					stopDirect()
+					_ = conn.Close()
+				}
+			}
+		}
 	}
 
 	// receive file name
-	name, err := s.dec.DecodeString()
+	name, err := dec.DecodeLongString()
 	if err != nil {
-		return nil, fmt.Errorf("receiving file name: %w", err)
+		stop()
+		return nil, fmt.Errorf("receiving file name: %w", ctxErr(ctx, err))
+	}
+
+	response := &RecvResponse{
+		Name:   name,
+		Path:   path,
+		secret: secret,
+		stop:   stop,
 	}
 
-	r, err := s.dec.DecodeReader()
+	typ, err := dec.Peek()
 	if err != nil {
-		return nil, fmt.Errorf("receiving body: %w", err)
+		stop()
+		return nil, fmt.Errorf("receiving body: %w", ctxErr(ctx, err))
 	}
+	switch typ {
+	case wire.FrameRecord:
+		// the file is announced with a header, for parallel streams or an archive
+		var header FileHeader
+		if err := dec.Decode(&header); err != nil {
+			stop()
+			return nil, fmt.Errorf("receiving file header: %w", ctxErr(ctx, err))
+		}
+		if header.Streams < 0 || header.Streams > MaxStreams || header.Length < -1 || (header.Streams > 0 && header.Length < 0) {
+			stop()
+			return nil, fmt.Errorf("bad file header: %v streams of %v bytes", header.Streams, header.Length)
+		}
+		response.Streams = header.Streams
+		response.Length = header.Length
+		response.Tar = header.Tar
+		response.confirm = header.Confirm
+		response.reply = enc
+		if response.Streams > 0 {
+			return response, nil
+		}
+		// keep watching the context until the body has been read
+		response.Body = &ctxReader{Reader: &acceptReader{response: response, dec: dec}, ctx: ctx, stop: stop}
+		return response, nil
 
-	response := &RecvResponse{
-		Body: r,
-		Name: name,
+	case wire.FrameInt64:
+		// the file is announced, and the body follows once it is accepted
+		if response.Length, err = dec.DecodeInt64(); err != nil {
+			stop()
+			return nil, fmt.Errorf("receiving length: %w", ctxErr(ctx, err))
+		}
+		if response.Length < -1 {
+			stop()
+			return nil, fmt.Errorf("bad length: %v", response.Length)
+		}
+		response.reply = enc
+		// keep watching the context until the body has been read
+		response.Body = &ctxReader{Reader: &acceptReader{response: response, dec: dec}, ctx: ctx, stop: stop}
+		return response, nil
 	}
 
+	// the body follows straight away, such as for a broadcast
+	r, err := dec.DecodeReader()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("receiving body: %w", ctxErr(ctx, err))
+	}
+	response.Body = &ctxReader{Reader: r, ctx: ctx, stop: stop}
+	response.Length = streamLength(r)
 	return response, nil
 }
+
+// RequestResponse is a code requested by a receiver for a sender to push a file to
+type RequestResponse struct {
+	// Secret the sender needs to push the file
+	Secret string
+
+	wait func() (*RecvResponse, error)
+}
+
+// Wait blocks until a sender pushes a file, and then returns it like Recv
+func (r *RequestResponse) Wait() (*RecvResponse, error) {
+	return r.wait()
+}
+
+func (s *service) Request() (*RequestResponse, error) {
+	return s.RequestContext(context.Background())
+}
+
+func (s *service) RequestContext(ctx context.Context) (*RequestResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := s.watch(ctx)
+
+	if err := s.encodeSide(MsgRecvRequest); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending msg recv request byte: %w", ctxErr(ctx, err))
+	}
+
+	secret, err := s.dec.DecodeString()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("receiving secret: %w", ctxErr(ctx, err))
+	}
+
+	return &RequestResponse{
+		Secret: secret,
+		wait: func() (*RecvResponse, error) {
+			return s.receive(ctx, stop, secret)
+		},
+	}, nil
+}
+
+// ctxReader reports the context error instead of errors caused by closing a connection on cancellation
+type ctxReader struct {
+	io.Reader
+	ctx  context.Context
+	stop func()
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if err != nil && r.ctx.Err() != nil {
+		return n, r.ctx.Err()
+	}
+	if errors.Is(err, io.EOF) {
+		r.stop()
+	}
+	return n, err
+}
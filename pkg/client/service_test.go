@@ -2,13 +2,17 @@ package client
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"errors"
 	"go-storj-solution/pkg/wire"
 	"io"
+	"net"
 	"reflect"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 )
 
 func IsEqual(t *testing.T, want interface{}, got interface{}) {
@@ -72,6 +76,13 @@ func Test_service_Send(t *testing.T) {
 		t.Fatalf("want %v, got %v", request.Name, string(bs[2:]))
 	}
 
+	// read the announced length, and accept the file
+	bs = make([]byte, 1+8)
+	io.ReadFull(fromClient, bs)
+	IsEqual(t, byte('i'), bs[0])
+	IsEqual(t, int64(len(body)), int64(binary.BigEndian.Uint64(bs[1:])))
+	toClient.Write([]byte{'b', AcceptFile})
+
 	// read body
 	bs = make([]byte, len(body)+1+8) // +1 for type +8 for size of int64
 	io.ReadFull(fromClient, bs)
@@ -135,3 +146,153 @@ func Test_service_Recv(t *testing.T) {
 	NoError(t, err)
 	IsEqual(t, body, bs)
 }
+
+func Test_service_Recv_Announced(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	body := "i like cheese"
+	replies := make(chan string, 1)
+
+	// go routine is the server, announcing the file before sending it
+	go func() {
+		enc, dec := wire.NewEncoder(serverConn), wire.NewDecoder(serverConn)
+		dec.DecodeByte()
+		dec.DecodeString()
+		enc.EncodeString("file.txt")
+		enc.EncodeInt64(int64(len(body)))
+
+		b, _ := dec.DecodeByte()
+		if b != AcceptFile {
+			reason, _ := dec.DecodeLongString()
+			replies <- reason
+			return
+		}
+		replies <- "accepted"
+		enc.EncodeReader(strings.NewReader(body), int64(len(body)))
+	}()
+
+	r, err := NewConnService(clientConn).Recv("abc")
+	NoError(t, err)
+	IsEqual(t, int64(len(body)), r.Length)
+
+	// nothing is accepted until the body is read
+	select {
+	case reply := <-replies:
+		t.Fatalf("unexpected reply before reading: %v", reply)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	b := &strings.Builder{}
+	_, err = io.Copy(b, r.Body)
+	NoError(t, err)
+	IsEqual(t, "accepted", <-replies)
+	IsEqual(t, body, b.String())
+}
+
+func Test_service_Recv_Reject(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	replies := make(chan string, 1)
+	go func() {
+		enc, dec := wire.NewEncoder(serverConn), wire.NewDecoder(serverConn)
+		dec.DecodeByte()
+		dec.DecodeString()
+		enc.EncodeString("file.txt")
+		enc.EncodeInt64(1 << 40)
+
+		if b, _ := dec.DecodeByte(); b != RejectFile {
+			replies <- "accepted"
+			return
+		}
+		reason, _ := dec.DecodeLongString()
+		replies <- reason
+	}()
+
+	r, err := NewConnService(clientConn).Recv("abc")
+	NoError(t, err)
+	NoError(t, r.Reject("no room"))
+	IsEqual(t, "no room", <-replies)
+}
+
+func Test_service_SendContext_Cancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// server sends a secret, but a receiver never joins
+	go func() {
+		bs := []byte{0, 0}
+		io.ReadFull(serverConn, bs)
+		serverConn.Write([]byte{'s', 3, 'a', 'b', 'c'})
+	}()
+
+	s := NewConnService(clientConn)
+	r, err := s.SendContext(ctx, &SendRequest{Body: strings.NewReader(""), Name: "empty"})
+	NoError(t, err)
+	IsEqual(t, "abc", r.Secret)
+
+	cancel()
+
+	err = <-r.Errors
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func Test_service_RecvContext_Cancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// server reads the side and secret, but never replies
+	go func() {
+		io.Copy(io.Discard, serverConn)
+	}()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		cancel()
+	}()
+
+	s := NewConnService(clientConn)
+	_, err := s.RecvContext(ctx, "abc")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
+
+func Test_service_RecvContext_CancelBody(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// server sends a name and the start of a body that never finishes
+	go func() {
+		bs := make([]byte, 2+2+3)
+		io.ReadFull(serverConn, bs)
+		serverConn.Write([]byte{'s', 1, 'f'})
+		serverConn.Write([]byte{'B', 0, 0, 0, 0, 0, 0, 0, 10})
+		serverConn.Write([]byte("abc"))
+	}()
+
+	s := NewConnService(clientConn)
+	r, err := s.RecvContext(ctx, "abc")
+	NoError(t, err)
+
+	bs := make([]byte, 3)
+	_, err = io.ReadFull(r.Body, bs)
+	NoError(t, err)
+
+	cancel()
+	_, err = io.ReadAll(r.Body)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v, got %v", context.Canceled, err)
+	}
+}
@@ -0,0 +1,224 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"sync"
+)
+
+// A session carries a sequence of messages in each direction.
+// Each message starts with a byte for its kind, and a file is followed by its name and body.
+// Each direction ends with a single messageEnd byte, once that peer has nothing more to send.
+const (
+	messageFile byte = 'f'
+	messageEnd  byte = 'e'
+)
+
+// Session is a two-way connection with a peer through the relay proxy.
+// Both peers can send and receive any number of files, in any order.
+// Sending and receiving can happen at the same time from different go routines,
+// but sends must not be concurrent with each other, and neither must receives.
+type Session struct {
+	// Secret the peer needs to join the session
+	Secret string
+
+	enc wire.Encoder
+	dec wire.Decoder
+
+	// closer closes the connection, may be nil
+	closer io.Closer
+
+	// stop watching the context the session was started with
+	stop func()
+	ctx  context.Context
+
+	// join waits for the peer once, and keeps the result in joinErr
+	join    sync.Once
+	joinErr error
+
+	// body of the last file received, which is skipped if it wasn't read
+	body io.Reader
+
+	sendDone bool
+	recvDone bool
+}
+
+func (s *service) OpenSession() (*Session, error) {
+	return s.OpenSessionContext(context.Background())
+}
+
+func (s *service) OpenSessionContext(ctx context.Context) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := s.watch(ctx)
+
+	if err := s.enc.EncodeByte(byte(MsgSessionOpen)); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending msg session open byte: %w", ctxErr(ctx, err))
+	}
+
+	secret, err := s.dec.DecodeString()
+	if err != nil {
+		stop()
+		return nil, fmt.Errorf("receiving secret: %w", ctxErr(ctx, err))
+	}
+
+	return s.session(ctx, stop, secret), nil
+}
+
+func (s *service) JoinSession(secret string) (*Session, error) {
+	return s.JoinSessionContext(context.Background(), secret)
+}
+
+func (s *service) JoinSessionContext(ctx context.Context, secret string) (*Session, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stop := s.watch(ctx)
+
+	if err := s.enc.EncodeByte(byte(MsgSessionJoin)); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending msg session join byte: %w", ctxErr(ctx, err))
+	}
+	if err := s.enc.EncodeString(secret); err != nil {
+		stop()
+		return nil, fmt.Errorf("sending secret: %w", ctxErr(ctx, err))
+	}
+
+	session := s.session(ctx, stop, secret)
+	if err := session.joined(); err != nil {
+		stop()
+		return nil, err
+	}
+	return session, nil
+}
+
+func (s *service) session(ctx context.Context, stop func(), secret string) *Session {
+	return &Session{
+		Secret: secret,
+		enc:    s.enc,
+		dec:    s.dec,
+		closer: s.closer,
+		stop:   stop,
+		ctx:    ctx,
+	}
+}
+
+// joined waits for the relay proxy to say the session has started, the first time it's called
+func (s *Session) joined() error {
+	s.join.Do(func() {
+		if b, err := s.dec.DecodeByte(); b != byte(MsgRecv) || err != nil {
+			if s.ctx.Err() != nil {
+				s.joinErr = fmt.Errorf("waiting for peer: %w", s.ctx.Err())
+				return
+			}
+			s.joinErr = fmt.Errorf("bad peer [%v]: %w", b, err)
+		}
+	})
+	return s.joinErr
+}
+
+// Wait blocks until the peer has joined the session.
+// Send and Recv wait for the peer too, so calling Wait is only needed to know when it joins.
+func (s *Session) Wait() error {
+	return s.joined()
+}
+
+// Send sends a file to the peer
+func (s *Session) Send(name string, body io.Reader, length int64) error {
+	if s.sendDone {
+		return errors.New("session: send after CloseSend")
+	}
+	if err := s.joined(); err != nil {
+		return err
+	}
+
+	if err := s.enc.EncodeByte(messageFile); err != nil {
+		return fmt.Errorf("sending message kind: %w", ctxErr(s.ctx, err))
+	}
+	if err := s.enc.EncodeLongString(name); err != nil {
+		return fmt.Errorf("sending file name: %w", ctxErr(s.ctx, err))
+	}
+	if err := s.enc.EncodeReader(body, length); err != nil {
+		return fmt.Errorf("sending body: %w", ctxErr(s.ctx, err))
+	}
+	return nil
+}
+
+// CloseSend tells the peer that no more files will be sent.
+// The peer's Recv then returns io.EOF, and receiving from the peer can carry on.
+func (s *Session) CloseSend() error {
+	if s.sendDone {
+		return nil
+	}
+	if err := s.joined(); err != nil {
+		return err
+	}
+	s.sendDone = true
+	if err := s.enc.EncodeByte(messageEnd); err != nil {
+		return fmt.Errorf("sending end: %w", ctxErr(s.ctx, err))
+	}
+	return nil
+}
+
+// Recv receives the next file from the peer, and returns io.EOF once the peer has called CloseSend.
+// The body of a file is only valid until the next call to Recv, which skips any of it that wasn't read.
+func (s *Session) Recv() (*RecvResponse, error) {
+	if s.recvDone {
+		return nil, io.EOF
+	}
+	if err := s.joined(); err != nil {
+		return nil, err
+	}
+
+	if s.body != nil {
+		if _, err := io.Copy(io.Discard, s.body); err != nil {
+			return nil, fmt.Errorf("skipping body: %w", ctxErr(s.ctx, err))
+		}
+		s.body = nil
+	}
+
+	kind, err := s.dec.DecodeByte()
+	if err != nil {
+		return nil, fmt.Errorf("receiving message kind: %w", ctxErr(s.ctx, err))
+	}
+	switch kind {
+	case messageEnd:
+		s.recvDone = true
+		return nil, io.EOF
+	case messageFile:
+	default:
+		return nil, fmt.Errorf("unknown message kind [%v]", kind)
+	}
+
+	name, err := s.dec.DecodeLongString()
+	if err != nil {
+		return nil, fmt.Errorf("receiving file name: %w", ctxErr(s.ctx, err))
+	}
+	body, err := s.dec.DecodeReader()
+	if err != nil {
+		return nil, fmt.Errorf("receiving body: %w", ctxErr(s.ctx, err))
+	}
+
+	s.body = body
+	// the session owns the connection, so a rejected file is skipped by the next Recv rather than stopping it
+	return &RecvResponse{
+		Body: &ctxReader{Reader: body, ctx: s.ctx, stop: func() {}},
+		Name: name,
+		stop: func() {},
+	}, nil
+}
+
+// Close ends the session by closing the connection to the relay proxy, which also closes the peer's connection.
+// To not cut the peer off, both peers should CloseSend and Recv until io.EOF before closing.
+func (s *Session) Close() error {
+	s.stop()
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
@@ -0,0 +1,192 @@
+package client
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// tarReader streams a tar archive of a directory as a body
+type tarReader struct {
+	*io.PipeReader
+}
+
+func newTarReader(root string) *tarReader {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTar(pw, root))
+	}()
+	return &tarReader{PipeReader: pr}
+}
+
+// writeTar writes a tar archive of the directory at root, with its entries under the base name of root.
+// Only regular files and directories are archived, as for directory transfers.
+func writeTar(w io.Writer, root string) error {
+	tw := tar.NewWriter(w)
+	base := filepath.Base(root)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && !d.Type().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(base, rel))
+		if d.IsDir() {
+			header.Name += "/"
+			return tw.WriteHeader(header)
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		return writeTarFile(tw, path)
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeTarFile writes the contents of a file to the archive, which fails if its size has changed
+func writeTarFile(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+// gzipMagic starts every gzip stream
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// extractLimit bounds how many bytes an archive unpacks to, as a small compressed archive can unpack to a lot
+type extractLimit struct {
+	// maxSize in bytes, zero is unlimited
+	maxSize int64
+
+	// free space in bytes of the output directory, -1 if unknown
+	free int64
+}
+
+// check fails once an archive unpacks to more than n bytes
+func (l extractLimit) check(n int64) error {
+	if l.maxSize > 0 && n > l.maxSize {
+		return fmt.Errorf("%w: unpacks to more than %v bytes", ErrTooLarge, l.maxSize)
+	}
+	if l.free >= 0 && n > l.free {
+		return fmt.Errorf("%w: unpacks to more than the %v bytes free", ErrNoSpace, l.free)
+	}
+	return nil
+}
+
+// extractArchive unpacks a tar archive, gzipped or not, from r into dir as it is received.
+// Entry names are sanitised like those of a directory transfer, and only files and directories are supported.
+// The rest of r is read once the archive ends, so the transfer completes.
+func extractArchive(r io.Reader, dir string, overwrite bool, limit extractLimit) error {
+	br := bufio.NewReader(r)
+	var archive io.Reader = br
+	if magic, err := br.Peek(len(gzipMagic)); err == nil && string(magic) == string(gzipMagic) {
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return fmt.Errorf("receiving archive: %w", err)
+		}
+		defer zr.Close()
+		archive = zr
+	}
+
+	if err := extractTar(tar.NewReader(archive), dir, overwrite, limit); err != nil {
+		return err
+	}
+
+	// a tar archive ends before its padding, and gzip checks its trailer once read to the end
+	if _, err := io.Copy(io.Discard, archive); err != nil {
+		return fmt.Errorf("receiving archive: %w", err)
+	}
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		return fmt.Errorf("receiving archive: %w", err)
+	}
+	return nil
+}
+
+// extractTar writes the entries of tr into dir, failing once their sizes or the bytes written pass the limit
+func extractTar(tr *tar.Reader, dir string, overwrite bool, limit extractLimit) error {
+	var total, written int64
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("receiving archive entry: %w", err)
+		}
+
+		// archives often name entries relative to ./
+		name := path.Clean(header.Name)
+		if name == "." || header.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		target, err := safeJoin(dir, name)
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.Mkdir(target, 0755); err != nil && !(overwrite && errors.Is(err, fs.ErrExist)) {
+				return fmt.Errorf("creating directory: %w", err)
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			// archives don't always have entries for the directories of their files
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return fmt.Errorf("creating directory: %w", err)
+			}
+			total += header.Size
+			if err := limit.check(total); err != nil {
+				return err
+			}
+			body := &limitedReader{r: tr, n: &written, limit: limit}
+			if err := receiveFile(body, header.Size, target, overwrite); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry %q of type %q", header.Name, header.Typeflag)
+		}
+	}
+}
+
+// limitedReader adds the bytes read to n, failing once n passes the limit
+type limitedReader struct {
+	r     io.Reader
+	n     *int64
+	limit extractLimit
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	*l.n += int64(n)
+	if limitErr := l.limit.check(*l.n); limitErr != nil {
+		return n, limitErr
+	}
+	return n, err
+}
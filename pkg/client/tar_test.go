@@ -0,0 +1,129 @@
+package client
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarEntry of a test archive, a directory if its name ends with /
+type tarEntry struct {
+	name     string
+	contents string
+}
+
+// unlimited extracts archives of any size
+var unlimited = extractLimit{free: -1}
+
+// newArchive builds a tar archive of entries, gzipped if zip is set
+func newArchive(t *testing.T, entries []tarEntry, zip bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	zw := gzip.NewWriter(&buf)
+	if zip {
+		w = zw
+	}
+	tw := tar.NewWriter(w)
+	for _, e := range entries {
+		header := &tar.Header{Name: e.name, Mode: 0644, Size: int64(len(e.contents)), Typeflag: tar.TypeReg}
+		if e.name[len(e.name)-1] == '/' {
+			header = &tar.Header{Name: e.name, Mode: 0755, Typeflag: tar.TypeDir}
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatalf("header: %v", err)
+		}
+		if _, err := tw.Write([]byte(e.contents)); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if zip {
+		if err := zw.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestExtractArchive(t *testing.T) {
+	entries := []tarEntry{
+		{"./", ""},
+		{"./bin/", ""},
+		{"./bin/tool", "#!/bin/sh"},
+		// a file without an entry for its directory
+		{"docs/guide/README.md", "read me"},
+		{"empty.txt", ""},
+	}
+
+	for _, zip := range []bool{false, true} {
+		dir := t.TempDir()
+		archive := newArchive(t, entries, zip)
+		if err := extractArchive(bytes.NewReader(archive), dir, false, unlimited); err != nil {
+			t.Fatalf("gzip %v: extract: %v", zip, err)
+		}
+		for _, e := range entries[2:] {
+			bs, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(e.name)))
+			if err != nil || string(bs) != e.contents {
+				t.Fatalf("gzip %v: %v: want %q, got %q: %v", zip, e.name, e.contents, bs, err)
+			}
+		}
+
+		// existing files aren't overwritten unless asked to
+		if err := extractArchive(bytes.NewReader(archive), dir, false, unlimited); !errors.Is(err, fs.ErrExist) {
+			t.Fatalf("gzip %v: want %v, got %v", zip, fs.ErrExist, err)
+		}
+		if err := extractArchive(bytes.NewReader(archive), dir, true, unlimited); err != nil {
+			t.Fatalf("gzip %v: overwrite: %v", zip, err)
+		}
+	}
+}
+
+func TestExtractArchive_Limit(t *testing.T) {
+	// a megabyte of zeros compresses to about a kilobyte
+	archive := newArchive(t, []tarEntry{{"small.txt", "small"}, {"zeros.bin", string(make([]byte, 1<<20))}}, true)
+	if len(archive) > 1<<16 {
+		t.Fatalf("archive of %v bytes doesn't compress", len(archive))
+	}
+
+	for _, tt := range []struct {
+		limit extractLimit
+		want  error
+	}{
+		{extractLimit{maxSize: 1 << 16, free: -1}, ErrTooLarge},
+		{extractLimit{free: 1 << 16}, ErrNoSpace},
+	} {
+		dir := t.TempDir()
+		if err := extractArchive(bytes.NewReader(archive), dir, false, tt.limit); !errors.Is(err, tt.want) {
+			t.Fatalf("want %v, got %v", tt.want, err)
+		}
+		// entries before the limit are kept, and the one that passes it isn't written
+		if _, err := os.Stat(filepath.Join(dir, "zeros.bin")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("want nothing written past the limit, got %v", err)
+		}
+	}
+}
+
+func TestExtractArchive_Unsafe(t *testing.T) {
+	for _, name := range []string{"../escape.txt", "/etc/passwd", "a/../../escape.txt"} {
+		dir := filepath.Join(t.TempDir(), "out")
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatalf("mkdir: %v", err)
+		}
+		archive := newArchive(t, []tarEntry{{name, "gotcha"}}, false)
+		if err := extractArchive(bytes.NewReader(archive), dir, true, unlimited); err == nil {
+			t.Fatalf("%v: want unsafe name rejected", name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "..", "escape.txt")); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%v: written outside of the output directory", name)
+		}
+	}
+}
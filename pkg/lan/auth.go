@@ -0,0 +1,140 @@
+package lan
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"net"
+	"time"
+)
+
+// A peer connecting to a relay on the local network proves it knows the transfer's code before it is onboarded,
+// so the code never has to be announced. The relay sends a random challenge, the peer replies with an HMAC of the
+// challenge keyed by the code, and the relay replies with authAccepted if it matches, or closes the connection.
+// The peer proves itself first, so a host connecting to the relay learns nothing about the code.
+
+const (
+	// challengeSize is the bytes of the relay's random challenge
+	challengeSize = 32
+
+	// authAccepted tells a peer its proof matched, and the relay's usual onboarding follows
+	authAccepted byte = 'A'
+)
+
+var errBadProof = errors.New("peer doesn't know the code")
+
+// newID returns a random hex ID, unrelated to any code
+func newID() string {
+	return hex.EncodeToString(random(16))
+}
+
+func random(n int) []byte {
+	bs := make([]byte, n)
+	if _, err := rand.Read(bs); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return bs
+}
+
+// proof of knowing code, for a challenge
+func proof(code string, challenge []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(code))
+	_, _ = mac.Write(challenge)
+	return mac.Sum(nil)
+}
+
+// challenge a peer to prove it knows code, within the handshake timeout
+func challenge(conn net.Conn, code string) error {
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	nonce := random(challengeSize)
+	enc, dec := wire.NewEncoder(conn), wire.NewDecoder(conn)
+	if err := enc.EncodeBytes(nonce); err != nil {
+		return fmt.Errorf("sending challenge: %w", err)
+	}
+	got, err := dec.DecodeBytes()
+	if err != nil {
+		return fmt.Errorf("receiving proof: %w", err)
+	}
+	// an empty code is never advertised, so can't be proven
+	if code == "" || !hmac.Equal(got, proof(code, nonce)) {
+		return errBadProof
+	}
+	if err := enc.EncodeByte(authAccepted); err != nil {
+		return fmt.Errorf("accepting peer: %w", err)
+	}
+	return nil
+}
+
+// prove to the relay on conn that we know code
+func prove(conn net.Conn, code string) error {
+	enc, dec := wire.NewEncoder(conn), wire.NewDecoder(conn)
+	nonce, err := dec.DecodeBytes()
+	if err != nil {
+		return fmt.Errorf("receiving challenge: %w", err)
+	}
+	if len(nonce) != challengeSize {
+		return fmt.Errorf("bad challenge of %v bytes", len(nonce))
+	}
+	if err := enc.EncodeBytes(proof(code, nonce)); err != nil {
+		return fmt.Errorf("sending proof: %w", err)
+	}
+	b, err := dec.DecodeByte()
+	if err != nil {
+		// the relay closes the connection if it has another code
+		return fmt.Errorf("relay refused the code: %w", err)
+	}
+	if b != authAccepted {
+		return fmt.Errorf("bad reply from relay [%v]", b)
+	}
+	return nil
+}
+
+// peerTransport dials a relay on the local network over TCP, proving it knows the code on each connection
+type peerTransport struct {
+	code string
+}
+
+func (p peerTransport) Listen(addr string) (net.Listener, error) {
+	return nil, errors.New("transport.Listen: peers don't listen on the local network")
+}
+
+func (p peerTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	conn, err := transport.NewTCP().Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// unblock proving when ctx is done
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+	if err := prove(conn, p.code); err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("transport.Dial: %w", ctx.Err())
+		}
+		return nil, fmt.Errorf("transport.Dial: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Dial connects a receiver to the relay at addr found by Discover, proving it knows code on every connection
+func Dial(ctx context.Context, addr string, code string, opts ...client.Option) (*client.Client, error) {
+	return client.Dial(ctx, addr, append(opts, client.WithTransport(peerTransport{code: code}))...)
+}
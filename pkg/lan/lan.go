@@ -0,0 +1,345 @@
+// Package lan transfers files between peers on the same local network without a separate relay.
+// The sender runs a relay for its single transfer and announces it with UDP broadcasts of a random ID,
+// and the receiver connects to the announced relays, proving it knows the transfer's code to each,
+// until one accepts it. Peers then use the same client.Service protocol as with a separate relay.
+package lan
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/proxy"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// Port is the UDP port transfers are announced on
+	Port = 8719
+
+	// DefaultInterval is how often a transfer is announced
+	DefaultInterval = time.Second
+
+	// magic starts each announcement, so other traffic on the port is ignored
+	magic = "storj-lan/2"
+
+	// handshakeTimeout limits how long a peer on the network has to onboard
+	handshakeTimeout = 10 * time.Second
+)
+
+// Options for announcing and discovering transfers
+type Options struct {
+	// Announce is the UDP address announcements are sent to, the broadcast address on Port if empty
+	Announce string
+
+	// Listen is the UDP address to discover announcements on, Port on all interfaces if empty
+	Listen string
+
+	// Interval between announcements, DefaultInterval if zero
+	Interval time.Duration
+}
+
+func (o Options) announce() string {
+	if o.Announce == "" {
+		return net.JoinHostPort(net.IPv4bcast.String(), strconv.Itoa(Port))
+	}
+	return o.Announce
+}
+
+func (o Options) listen() string {
+	if o.Listen == "" {
+		return ":" + strconv.Itoa(Port)
+	}
+	return o.Listen
+}
+
+func (o Options) interval() time.Duration {
+	if o.Interval <= 0 {
+		return DefaultInterval
+	}
+	return o.Interval
+}
+
+// Relay is a relay run by the sender for a single transfer, that peers on the network connect to over TCP
+type Relay struct {
+	listener net.Listener
+
+	// id is announced in place of the code
+	id string
+
+	// memory connects the sender to its own relay
+	memory   *transport.Memory
+	internal net.Listener
+
+	// guards peers and code, and idle is signalled when the last peer connection is closed
+	sync.Mutex
+	peers int
+	idle  *sync.Cond
+
+	// code peers must prove they know, once advertised
+	code string
+}
+
+// Listen runs a relay on the TCP address addr, such as ":0" for a random port
+func Listen(addr string, logger log.Logger) (*Relay, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+	memory := transport.NewMemory()
+	internal, err := memory.Listen("lan")
+	if err != nil {
+		_ = l.Close()
+		return nil, fmt.Errorf("listen: %w", err)
+	}
+
+	service := proxy.New(proxy.NewRandomSecrets(6, time.Now().UnixNano()), logger)
+	go service.Run()
+	service.Configure(proxy.Options{
+		// only the sender's transfer
+		MaxTransfers:     1,
+		HandshakeTimeout: handshakeTimeout,
+	})
+
+	r := &Relay{
+		listener: l,
+		id:       newID(),
+		memory:   memory,
+		internal: internal,
+	}
+	r.idle = sync.NewCond(r)
+
+	go func() {
+		for {
+			conn, err := internal.Accept()
+			if err != nil {
+				return
+			}
+			go service.Onboard(conn)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go r.onboard(service, conn)
+		}
+	}()
+
+	return r, nil
+}
+
+// onboard a peer once it has proven it knows the advertised code
+func (r *Relay) onboard(service *proxy.Service, conn net.Conn) {
+	r.Lock()
+	code := r.code
+	r.Unlock()
+	if err := challenge(conn, code); err != nil {
+		_ = conn.Close()
+		return
+	}
+	service.Onboard(r.track(conn))
+}
+
+// peerConn is a connection from a peer, that tells the relay when it has been closed
+type peerConn struct {
+	net.Conn
+	once  sync.Once
+	relay *Relay
+}
+
+func (c *peerConn) Close() error {
+	c.once.Do(func() {
+		defer c.relay.Unlock()
+		c.relay.Lock()
+		c.relay.peers--
+		if c.relay.peers == 0 {
+			c.relay.idle.Broadcast()
+		}
+	})
+	return c.Conn.Close()
+}
+
+// track counts conn as a peer until it is closed
+func (r *Relay) track(conn net.Conn) net.Conn {
+	defer r.Unlock()
+	r.Lock()
+	r.peers++
+	return &peerConn{Conn: conn, relay: r}
+}
+
+// Wait blocks until the relay has closed every connection from peers.
+// The relay runs in the sender's process, so the sender must wait for it to finish
+// relaying to the receiver before exiting, even once the sender has sent the whole file.
+func (r *Relay) Wait() {
+	defer r.Unlock()
+	r.Lock()
+	for r.peers > 0 {
+		r.idle.Wait()
+	}
+}
+
+// Dial connects the sender to the relay
+func (r *Relay) Dial(ctx context.Context, opts ...client.Option) (*client.Client, error) {
+	return client.Dial(ctx, "lan", append(opts, client.WithTransport(r.memory))...)
+}
+
+// Addr is the TCP address peers connect to
+func (r *Relay) Addr() net.Addr {
+	return r.listener.Addr()
+}
+
+// Close stops accepting peers. Transfers already started are unaffected.
+func (r *Relay) Close() error {
+	_ = r.internal.Close()
+	return r.listener.Close()
+}
+
+// Advertise announces the transfer with code until ctx is done.
+// Only the relay's random ID is announced, and peers must prove they know code before they are onboarded.
+func (r *Relay) Advertise(ctx context.Context, code string, opts Options) error {
+	r.Lock()
+	r.code = code
+	r.Unlock()
+
+	raddr, err := net.ResolveUDPAddr("udp", opts.announce())
+	if err != nil {
+		return fmt.Errorf("resolving announce address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	defer conn.Close()
+
+	packet, err := announcement(r.id, r.listener.Addr().(*net.TCPAddr).Port)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(opts.interval())
+	defer ticker.Stop()
+	for {
+		if _, err := conn.WriteToUDP(packet, raddr); err != nil {
+			return fmt.Errorf("announcing: %w", err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover waits for the transfer with code to be announced, and returns the TCP address of its relay.
+// Each announced relay is asked whether it has code, by proving we know it, so connect with Dial.
+// A relay proves nothing back, so a host announcing a relay of its own learns enough to guess the code,
+// and this should only be used on trusted networks.
+func Discover(ctx context.Context, code string, opts Options) (string, error) {
+	conn, err := net.ListenPacket("udp", opts.listen())
+	if err != nil {
+		return "", fmt.Errorf("listen: %w", err)
+	}
+	defer conn.Close()
+	return discover(ctx, conn, code)
+}
+
+// discover reads announcements from conn until one is of a relay that accepts code
+func discover(ctx context.Context, conn net.PacketConn, code string) (string, error) {
+	// unblock reading when ctx is done
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = conn.SetReadDeadline(time.Now())
+		case <-done:
+		}
+	}()
+
+	// relays are announced repeatedly, but only need asking once
+	tried := make(map[string]bool)
+	buf := make([]byte, 512)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return "", fmt.Errorf("discovering: %w", ctx.Err())
+			}
+			return "", fmt.Errorf("discovering: %w", err)
+		}
+		id, port, err := parseAnnouncement(buf[:n])
+		if err != nil {
+			// not an announcement at all
+			continue
+		}
+		udp, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		addr := net.JoinHostPort(udp.IP.String(), strconv.Itoa(port))
+		if tried[id+" "+addr] {
+			continue
+		}
+		tried[id+" "+addr] = true
+		if accepts(ctx, addr, code) {
+			return addr, nil
+		}
+	}
+}
+
+// accepts checks whether the relay at addr has the transfer with code
+func accepts(ctx context.Context, addr string, code string) bool {
+	ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+	defer cancel()
+	conn, err := peerTransport{code: code}.Dial(ctx, addr)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// announcement encodes the magic, the relay's ID and its TCP port
+func announcement(id string, port int) ([]byte, error) {
+	b := &bytes.Buffer{}
+	enc := wire.NewEncoder(b)
+	for _, s := range []string{magic, id, strconv.Itoa(port)} {
+		if err := enc.EncodeString(s); err != nil {
+			return nil, fmt.Errorf("encoding announcement: %w", err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+var errNotAnnouncement = errors.New("not an announcement")
+
+// parseAnnouncement decodes the ID and port of an announcement
+func parseAnnouncement(packet []byte) (string, int, error) {
+	dec := wire.NewDecoder(bytes.NewReader(packet))
+	if m, err := dec.DecodeString(); err != nil || m != magic {
+		return "", 0, errNotAnnouncement
+	}
+	h, err := dec.DecodeString()
+	if err != nil {
+		return "", 0, errNotAnnouncement
+	}
+	p, err := dec.DecodeString()
+	if err != nil {
+		return "", 0, errNotAnnouncement
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil || port <= 0 || port > 65535 {
+		return "", 0, errNotAnnouncement
+	}
+	return h, port, nil
+}
@@ -0,0 +1,151 @@
+package lan
+
+import (
+	"context"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAnnouncement(t *testing.T) {
+	id := newID()
+	packet, err := announcement(id, 4321)
+	if err != nil {
+		t.Fatalf("announcement: %v", err)
+	}
+	got, port, err := parseAnnouncement(packet)
+	if err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+	if got != id || port != 4321 {
+		t.Fatalf("want %v and 4321, got %v and %v", id, got, port)
+	}
+
+	for _, bad := range [][]byte{nil, []byte("hello"), packet[:len(packet)-1]} {
+		if _, _, err := parseAnnouncement(bad); err == nil {
+			t.Fatalf("expected error parsing %q", bad)
+		}
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	src := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(src, []byte("hello world"), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	relay, err := Listen("127.0.0.1:0", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer relay.Close()
+
+	sender, err := relay.Dial(ctx)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	sending, err := sender.SendFile(ctx, src)
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// announce over loopback rather than broadcast
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer conn.Close()
+	opts := Options{Announce: conn.LocalAddr().String(), Interval: 10 * time.Millisecond}
+
+	// announcements of other transfers are ignored
+	other, err := Listen("127.0.0.1:0", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer other.Close()
+	advertising, stop := context.WithCancel(ctx)
+	defer stop()
+	go other.Advertise(advertising, "other1", opts)
+	go relay.Advertise(advertising, sending.Secret, opts)
+
+	addr, err := discover(ctx, conn, sending.Secret)
+	if err != nil {
+		t.Fatalf("discover: %v", err)
+	}
+	if addr != relay.Addr().String() {
+		t.Fatalf("want %v, got %v", relay.Addr(), addr)
+	}
+
+	receiver, err := Dial(ctx, addr, sending.Secret)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	path, err := receiver.ReceiveTo(ctx, sending.Secret, t.TempDir())
+	if err != nil {
+		t.Fatalf("receive: %v", err)
+	}
+	if err := sending.Wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	// the relay has closed the receiver's connection
+	relay.Wait()
+	bs, err := os.ReadFile(path)
+	if err != nil || string(bs) != "hello world" {
+		t.Fatalf("want hello world, got %s: %v", bs, err)
+	}
+}
+
+func TestRelay_RequiresCode(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	relay, err := Listen("127.0.0.1:0", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer relay.Close()
+	addr := relay.Addr().String()
+
+	// nobody is onboarded before the code is advertised
+	if accepts(ctx, addr, "") {
+		t.Fatal("want an empty code refused")
+	}
+	advertising, stop := context.WithCancel(ctx)
+	defer stop()
+	go relay.Advertise(advertising, "abc123", Options{Announce: "127.0.0.1:9", Interval: time.Hour})
+	deadline := time.Now().Add(5 * time.Second)
+	for !accepts(ctx, addr, "abc123") {
+		if time.Now().After(deadline) {
+			t.Fatal("want the advertised code accepted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// peers that don't know the code are closed before the relay sees them
+	if accepts(ctx, addr, "abc124") {
+		t.Fatal("want the wrong code refused")
+	}
+	c, err := client.Dial(ctx, addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer c.Close()
+	if _, err := c.ReceiveTo(ctx, "abc123", t.TempDir()); err == nil {
+		t.Fatal("want a peer without a proof refused")
+	}
+}
+
+func TestDiscover_Cancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := Discover(ctx, "abc123", Options{Listen: "127.0.0.1:0"}); err == nil {
+		t.Fatal("expected error once cancelled")
+	}
+}
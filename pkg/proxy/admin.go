@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// NewAdminHandler returns an HTTP handler for inspecting and killing transfers.
+// Requests must carry the token as a bearer token in the Authorization header.
+//
+//	GET    /transfers          lists waiting and active transfers
+//	DELETE /transfers/<secret> terminates a transfer
+func NewAdminHandler(s *Service, token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/transfers", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		infos := s.Transfers()
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].Created.Before(infos[j].Created)
+		})
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(infos)
+	})
+	mux.HandleFunc("/transfers/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodDelete {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		secret := strings.TrimPrefix(req.URL.Path, "/transfers/")
+		if !s.Kill(secret) {
+			http.Error(w, "no such transfer", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !authorized(req, token) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		mux.ServeHTTP(w, req)
+	})
+}
+
+// authorized checks the request bearer token in constant time
+func authorized(req *http.Request, token string) bool {
+	if token == "" {
+		return false
+	}
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
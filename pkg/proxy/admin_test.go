@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"encoding/json"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/transport"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitingService returns a running Service with a waiting transfer for the secret
+func waitingService(t *testing.T, secret string) *Service {
+	t.Helper()
+	s := New(NewFixedSecret(secret), log.NewNopLogger())
+	go s.Run()
+
+	joinSender(t, startRelayFor(t, s), secret)
+
+	// wait for sender to join
+	for i := 0; i < 100; i++ {
+		if len(s.Transfers()) == 1 {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("sender never joined")
+	return nil
+}
+
+// joinSender onboards a sender that then waits for a receiver
+func joinSender(t *testing.T, tr transport.Transport, secret string) {
+	t.Helper()
+	conn := dialConn(t, tr)
+	if _, err := conn.Write([]byte{'b', 'S'}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	bs := make([]byte, 2+len(secret))
+	if _, err := io.ReadFull(conn, bs); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+}
+
+func TestAdminHandler_Unauthorized(t *testing.T) {
+	s := waitingService(t, "abc")
+	h := NewAdminHandler(s, "token")
+
+	tests := []struct {
+		name string
+		auth string
+	}{
+		{"no header", ""},
+		{"wrong token", "Bearer nope"},
+		{"wrong scheme", "Basic token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/transfers", nil)
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, req)
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("want %v, got %v", http.StatusUnauthorized, w.Code)
+			}
+		})
+	}
+}
+
+func TestAdminHandler_ListAndKill(t *testing.T) {
+	s := waitingService(t, "abc")
+	h := NewAdminHandler(s, "token")
+
+	req := httptest.NewRequest(http.MethodGet, "/transfers", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want %v, got %v", http.StatusOK, w.Code)
+	}
+
+	var infos []TransferInfo
+	if err := json.NewDecoder(w.Body).Decode(&infos); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if len(infos) != 1 || infos[0].Secret != "abc" || infos[0].State != StateWaiting {
+		t.Fatalf("unexpected transfers: %+v", infos)
+	}
+
+	req = httptest.NewRequest(http.MethodDelete, "/transfers/abc", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("want %v, got %v", http.StatusNoContent, w.Code)
+	}
+	if n := len(s.Transfers()); n != 0 {
+		t.Fatalf("want 0 transfers, got %v", n)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("want %v, got %v", http.StatusNotFound, w.Code)
+	}
+}
@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// DefaultBufferSize is the size of the buffers relaying bytes, unless set by Options.BufferSize
+	DefaultBufferSize = 32 * 1024
+
+	// MinBufferSize and MaxBufferSize limit Options.BufferSize
+	MinBufferSize = 1024
+	MaxBufferSize = 1024 * 1024
+
+	// MaxTransferMemory is the most buffer memory a transfer may use, to stay under the 4MB per transfer
+	// the relay is required to use. A broadcast queues fewer chunks for its receivers with larger buffers.
+	MaxTransferMemory = 4 * 1000 * 1000
+)
+
+// bufferPool lends fixed size buffers for relaying, and accounts for the memory of those lent
+type bufferPool struct {
+	// size of new buffers, updated atomically by Configure
+	size int64
+
+	// buffers returned for reuse, as *[]byte
+	pool sync.Pool
+
+	// used is the bytes of buffers lent to every transfer
+	used bufferUse
+}
+
+// bufferUse is the buffer memory used by a transfer, updated atomically
+type bufferUse struct {
+	current int64
+	peak    int64
+}
+
+func newBufferPool(size int) *bufferPool {
+	return &bufferPool{size: int64(size)}
+}
+
+// setSize changes the size of buffers lent from now on
+func (p *bufferPool) setSize(size int) {
+	atomic.StoreInt64(&p.size, int64(size))
+}
+
+// currentSize of the buffers lent by get
+func (p *bufferPool) currentSize() int64 {
+	return atomic.LoadInt64(&p.size)
+}
+
+// get lends a buffer of the current size, accounting for it in use
+func (p *bufferPool) get(use *bufferUse) []byte {
+	return p.getSize(use, p.currentSize())
+}
+
+// getSize lends a buffer of size bytes, for a transfer that keeps the size it started with
+func (p *bufferPool) getSize(use *bufferUse, size int64) []byte {
+	var buf []byte
+	if b, ok := p.pool.Get().(*[]byte); ok && int64(len(*b)) == size {
+		buf = *b
+	} else {
+		// the pool is empty, or held buffers from before the size was changed
+		buf = make([]byte, size)
+	}
+	p.account(use, int64(len(buf)))
+	return buf
+}
+
+// put returns a buffer lent by get
+func (p *bufferPool) put(use *bufferUse, buf []byte) {
+	p.account(use, -int64(len(buf)))
+	if int64(len(buf)) == atomic.LoadInt64(&p.size) {
+		p.pool.Put(&buf)
+	}
+}
+
+func (p *bufferPool) account(use *bufferUse, n int64) {
+	p.used.add(n)
+	use.add(n)
+}
+
+// inUse is the bytes of buffers currently lent
+func (p *bufferPool) inUse() int64 {
+	return atomic.LoadInt64(&p.used.current)
+}
+
+// add n bytes to the memory in use, which may be negative, raising the peak if it is passed
+func (u *bufferUse) add(n int64) {
+	current := atomic.AddInt64(&u.current, n)
+	for {
+		peak := atomic.LoadInt64(&u.peak)
+		if current <= peak || atomic.CompareAndSwapInt64(&u.peak, peak, current) {
+			return
+		}
+	}
+}
+
+// bufferSize is the size of relay buffers set by the options
+func (o Options) bufferSize() int {
+	if o.BufferSize <= 0 {
+		return DefaultBufferSize
+	}
+	return o.BufferSize
+}
@@ -0,0 +1,122 @@
+package proxy
+
+import (
+	"bytes"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/wire"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBufferPool(t *testing.T) {
+	p := newBufferPool(1024)
+	var use bufferUse
+
+	a := p.get(&use)
+	b := p.get(&use)
+	if len(a) != 1024 || p.inUse() != 2048 || use.current != 2048 {
+		t.Fatalf("unexpected accounting: len %v, in use %v, transfer %v", len(a), p.inUse(), use.current)
+	}
+	p.put(&use, a)
+	p.put(&use, b)
+	if p.inUse() != 0 || use.current != 0 || use.peak != 2048 {
+		t.Fatalf("unexpected accounting: in use %v, transfer %v, peak %v", p.inUse(), use.current, use.peak)
+	}
+
+	// buffers from before a size change are not lent again
+	p.setSize(4096)
+	c := p.get(&use)
+	if len(c) != 4096 {
+		t.Fatalf("want 4096, got %v", len(c))
+	}
+	p.put(&use, c)
+}
+
+func TestService_BufferMemory(t *testing.T) {
+	service := New(NewRandomSecrets(8, 1), log.NewNopLogger())
+	go service.Run()
+	// the largest buffers leave a broadcast the least room in MaxTransferMemory,
+	// so its receivers wait on each other rather than being dropped
+	service.Configure(Options{BufferSize: MaxBufferSize, SlowReceiverTimeout: 10 * time.Second})
+	tr := startRelayFor(t, service)
+
+	const transfers = 20
+	body := bytes.Repeat([]byte("0123456789"), 400000)
+
+	var sends []*client.SendResponse
+	var conns []net.Conn
+	var results []<-chan received
+	for i := 0; i < transfers; i++ {
+		receivers := 1
+		if i == 0 {
+			receivers = 3
+		}
+		conn := dialConn(t, tr)
+		conns = append(conns, conn)
+		send, err := client.NewService(wire.NewEncoder(conn), wire.NewDecoder(conn)).Send(&client.SendRequest{
+			Body:      bytes.NewReader(body),
+			Name:      "artifact.bin",
+			Length:    int64(len(body)),
+			Receivers: receivers,
+		})
+		if err != nil {
+			t.Fatalf("send: %v", err)
+		}
+		sends = append(sends, send)
+		for j := 0; j < receivers; j++ {
+			results = append(results, receiveAll(t, tr, send.Secret))
+		}
+	}
+
+	// the transfers track the peak of their memory, so keep them to check it once they are done
+	running := make(chan []*transfer)
+	service.action <- func() {
+		var ts []*transfer
+		for _, t := range service.transfers {
+			ts = append(ts, t)
+		}
+		running <- ts
+	}
+	ts := <-running
+	if len(ts) != transfers {
+		t.Fatalf("want %v transfers, got %v", transfers, len(ts))
+	}
+
+	for i, result := range results {
+		r := <-result
+		if r.err != nil {
+			t.Fatalf("receiver %v: %v", i, r.err)
+		}
+		if !bytes.Equal(body, r.body) {
+			t.Fatalf("receiver %v got %v bytes, want %v", i, len(r.body), len(body))
+		}
+	}
+	for _, send := range sends {
+		if err := <-send.Errors; err != nil {
+			t.Fatalf("send errors: %v", err)
+		}
+	}
+	for _, tr := range ts {
+		if peak := atomic.LoadInt64(&tr.memory.peak); peak > MaxTransferMemory {
+			t.Fatalf("transfer %v used %v bytes", tr.id, peak)
+		}
+	}
+	if peak := atomic.LoadInt64(&service.buffers.used.peak); peak > transfers*MaxTransferMemory {
+		t.Fatalf("relay used %v bytes", peak)
+	}
+
+	// every buffer is returned once the senders close and the transfers end
+	for _, conn := range conns {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for service.Stats().BufferBytes != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no buffers in use, got %v bytes", service.Stats().BufferBytes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
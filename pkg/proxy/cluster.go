@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/log/level"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// Cluster joins a relay to other relays sharing a Directory.
+// A sender and receiver can then connect to different relays of the cluster, with the receiver's
+// relay forwarding the receiver to the sender's relay.
+type Cluster struct {
+	// Directory of the transfers waiting on each relay
+	Directory Directory
+
+	// Addr that other relays dial to reach this relay, see transport.Parse
+	Addr string
+
+	// Transport to dial other relays with, chosen from their address if nil
+	Transport transport.Transport
+}
+
+// register the reserved secret of a new transfer in cluster c, if there is one.
+// Must not be called from an action, as the directory may be slow.
+func (r *Service) register(c *Cluster, ts transferSide) error {
+	if c == nil {
+		return nil
+	}
+	err := c.Directory.Register(ts.secret, c.Addr)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, errDuplicateSecret) && ts.custom:
+		level.Warn(r.logger).Log("msg", "custom code taken in cluster", "secret", redact(ts.secret), "addr", ts.addr)
+		return &client.CodeError{Code: ts.secret, Status: client.CodeTaken}
+	case errors.Is(err, errDuplicateSecret):
+		level.Error(r.logger).Log("msg", "duplicate secret in cluster", "secret", redact(ts.secret))
+	default:
+		level.Error(r.logger).Log("msg", "failed registering secret", "secret", redact(ts.secret), "err", err)
+	}
+	return err
+}
+
+// unregister the secret of an ended transfer from the cluster in the background, keeping the secret reserved
+// until it is, so a new transfer with the secret isn't refused by the cluster. Must be called from an action.
+func (r *Service) unregister(secret string) {
+	c := r.opts.Cluster
+	if c == nil {
+		return
+	}
+	r.reserved[secret] = struct{}{}
+	go func() {
+		if err := c.Directory.Unregister(secret); err != nil {
+			level.Error(r.logger).Log("msg", "failed unregistering secret", "secret", redact(secret), "err", err)
+		}
+		r.action <- func() {
+			delete(r.reserved, secret)
+		}
+	}()
+}
+
+// forward a client that joined with a secret unknown to this relay, to the relay of the cluster with the transfer.
+// The client's handshake is replayed to the other relay, and then bytes are copied both ways, so this relay
+// looks like the client to the other relay. The client's connection is closed if there is no such transfer.
+func (r *Service) forward(ts transferSide, c *Cluster, timeout time.Duration) {
+	defer ts.conn.Close()
+
+	addr, ok, err := c.Directory.Lookup(ts.secret)
+	if err != nil {
+		level.Error(r.logger).Log("msg", "failed looking up secret", "secret", redact(ts.secret), "err", err)
+		return
+	}
+	if !ok || addr == c.Addr {
+		return
+	}
+
+	t, a := c.Transport, addr
+	if t == nil {
+		t, a = transport.Parse(addr)
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	upstream, err := t.Dial(ctx, a)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed dialing relay", "relay", addr, "err", err)
+		return
+	}
+	defer upstream.Close()
+
+	enc := wire.NewEncoder(upstream)
+	if ts.direct {
+		err = enc.EncodeByte(byte(client.MsgDirect))
+	}
+	if err == nil {
+		err = enc.EncodeByte(byte(ts.side))
+	}
+	if err == nil {
+		err = enc.EncodeString(ts.secret)
+	}
+	if err == nil && ts.side == client.MsgStream {
+		if err = enc.EncodeByte(byte(ts.role)); err == nil {
+			err = enc.EncodeByte(byte(ts.index))
+		}
+	}
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed forwarding handshake", "relay", addr, "err", err)
+		return
+	}
+
+	// handshake is over, so clear any deadline
+	setDeadline(ts.conn, 0)
+
+	level.Info(r.logger).Log(
+		"msg", "forwarding",
+		"side", ts.side,
+		"secret", redact(ts.secret),
+		"relay", addr,
+		"addr", ts.addr,
+	)
+	// the relay with the transfer counts its bytes as relayed, while the buffers forwarding them are this relay's
+	var n int64
+	var use bufferUse
+	if err := splice(ts.conn, upstream, &n, r.buffers, &use); err != nil {
+		level.Warn(r.logger).Log("msg", "forwarding to relay failed", "relay", addr, "err", err)
+	}
+	level.Info(r.logger).Log(
+		"msg", "forwarded",
+		"secret", redact(ts.secret),
+		"relay", addr,
+		"bytes", atomic.LoadInt64(&n),
+		"buffer_peak", atomic.LoadInt64(&use.peak),
+	)
+}
+
+// splice copies bytes both ways between two connections until either way ends.
+// The caller closes both connections afterwards, which ends the other way.
+func splice(a io.ReadWriter, b io.ReadWriter, n *int64, buffers *bufferPool, use *bufferUse) error {
+	errs := make(chan error, 2)
+	go func() {
+		_, err := relayCopy(a, b, n, buffers, use)
+		errs <- err
+	}()
+	go func() {
+		_, err := relayCopy(b, a, n, buffers, use)
+		errs <- err
+	}()
+	return <-errs
+}
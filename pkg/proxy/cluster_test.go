@@ -0,0 +1,216 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// startCluster runs n relays sharing a directory on an in-memory transport until the test ends.
+// The relays listen on "relay-0" to "relay-<n-1>".
+func startCluster(t *testing.T, n int, opts Options) (*transport.Memory, Directory) {
+	t.Helper()
+	tr := transport.NewMemory()
+	dir := NewMemoryDirectory()
+	for i := 0; i < n; i++ {
+		addr := fmt.Sprintf("relay-%v", i)
+		service := New(NewRandomSecrets(6, int64(i)), log.NewNopLogger())
+		go service.Run()
+
+		o := opts
+		o.Cluster = &Cluster{Directory: dir, Addr: addr, Transport: tr}
+		service.Configure(o)
+
+		l, err := tr.Listen(addr)
+		if err != nil {
+			t.Fatalf("listen: %v", err)
+		}
+		t.Cleanup(func() { l.Close() })
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go service.Onboard(conn)
+			}
+		}()
+	}
+	return tr, dir
+}
+
+// dialRelay connects a client service to a relay of a cluster
+func dialRelay(t *testing.T, tr transport.Transport, addr string) client.Service {
+	t.Helper()
+	conn, err := tr.Dial(context.Background(), addr)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return client.NewService(wire.NewEncoder(conn), wire.NewDecoder(conn))
+}
+
+func TestCluster_Transfer(t *testing.T) {
+	tr, dir := startCluster(t, 3, Options{})
+
+	conn, err := tr.Dial(context.Background(), "relay-0")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	body := "the quick brown fox"
+	send, err := client.NewConnService(conn).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   "fox.txt",
+		Length: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if addr, ok, _ := dir.Lookup(send.Secret); !ok || addr != "relay-0" {
+		t.Fatalf("want relay-0 registered, got %v %v", addr, ok)
+	}
+
+	recv, err := dialRelay(t, tr, "relay-2").Recv(send.Secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	b := &strings.Builder{}
+	if _, err := io.Copy(b, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if recv.Name != "fox.txt" || b.String() != body {
+		t.Fatalf("want fox.txt %v, got %v %v", body, recv.Name, b.String())
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+	conn.Close()
+
+	// the secret is unregistered once the transfer ends, so can't be received again
+	deadline := time.Now().Add(time.Second)
+	for {
+		if _, ok, _ := dir.Lookup(send.Secret); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("secret still registered")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := dialRelay(t, tr, "relay-1").Recv(send.Secret); err == nil {
+		t.Fatal("expected error receiving an ended transfer")
+	}
+}
+
+func TestCluster_CustomCodeTaken(t *testing.T) {
+	tr, _ := startCluster(t, 2, Options{AllowCustomCodes: true})
+
+	sendCode := func(addr string) error {
+		_, err := dialRelay(t, tr, addr).Send(&client.SendRequest{
+			Body: strings.NewReader(""),
+			Name: "empty",
+			Code: "deploy-artifacts-42",
+		})
+		return err
+	}
+
+	if err := sendCode("relay-0"); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	var codeErr *client.CodeError
+	if err := sendCode("relay-1"); !errors.As(err, &codeErr) || codeErr.Status != client.CodeTaken {
+		t.Fatalf("want %v, got %v", client.CodeTaken, err)
+	}
+}
+
+func TestCluster_Session(t *testing.T) {
+	tr, _ := startCluster(t, 2, Options{})
+
+	opener, err := dialRelay(t, tr, "relay-0").OpenSession()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	joiner, err := dialRelay(t, tr, "relay-1").JoinSession(opener.Secret)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+
+	go func() {
+		_ = joiner.Send("reply", strings.NewReader("pong"), 4)
+	}()
+	recv, err := opener.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	b := &strings.Builder{}
+	if _, err := io.Copy(b, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if recv.Name != "reply" || b.String() != "pong" {
+		t.Fatalf("want reply pong, got %v %v", recv.Name, b.String())
+	}
+}
+
+// blockingDirectory holds registrations until released, like a slow shared file system
+type blockingDirectory struct {
+	Directory
+	registering chan struct{}
+	release     chan struct{}
+}
+
+func (d *blockingDirectory) Register(secret string, addr string) error {
+	d.registering <- struct{}{}
+	<-d.release
+	return d.Directory.Register(secret, addr)
+}
+
+func TestCluster_SlowDirectory(t *testing.T) {
+	dir := &blockingDirectory{
+		Directory:   NewMemoryDirectory(),
+		registering: make(chan struct{}, 1),
+		release:     make(chan struct{}),
+	}
+	service := New(NewRandomSecrets(6, 0), log.NewNopLogger())
+	go service.Run()
+	service.Configure(Options{AllowCustomCodes: true, Cluster: &Cluster{Directory: dir, Addr: "relay"}})
+	tr := startRelayFor(t, service)
+
+	sendCode := func() error {
+		_, err := dialService(t, tr).Send(&client.SendRequest{
+			Body: strings.NewReader(""),
+			Name: "empty",
+			Code: "deploy-artifacts-42",
+		})
+		return err
+	}
+	sent := make(chan error, 1)
+	go func() { sent <- sendCode() }()
+	<-dir.registering
+
+	// the relay carries on while the code is registered, and the code is reserved meanwhile
+	if got := service.Transfers(); len(got) != 0 {
+		t.Fatalf("want no transfers while registering, got %v", got)
+	}
+	var codeErr *client.CodeError
+	if err := sendCode(); !errors.As(err, &codeErr) || codeErr.Status != client.CodeTaken {
+		t.Fatalf("want %v, got %v", client.CodeTaken, err)
+	}
+
+	close(dir.release)
+	if err := <-sent; err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got := service.Transfers(); len(got) != 1 {
+		t.Fatalf("want the transfer once registered, got %v", got)
+	}
+}
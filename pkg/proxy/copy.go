@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// spliceChunk is how many bytes are spliced between TCP connections at a time,
+// so the bytes relayed are still counted as a transfer progresses
+const spliceChunk = 1 << 20
+
+// relayCopy copies from src to dst until src ends, adding the bytes copied to n as it goes.
+// When both are TCP connections the copy is made by dst.ReadFrom, which on Linux splices the bytes
+// between the sockets in the kernel rather than reading them into a buffer and writing them out again.
+// Connections are kept as their concrete types behind io.ReadWriteCloser so this is possible.
+// Otherwise the copy is through a buffer from buffers, accounted to use.
+func relayCopy(dst io.Writer, src io.Reader, n *int64, buffers *bufferPool, use *bufferUse) (int64, error) {
+	return relayCopySize(dst, src, n, buffers, use, buffers.currentSize())
+}
+
+// relayCopySize is relayCopy with a buffer of size bytes, such as a smaller one to keep a transfer within its memory
+func relayCopySize(dst io.Writer, src io.Reader, n *int64, buffers *bufferPool, use *bufferUse, size int64) (int64, error) {
+	if d, ok := dst.(*net.TCPConn); ok {
+		if s, ok := src.(*net.TCPConn); ok {
+			return spliceTCP(d, s, n)
+		}
+	}
+	buf := buffers.getSize(use, size)
+	defer buffers.put(use, buf)
+	// hide any WriteTo of src, which would copy with a buffer of its own
+	return io.CopyBuffer(countingWriter{Writer: dst, n: n}, readerOnly{src}, buf)
+}
+
+// readerOnly hides any methods of a reader other than Read
+type readerOnly struct {
+	io.Reader
+}
+
+// writerOnly hides any methods of a writer other than Write, such as a ReadFrom that would copy with a buffer of its own
+type writerOnly struct {
+	io.Writer
+}
+
+// spliceTCP copies between TCP connections a chunk at a time
+func spliceTCP(dst *net.TCPConn, src *net.TCPConn, n *int64) (int64, error) {
+	var written int64
+	for {
+		// splicing is used for a TCP connection within an io.LimitedReader too
+		c, err := dst.ReadFrom(&io.LimitedReader{R: src, N: spliceChunk})
+		written += c
+		atomic.AddInt64(n, c)
+		if err != nil {
+			return written, err
+		}
+		if c == 0 {
+			// src has ended
+			return written, nil
+		}
+	}
+}
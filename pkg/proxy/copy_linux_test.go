@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package proxy
+
+import (
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// benchmarkSize is the number of bytes relayed by each iteration of the benchmark
+const benchmarkSize = 256 << 20
+
+// cpuTime is the user and system CPU time used by the process so far
+func cpuTime(b *testing.B) time.Duration {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		b.Fatalf("getrusage: %v", err)
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// benchmarkRelay relays between TCP connections over loopback with copy, reporting
+// throughput and the CPU time of the whole process per GB relayed.
+// The sender and receiver are in the process too, so the difference between copies is what matters.
+func benchmarkRelay(b *testing.B, copy func(dst io.Writer, src io.Reader, n *int64) (int64, error)) {
+	chunk := make([]byte, 256<<10)
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	start := cpuTime(b)
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		sender, src := tcpPair(b)
+		dst, receiver := tcpPair(b)
+		b.StartTimer()
+
+		go func() {
+			for sent := 0; sent < benchmarkSize; sent += len(chunk) {
+				if _, err := sender.Write(chunk); err != nil {
+					break
+				}
+			}
+			_ = sender.Close()
+		}()
+		done := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, receiver)
+			close(done)
+		}()
+
+		var counted int64
+		if _, err := copy(net.Conn(dst), net.Conn(src), &counted); err != nil {
+			b.Fatalf("relay: %v", err)
+		}
+		_ = dst.Close()
+		<-done
+		if counted != benchmarkSize {
+			b.Fatalf("want %v bytes, got %v", benchmarkSize, counted)
+		}
+	}
+
+	b.StopTimer()
+	gb := float64(b.N) * benchmarkSize / (1 << 30)
+	b.ReportMetric(float64((cpuTime(b)-start).Milliseconds())/gb, "cpu-ms/GB")
+}
+
+// BenchmarkRelay compares splicing between TCP connections with copying through a buffer,
+// as io.Copy does when both connections are hidden, so neither ReadFrom nor WriteTo can splice:
+//
+//	go test -run NONE -bench Relay ./pkg/proxy
+func BenchmarkRelay(b *testing.B) {
+	b.Run("splice", func(b *testing.B) {
+		benchmarkRelay(b, func(dst io.Writer, src io.Reader, n *int64) (int64, error) {
+			return relayCopy(dst, src, n, newBufferPool(DefaultBufferSize), &bufferUse{})
+		})
+	})
+	b.Run("buffered", func(b *testing.B) {
+		benchmarkRelay(b, func(dst io.Writer, src io.Reader, n *int64) (int64, error) {
+			return io.Copy(countingWriter{Writer: dst, n: n}, readerOnly{src})
+		})
+	})
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+)
+
+// tcpPair returns both ends of a TCP connection over loopback
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed.(*net.TCPConn), conn.(*net.TCPConn)
+}
+
+// relayThrough relays body from a sender to a receiver through conns of the relay, accounting any buffer to use,
+// and returns what was received
+func relayThrough(t testing.TB, sender io.WriteCloser, src io.Reader, dst io.WriteCloser, receiver io.Reader, body []byte, use *bufferUse) ([]byte, int64, int64) {
+	t.Helper()
+	go func() {
+		_, _ = sender.Write(body)
+		_ = sender.Close()
+	}()
+	received := make(chan []byte, 1)
+	go func() {
+		bs, _ := io.ReadAll(receiver)
+		received <- bs
+	}()
+
+	var counted int64
+	n, err := relayCopy(dst, src, &counted, newBufferPool(DefaultBufferSize), use)
+	if err != nil {
+		t.Fatalf("relay: %v", err)
+	}
+	_ = dst.Close()
+	return <-received, n, counted
+}
+
+func TestRelayCopy(t *testing.T) {
+	body := make([]byte, 3*spliceChunk+123)
+	rand.New(rand.NewSource(1)).Read(body)
+
+	t.Run("tcp", func(t *testing.T) {
+		sender, src := tcpPair(t)
+		dst, receiver := tcpPair(t)
+		var use bufferUse
+		got, n, counted := relayThrough(t, sender, src, dst, receiver, body, &use)
+		if !bytes.Equal(got, body) || n != int64(len(body)) || counted != n {
+			t.Fatalf("want %v bytes, got %v, copied %v and counted %v", len(body), len(got), n, counted)
+		}
+		// spliced, so without a buffer
+		if use.peak != 0 {
+			t.Fatalf("want no buffer, used %v bytes", use.peak)
+		}
+	})
+
+	t.Run("other connections", func(t *testing.T) {
+		sender, src := net.Pipe()
+		dst, receiver := net.Pipe()
+		var use bufferUse
+		got, n, counted := relayThrough(t, sender, src, dst, receiver, body, &use)
+		if !bytes.Equal(got, body) || n != int64(len(body)) || counted != n {
+			t.Fatalf("want %v bytes, got %v, copied %v and counted %v", len(body), len(got), n, counted)
+		}
+		if use.peak != DefaultBufferSize {
+			t.Fatalf("want a buffer of %v bytes, used %v bytes", DefaultBufferSize, use.peak)
+		}
+	})
+}
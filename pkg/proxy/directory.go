@@ -0,0 +1,246 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory records which relay of a cluster each waiting transfer is on, so a client can join
+// a transfer through any relay of the cluster.
+// Methods are called while a relay updates its transfers, so must be quick, like a local map or file.
+type Directory interface {
+	// Register records the transfer for secret as being on the relay at addr.
+	// Returns errDuplicateSecret if the secret is already registered by any relay.
+	Register(secret string, addr string) error
+
+	// Lookup returns the address of the relay with the transfer for secret, or false if there isn't one
+	Lookup(secret string) (string, bool, error)
+
+	// Unregister removes the secret, once its transfer has ended
+	Unregister(secret string) error
+}
+
+// memoryDirectory is a Directory shared by relays in the same process
+type memoryDirectory struct {
+	// guards addrs
+	sync.Mutex
+
+	// addrs of relays by secret
+	addrs map[string]string
+}
+
+// NewMemoryDirectory returns a Directory for relays running in the same process, such as in tests
+func NewMemoryDirectory() Directory {
+	return &memoryDirectory{
+		addrs: make(map[string]string),
+	}
+}
+
+func (d *memoryDirectory) Register(secret string, addr string) error {
+	defer d.Unlock()
+	d.Lock()
+	if _, ok := d.addrs[secret]; ok {
+		return errDuplicateSecret
+	}
+	d.addrs[secret] = addr
+	return nil
+}
+
+func (d *memoryDirectory) Lookup(secret string) (string, bool, error) {
+	defer d.Unlock()
+	d.Lock()
+	addr, ok := d.addrs[secret]
+	return addr, ok, nil
+}
+
+func (d *memoryDirectory) Unregister(secret string) error {
+	defer d.Unlock()
+	d.Lock()
+	delete(d.addrs, secret)
+	return nil
+}
+
+// FileDirectoryOptions decide when entries of a file directory are stale, such as those left by a relay that crashed
+type FileDirectoryOptions struct {
+	// TTL after which an entry is stale, as its transfer can no longer be joined. Zero keeps entries until unregistered.
+	TTL time.Duration
+
+	// Reachable reports whether the relay at addr is still running, so the entries of a relay that has gone are
+	// replaced. It is only called when registering a secret that another relay has, and must be quick.
+	// Entries of other relays are kept until their TTL if nil.
+	Reachable func(addr string) bool
+}
+
+// fileDirectory is a Directory of files in a directory shared by the relays, such as on a network file system.
+// Each secret is a file named by a hash of the secret, containing a directoryEntry.
+type fileDirectory struct {
+	dir  string
+	opts FileDirectoryOptions
+
+	// instance tells entries registered by this process from those of other runs of the same relay,
+	// and those registered before started are of an earlier run
+	instance string
+	started  time.Time
+
+	// now is the time, replaced in tests
+	now func() time.Time
+}
+
+// directoryEntry records the relay that registered a secret
+type directoryEntry struct {
+	Addr       string    `json:"addr"`
+	Instance   string    `json:"instance"`
+	Registered time.Time `json:"registered"`
+}
+
+// NewFileDirectory returns a Directory kept in dir, creating dir if needed
+func NewFileDirectory(dir string, opts FileDirectoryOptions) (Directory, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating directory: %w", err)
+	}
+	return &fileDirectory{dir: dir, opts: opts, instance: newTransferID(), started: time.Now(), now: time.Now}, nil
+}
+
+func (d *fileDirectory) path(secret string) string {
+	return filepath.Join(d.dir, storeKey(secret))
+}
+
+func (d *fileDirectory) Register(secret string, addr string) error {
+	bs, err := json.Marshal(directoryEntry{Addr: addr, Instance: d.instance, Registered: d.now()})
+	if err != nil {
+		return fmt.Errorf("registering secret: %w", err)
+	}
+	// the entry is written in full before linking it into place, so other relays never see a partial entry,
+	// and linking fails if the secret is already registered, which makes registering atomic across relays
+	tmp, err := os.CreateTemp(d.dir, ".register-*")
+	if err != nil {
+		return fmt.Errorf("registering secret: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bs); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("registering secret: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("registering secret: %w", err)
+	}
+
+	err = os.Link(tmp.Name(), d.path(secret))
+	if !errors.Is(err, os.ErrExist) {
+		if err != nil {
+			return fmt.Errorf("registering secret: %w", err)
+		}
+		return nil
+	}
+
+	// the secret is taken, unless its entry is stale
+	old, ok, err := d.read(secret)
+	if err != nil {
+		return fmt.Errorf("registering secret: %w", err)
+	}
+	if ok && !d.stale(old, addr) {
+		return errDuplicateSecret
+	}
+	if err := d.remove(secret, old, ok); err != nil {
+		return err
+	}
+	if err := os.Link(tmp.Name(), d.path(secret)); err != nil {
+		if errors.Is(err, os.ErrExist) {
+			// another relay replaced the stale entry first
+			return errDuplicateSecret
+		}
+		return fmt.Errorf("registering secret: %w", err)
+	}
+	return nil
+}
+
+func (d *fileDirectory) Lookup(secret string) (string, bool, error) {
+	e, ok, err := d.read(secret)
+	if err != nil {
+		return "", false, fmt.Errorf("looking up secret: %w", err)
+	}
+	if !ok || d.expired(e) {
+		return "", false, nil
+	}
+	return e.Addr, true, nil
+}
+
+// Unregister removes the entry for secret if this relay registered it, as a stale entry may have been replaced
+func (d *fileDirectory) Unregister(secret string) error {
+	e, ok, err := d.read(secret)
+	if err != nil {
+		return fmt.Errorf("unregistering secret: %w", err)
+	}
+	if ok && e.Instance != d.instance {
+		return nil
+	}
+	return d.remove(secret, e, ok)
+}
+
+// read the entry for secret, which isn't ok if it doesn't exist or can't be parsed,
+// such as one left by an older relay
+func (d *fileDirectory) read(secret string) (directoryEntry, bool, error) {
+	var e directoryEntry
+	bs, err := os.ReadFile(d.path(secret))
+	if errors.Is(err, os.ErrNotExist) {
+		return e, false, nil
+	}
+	if err != nil {
+		return e, false, err
+	}
+	if err := json.Unmarshal(bs, &e); err != nil || e.Addr == "" {
+		return e, false, nil
+	}
+	return e, true, nil
+}
+
+// expired is set for an entry older than the TTL
+func (d *fileDirectory) expired(e directoryEntry) bool {
+	return d.opts.TTL > 0 && d.now().Sub(e.Registered) > d.opts.TTL
+}
+
+// stale is set for an entry that relay addr can replace, as its transfer has gone
+func (d *fileDirectory) stale(e directoryEntry, addr string) bool {
+	switch {
+	case d.expired(e):
+		return true
+	case e.Addr == addr:
+		// registered by this relay, so it is stale if registered before the relay restarted
+		return e.Instance != d.instance && e.Registered.Before(d.started)
+	case d.opts.Reachable != nil:
+		return !d.opts.Reachable(e.Addr)
+	}
+	return false
+}
+
+// remove the entry for secret, if it is still the entry that was read, so an entry
+// registered by another relay in the meantime isn't removed
+func (d *fileDirectory) remove(secret string, e directoryEntry, ok bool) error {
+	// the entry is moved aside before checking it, so it can't be replaced between checking and removing it
+	aside := fmt.Sprintf("%v.%v.removing", d.path(secret), newTransferID())
+	if err := os.Rename(d.path(secret), aside); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("removing secret: %w", err)
+	}
+	defer os.Remove(aside)
+
+	var moved directoryEntry
+	bs, err := os.ReadFile(aside)
+	if err != nil {
+		return fmt.Errorf("removing secret: %w", err)
+	}
+	if json.Unmarshal(bs, &moved) == nil && moved.Addr != "" && (!ok || moved != e) {
+		// a new entry, so put it back
+		if err := os.Link(aside, d.path(secret)); err != nil && !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("restoring secret: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package proxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testDirectory(t *testing.T, d Directory) {
+	if _, ok, err := d.Lookup("abc123"); ok || err != nil {
+		t.Fatalf("want nothing, got %v %v", ok, err)
+	}
+	if err := d.Register("abc123", "relay-0"); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	if err := d.Register("abc123", "relay-1"); !errors.Is(err, errDuplicateSecret) {
+		t.Fatalf("want %v, got %v", errDuplicateSecret, err)
+	}
+	if addr, ok, err := d.Lookup("abc123"); !ok || err != nil || addr != "relay-0" {
+		t.Fatalf("want relay-0, got %v %v %v", addr, ok, err)
+	}
+	if err := d.Unregister("abc123"); err != nil {
+		t.Fatalf("unregister: %v", err)
+	}
+	if _, ok, _ := d.Lookup("abc123"); ok {
+		t.Fatal("secret still registered")
+	}
+	if err := d.Unregister("abc123"); err != nil {
+		t.Fatalf("unregister twice: %v", err)
+	}
+}
+
+func TestMemoryDirectory(t *testing.T) {
+	testDirectory(t, NewMemoryDirectory())
+}
+
+func TestFileDirectory(t *testing.T) {
+	d, err := NewFileDirectory(t.TempDir(), FileDirectoryOptions{})
+	if err != nil {
+		t.Fatalf("new directory: %v", err)
+	}
+	testDirectory(t, d)
+}
+
+func TestFileDirectory_Stale(t *testing.T) {
+	dir := t.TempDir()
+	down := map[string]bool{}
+	open := func() *fileDirectory {
+		d, err := NewFileDirectory(dir, FileDirectoryOptions{
+			TTL:       time.Minute,
+			Reachable: func(addr string) bool { return !down[addr] },
+		})
+		if err != nil {
+			t.Fatalf("new directory: %v", err)
+		}
+		return d.(*fileDirectory)
+	}
+	relay0, relay1 := open(), open()
+	register := func(d *fileDirectory, addr string, want error) {
+		t.Helper()
+		if err := d.Register("abc123", addr); !errors.Is(err, want) {
+			t.Fatalf("%v: want %v, got %v", addr, want, err)
+		}
+	}
+	lookup := func(want string) {
+		t.Helper()
+		addr, ok, err := relay1.Lookup("abc123")
+		if err != nil || (want != "") != ok || addr != want {
+			t.Fatalf("want %q, got %q %v %v", want, addr, ok, err)
+		}
+	}
+
+	// an entry of a running relay is kept
+	register(relay0, "relay-0", nil)
+	register(relay1, "relay-1", errDuplicateSecret)
+	lookup("relay-0")
+
+	// but is replaced once the relay that registered it can't be reached
+	down["relay-0"] = true
+	register(relay1, "relay-1", nil)
+	lookup("relay-1")
+
+	// and the relay that lost the entry doesn't remove it once its transfer ends
+	if err := relay0.Unregister("abc123"); err != nil {
+		t.Fatalf("unregister: %v", err)
+	}
+	lookup("relay-1")
+
+	// an entry older than the TTL has expired, even when its relay is still running
+	now := time.Now()
+	relay0.now = func() time.Time { return now.Add(2 * time.Minute) }
+	relay1.now = relay0.now
+	lookup("")
+	down["relay-0"] = false
+	register(relay0, "relay-0", nil)
+	lookup("relay-0")
+
+	// and a relay that has restarted replaces the entries of its earlier run
+	restarted := open()
+	restarted.now = func() time.Time { return now.Add(3 * time.Minute) }
+	restarted.started = restarted.now()
+	register(restarted, "relay-0", nil)
+	lookup("relay-0")
+	register(relay0, "relay-0", errDuplicateSecret)
+}
@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/go-kit/log/level"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxReceivers of a broadcast, as receivers are declared in a single byte
+	maxReceivers = 255
+
+	// fanoutQueueLength is how many chunks a receiver can fall behind before it is dropped.
+	// Chunks are read into pooled buffers and shared by receivers, so memory is bounded by the
+	// queue length regardless of the number of receivers, at (queue length+2) buffers.
+	// The queue is shortened for large buffers to keep within MaxTransferMemory.
+	fanoutQueueLength = 64
+)
+
+// fanoutQueue is the queue length of each receiver for buffers of size bytes
+func fanoutQueue(size int) int {
+	n := MaxTransferMemory/size - 2
+	if n > fanoutQueueLength {
+		n = fanoutQueueLength
+	}
+	if n < 1 {
+		n = 1
+	}
+	return n
+}
+
+// chunk of bytes read from a broadcasting sender, shared by the receivers it is queued for.
+// The buffer is returned to the pool once every reference is released.
+type chunk struct {
+	buf  []byte
+	n    int
+	refs int32
+}
+
+// release a reference to the chunk
+func (c *chunk) release(t *transfer, buffers *bufferPool) {
+	if atomic.AddInt32(&c.refs, -1) == 0 {
+		buffers.put(&t.memory, c.buf)
+	}
+}
+
+// errNoReceivers is returned when every receiver of a broadcast has been dropped
+var errNoReceivers = errors.New("all receivers dropped")
+
+// sink queues chunks for a receiver of a broadcast
+type sink struct {
+	receiver
+
+	// chunks waiting to be written to the receiver
+	chunks chan *chunk
+
+	// failed is set by the writing go routine if a write fails
+	failed int32
+
+	// dropped is set by the reading go routine once the sink is closed
+	dropped bool
+}
+
+// write sends queued chunks to the receiver until the queue is closed, releasing each once written
+func (s *sink) write(wg *sync.WaitGroup, t *transfer, buffers *bufferPool) {
+	defer wg.Done()
+	for c := range s.chunks {
+		// after a failure, drain until the reader notices it
+		if atomic.LoadInt32(&s.failed) == 0 {
+			if _, err := s.conn.Write(c.buf[:c.n]); err != nil {
+				atomic.StoreInt32(&s.failed, 1)
+			}
+		}
+		c.release(t, buffers)
+	}
+}
+
+// push queues a chunk, waiting up to timeout if the queue is full.
+// Returns false if the chunk couldn't be queued.
+func (s *sink) push(chunk *chunk, timeout time.Duration) bool {
+	select {
+	case s.chunks <- chunk:
+		return true
+	default:
+	}
+	if timeout <= 0 {
+		return false
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case s.chunks <- chunk:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// fanout copies bytes from the sender to every receiver.
+// A receiver that falls too far behind for too long, or fails, is dropped by closing its
+// connection, so it sees a truncated stream rather than stalling the other receivers.
+func (t *transfer) fanout(r *Service) error {
+	buffers := r.buffers
+
+	// the reader holds a reference to each chunk until it is queued for every receiver.
+	// Every chunk has the size of the first, as the queue length depends on it.
+	c := &chunk{buf: buffers.get(&t.memory), refs: 1}
+	size := int64(len(c.buf))
+	queue := fanoutQueue(len(c.buf))
+
+	wg := &sync.WaitGroup{}
+	sinks := make([]*sink, len(t.recvs))
+	for i, recv := range t.recvs {
+		sinks[i] = &sink{receiver: recv, chunks: make(chan *chunk, queue)}
+		wg.Add(1)
+		go sinks[i].write(wg, t, buffers)
+	}
+	defer wg.Wait()
+
+	drop := func(s *sink, reason string) {
+		level.Warn(r.logger).Log("msg", "dropping receiver", "transfer", t.id, "addr", s.addr, "reason", reason)
+		s.dropped = true
+		close(s.chunks)
+		_ = s.conn.Close()
+	}
+	defer func() {
+		for _, s := range sinks {
+			if !s.dropped {
+				close(s.chunks)
+			}
+		}
+	}()
+
+	for {
+		n, err := t.send.Read(c.buf)
+		c.n = n
+		live := 0
+		if n > 0 {
+			atomic.AddInt64(&t.bytes, int64(n))
+			for _, s := range sinks {
+				if s.dropped {
+					continue
+				}
+				if atomic.LoadInt32(&s.failed) == 1 {
+					drop(s, "write failed")
+					continue
+				}
+				atomic.AddInt32(&c.refs, 1)
+				if s.push(c, t.slowTimeout) {
+					live++
+				} else {
+					c.release(t, buffers)
+					drop(s, "too slow")
+				}
+			}
+		}
+		c.release(t, buffers)
+		if n > 0 && live == 0 {
+			return errNoReceivers
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c = &chunk{buf: buffers.getSize(&t.memory, size), refs: 1}
+	}
+}
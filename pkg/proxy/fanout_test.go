@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bytes"
+	"errors"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"io"
+	"testing"
+	"time"
+)
+
+// received is the result of a receiver reading a whole body
+type received struct {
+	body []byte
+	err  error
+}
+
+// receiveAll starts a receiver which reads the whole body.
+// Receivers must run concurrently, as a broadcast doesn't start until its receivers have joined.
+func receiveAll(t *testing.T, tr transport.Transport, secret string) <-chan received {
+	t.Helper()
+	s := dialService(t, tr)
+	result := make(chan received, 1)
+	go func() {
+		recv, err := s.Recv(secret)
+		if err != nil {
+			result <- received{err: err}
+			return
+		}
+		body, err := io.ReadAll(recv.Body)
+		result <- received{body: body, err: err}
+	}()
+	return result
+}
+
+func TestService_Broadcast(t *testing.T) {
+	tr := startRelay(t, NewRandomSecrets(6, 1))
+
+	body := bytes.Repeat([]byte("0123456789"), 100000)
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:      bytes.NewReader(body),
+		Name:      "artifact.bin",
+		Length:    int64(len(body)),
+		Receivers: 3,
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	var results []<-chan received
+	for i := 0; i < 3; i++ {
+		results = append(results, receiveAll(t, tr, send.Secret))
+	}
+	for i, result := range results {
+		r := <-result
+		if r.err != nil {
+			t.Fatalf("receiver %v: %v", i, r.err)
+		}
+		if !bytes.Equal(body, r.body) {
+			t.Fatalf("receiver %v got %v bytes, want %v", i, len(r.body), len(body))
+		}
+	}
+
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+
+	// a fourth receiver is too late
+	if r := <-receiveAll(t, tr, send.Secret); r.err == nil {
+		t.Fatal("expected late receiver to fail")
+	}
+}
+
+func TestService_BroadcastWindow(t *testing.T) {
+	tr := startRelay(t, NewRandomSecrets(6, 1))
+
+	body := []byte("small artifact")
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:      bytes.NewReader(body),
+		Name:      "artifact.bin",
+		Length:    int64(len(body)),
+		Receivers: 10,
+		Window:    10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	// only two receivers join before the window closes
+	first := receiveAll(t, tr, send.Secret)
+	second := receiveAll(t, tr, send.Secret)
+	for i, result := range []<-chan received{first, second} {
+		r := <-result
+		if r.err != nil {
+			t.Fatalf("receiver %v: %v", i, r.err)
+		}
+		if !bytes.Equal(body, r.body) {
+			t.Fatalf("want %v, got %v", string(body), string(r.body))
+		}
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+}
+
+func TestService_BroadcastDropsSlowReceiver(t *testing.T) {
+	service := New(NewRandomSecrets(6, 1), log.NewNopLogger())
+	go service.Run()
+	service.Configure(Options{SlowReceiverTimeout: 50 * time.Millisecond})
+	tr := startRelayFor(t, service)
+
+	// large enough to overflow the queue of a receiver that doesn't read
+	body := bytes.Repeat([]byte{'x'}, 4*fanoutQueueLength*DefaultBufferSize)
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:      bytes.NewReader(body),
+		Name:      "artifact.bin",
+		Length:    int64(len(body)),
+		Receivers: 2,
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	fast := receiveAll(t, tr, send.Secret)
+
+	// slow receiver reads the name, but doesn't read the body until the fast receiver is done
+	slowService := dialService(t, tr)
+	slowBody := make(chan io.Reader, 1)
+	go func() {
+		recv, err := slowService.Recv(send.Secret)
+		if err != nil {
+			slowBody <- bytes.NewReader(nil)
+			return
+		}
+		slowBody <- recv.Body
+	}()
+
+	r := <-fast
+	if r.err != nil {
+		t.Fatalf("fast receiver: %v", r.err)
+	}
+	if len(r.body) != len(body) {
+		t.Fatalf("want %v bytes, got %v", len(body), len(r.body))
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+
+	if _, err := io.ReadAll(<-slowBody); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
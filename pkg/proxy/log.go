@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// redactKey is generated once per process, so redacted secrets correlate log lines of this relay but can't be
+// reversed by hashing every possible code, as codes are short
+var redactKey = newRedactKey()
+
+func newRedactKey() []byte {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return key
+}
+
+// redact keys a hash of a secret so it can be logged for correlation without revealing it
+func redact(secret string) string {
+	mac := hmac.New(sha256.New, redactKey)
+	mac.Write([]byte(secret))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// newTransferID returns a random identifier for correlating log lines of a transfer
+func newTransferID() string {
+	bs := make([]byte, 8)
+	if _, err := rand.Read(bs); err != nil {
+		// crypto/rand doesn't fail on supported platforms
+		panic(err)
+	}
+	return hex.EncodeToString(bs)
+}
@@ -0,0 +1,36 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	secret := "abc123"
+	first := redact(secret)
+	if strings.Contains(first, secret) {
+		t.Fatalf("secret not redacted: %v", first)
+	}
+	if second := redact(secret); first != second {
+		t.Fatalf("redaction not stable: %v, %v", first, second)
+	}
+	if other := redact("xyz789"); first == other {
+		t.Fatalf("different secrets redacted the same: %v", first)
+	}
+
+	// an unkeyed hash of every short code would reveal it
+	h := sha256.Sum256([]byte(secret))
+	if strings.Contains(first, hex.EncodeToString(h[:4])) {
+		t.Fatalf("secret redacted with an unkeyed hash: %v", first)
+	}
+}
+
+func TestNewTransferID(t *testing.T) {
+	first := newTransferID()
+	second := newTransferID()
+	if first == second {
+		t.Fatal("transfer ids match, but shouldn't:", first, second)
+	}
+}
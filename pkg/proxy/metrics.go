@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// Stats are counters describing the work of a Service
+type Stats struct {
+	// Waiting transfers have a sender waiting for a receiver
+	Waiting int
+
+	// Active transfers are relaying bytes
+	Active int
+
+	// Completed transfers have ended, successfully or not
+	Completed int64
+
+	// BytesRelayed from senders to receivers, and both ways between the peers of sessions, including by active transfers
+	BytesRelayed int64
+
+	// BufferBytes is the memory of the buffers currently relaying bytes
+	BufferBytes int64
+}
+
+// Stats returns a snapshot of the Service counters
+func (r *Service) Stats() Stats {
+	result := make(chan Stats)
+	r.action <- func() {
+		s := Stats{
+			Completed:    r.completed,
+			BytesRelayed: r.relayed,
+			BufferBytes:  r.buffers.inUse(),
+		}
+		for _, t := range r.transfers {
+			switch t.state {
+			case StateWaiting:
+				s.Waiting++
+			case StateActive:
+				s.Active++
+			}
+			s.BytesRelayed += atomic.LoadInt64(&t.bytes)
+		}
+		result <- s
+	}
+	return <-result
+}
+
+// NewMetricsHandler returns an HTTP handler serving Service stats in the Prometheus text format
+func NewMetricsHandler(s *Service) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		stats := s.Stats()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(w, "# HELP relay_transfers Transfers in the relay by state.\n")
+		fmt.Fprintf(w, "# TYPE relay_transfers gauge\n")
+		fmt.Fprintf(w, "relay_transfers{state=\"%v\"} %v\n", StateWaiting, stats.Waiting)
+		fmt.Fprintf(w, "relay_transfers{state=\"%v\"} %v\n", StateActive, stats.Active)
+		fmt.Fprintf(w, "# HELP relay_transfers_completed_total Transfers that have ended.\n")
+		fmt.Fprintf(w, "# TYPE relay_transfers_completed_total counter\n")
+		fmt.Fprintf(w, "relay_transfers_completed_total %v\n", stats.Completed)
+		fmt.Fprintf(w, "# HELP relay_bytes_relayed_total Bytes relayed from senders to receivers, and both ways for sessions.\n")
+		fmt.Fprintf(w, "# TYPE relay_bytes_relayed_total counter\n")
+		fmt.Fprintf(w, "relay_bytes_relayed_total %v\n", stats.BytesRelayed)
+		fmt.Fprintf(w, "# HELP relay_buffer_bytes Memory of the buffers relaying bytes.\n")
+		fmt.Fprintf(w, "# TYPE relay_buffer_bytes gauge\n")
+		fmt.Fprintf(w, "relay_buffer_bytes %v\n", stats.BufferBytes)
+	})
+}
@@ -0,0 +1,73 @@
+package proxy
+
+import (
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	s := waitingService(t, "abc")
+
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	NewMetricsHandler(s).ServeHTTP(w, req)
+
+	body := w.Body.String()
+	for _, want := range []string{
+		`relay_transfers{state="waiting"} 1`,
+		`relay_transfers{state="active"} 0`,
+		`relay_transfers_completed_total 0`,
+		`relay_buffer_bytes 0`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("want %v in:\n%v", want, body)
+		}
+	}
+}
+
+func TestService_BytesRelayed(t *testing.T) {
+	service := New(NewFixedSecret("abc123"), log.NewNopLogger())
+	go service.Run()
+	tr := startRelayFor(t, service)
+
+	body := "the quick brown fox"
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   "fox.txt",
+		Length: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	recv, err := dialService(t, tr).Recv(send.Secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if _, err := io.Copy(io.Discard, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+
+	// the name, length and body frames from the sender, and not the receiver's reply accepting the file
+	want := int64(2+len("fox.txt")) + 9 + int64(9+len(body))
+	deadline := time.Now().Add(time.Second)
+	for service.Stats().BytesRelayed != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %v bytes relayed, got %v", want, service.Stats().BytesRelayed)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	// and nothing more once the relay has counted the whole body
+	time.Sleep(10 * time.Millisecond)
+	if got := service.Stats().BytesRelayed; got != want {
+		t.Fatalf("want %v bytes relayed, got %v", want, got)
+	}
+}
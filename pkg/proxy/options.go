@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"github.com/go-kit/log/level"
+	"io"
+	"time"
+)
+
+// Options are settings of a Service that can be changed while it is running
+type Options struct {
+	// MaxTransfers limits the number of waiting and active transfers, zero is unlimited
+	MaxTransfers int
+
+	// HandshakeTimeout limits how long a client has to onboard, zero is unlimited
+	HandshakeTimeout time.Duration
+
+	// WaitTimeout limits how long a transfer waits for its other side to join, zero is unlimited
+	WaitTimeout time.Duration
+
+	// AllowCustomCodes lets senders choose their own codes instead of a generated secret
+	AllowCustomCodes bool
+
+	// SlowReceiverTimeout is how long a broadcast waits for a receiver that has fallen too
+	// far behind before dropping it, zero drops the receiver immediately
+	SlowReceiverTimeout time.Duration
+
+	// Store keeps uploads for receivers to fetch after the sender has gone, nil disables uploads
+	Store *Store
+
+	// Cluster shares transfers with other relays, nil runs the relay alone
+	Cluster *Cluster
+
+	// BufferSize of the buffers relaying bytes between connections that can't be spliced,
+	// DefaultBufferSize if zero. Transfers that have started keep the size they started with.
+	BufferSize int
+}
+
+// Configure replaces the options of the Service.
+// New options apply to clients that onboard afterwards.
+func (r *Service) Configure(o Options) {
+	r.action <- func() {
+		r.opts = o
+		r.buffers.setSize(o.bufferSize())
+	}
+}
+
+// options returns the current options
+func (r *Service) options() Options {
+	result := make(chan Options)
+	r.action <- func() {
+		result <- r.opts
+	}
+	return <-result
+}
+
+// deadliner is a connection supporting deadlines, such as a net.Conn
+type deadliner interface {
+	SetDeadline(t time.Time) error
+}
+
+// setDeadline sets a deadline on the connection if it supports deadlines.
+// A zero timeout clears the deadline.
+func setDeadline(conn io.ReadWriteCloser, timeout time.Duration) {
+	d, ok := conn.(deadliner)
+	if !ok {
+		return
+	}
+	if timeout == 0 {
+		_ = d.SetDeadline(time.Time{})
+		return
+	}
+	_ = d.SetDeadline(time.Now().Add(timeout))
+}
+
+// expire removes a transfer still waiting for a receiver
+func (r *Service) expire(t *transfer) {
+	r.action <- func() {
+		if r.transfers[t.secret] != t || t.state != StateWaiting {
+			return
+		}
+		level.Info(r.logger).Log("msg", "expiring", "transfer", t.id)
+		r.teardown(t)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOptions_WaitTimeout(t *testing.T) {
+	s := waitingService(t, "abc")
+	s.Configure(Options{WaitTimeout: time.Millisecond})
+
+	// only transfers joining after Configure expire
+	if n := len(s.Transfers()); n != 1 {
+		t.Fatalf("want 1 transfer, got %v", n)
+	}
+
+	s.Kill("abc")
+	tr := startRelayFor(t, s)
+	joinSender(t, tr, "abc")
+
+	for i := 0; i < 100; i++ {
+		if len(s.Transfers()) == 0 {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("waiting transfer never expired")
+}
+
+func TestOptions_MaxTransfers(t *testing.T) {
+	s := waitingService(t, "abc")
+	s.Configure(Options{MaxTransfers: 1})
+
+	tr := startRelayFor(t, s)
+	conn := dialConn(t, tr)
+	if _, err := conn.Write([]byte{'b', 'S'}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	// second sender is given a secret, but then disconnected
+	bs := make([]byte, 64)
+	for {
+		if _, err := conn.Read(bs); err != nil {
+			break
+		}
+	}
+	if n := len(s.Transfers()); n != 1 {
+		t.Fatalf("want 1 transfer, got %v", n)
+	}
+}
@@ -5,6 +5,31 @@ import (
 	"sync"
 )
 
+const (
+	// MinCodeLength is the shortest code a sender can choose
+	MinCodeLength = 6
+
+	// MaxCodeLength is the longest code a sender can choose
+	MaxCodeLength = 64
+)
+
+// validCode checks a code chosen by a sender is of a reasonable length, and only
+// contains lower case letters, digits and inner hyphens, so it is easy to read out over the phone.
+func validCode(code string) bool {
+	if len(code) < MinCodeLength || len(code) > MaxCodeLength {
+		return false
+	}
+	if code[0] == '-' || code[len(code)-1] == '-' {
+		return false
+	}
+	for _, c := range code {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
 // Secrets is a source of secret values
 type Secrets interface {
 	Secret() string
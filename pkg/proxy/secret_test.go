@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"strings"
 	"testing"
 )
 
@@ -21,3 +22,29 @@ func TestNewRandomSecrets(t *testing.T) {
 		t.Fatal("secrets match, but shouldn't:", first, second)
 	}
 }
+
+func TestValidCode(t *testing.T) {
+	tests := []struct {
+		code  string
+		valid bool
+	}{
+		{"deploy-artifacts-42", true},
+		{"abc123", true},
+		{"abc12", false},
+		{"Deploy-artifacts", false},
+		{"-deploy", false},
+		{"deploy-", false},
+		{"deploy artifacts", false},
+		{"deploy_artifacts", false},
+		{strings.Repeat("a", MaxCodeLength), true},
+		{strings.Repeat("a", MaxCodeLength+1), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.code, func(t *testing.T) {
+			if got := validCode(tt.code); got != tt.valid {
+				t.Fatalf("want %v, got %v", tt.valid, got)
+			}
+		})
+	}
+}
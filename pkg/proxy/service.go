@@ -1,10 +1,27 @@
 package proxy
 
 import (
+	"errors"
+	"fmt"
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 	"go-storj-solution/pkg/client"
 	"go-storj-solution/pkg/wire"
 	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// State of a transfer
+type State string
+
+const (
+	// StateWaiting is a transfer with a sender waiting for a receiver
+	StateWaiting State = "waiting"
+
+	// StateActive is a transfer relaying bytes from sender to receiver
+	StateActive State = "active"
 )
 
 // Service manages transfers between senders and receivers.
@@ -16,10 +33,23 @@ type Service struct {
 	// updated serially by functions processed from 'action' channel.
 	transfers map[string]*transfer
 
+	// reserved secrets of transfers being created, and of ended transfers being unregistered from the cluster
+	reserved map[string]struct{}
+
 	// action to add or remove transfers.
 	// `Service` is effectively an actor.
 	action chan func()
 
+	// opts are changed by Configure
+	opts Options
+
+	// completed transfers and the bytes they relayed
+	completed int64
+	relayed   int64
+
+	// buffers for relaying, shared by every transfer
+	buffers *bufferPool
+
 	logger log.Logger
 }
 
@@ -27,7 +57,9 @@ func New(secrets Secrets, logger log.Logger) *Service {
 	return &Service{
 		secrets:   secrets,
 		transfers: make(map[string]*transfer),
+		reserved:  make(map[string]struct{}),
 		action:    make(chan func()),
+		buffers:   newBufferPool(DefaultBufferSize),
 		logger:    logger,
 	}
 }
@@ -42,20 +74,32 @@ func (r *Service) Run() {
 }
 
 // Onboard adds a sender or receiver to the Service proxy.
-// For a sender a Secret will be generated and sent to the sender.
+// For a sender a Secret will be generated and sent to the sender, unless
+// the sender chose its own code, in which case the code's status is sent instead.
+// A broadcaster is sent both the status of its code and the secret.
 // For a receiver a Secret will be read from the connection.
 // A valid client then joins a transfer, either creating it for a sender
 // or being associated with an existing transform for a receiver.
 // The Service takes ownership of an onboarded connection and will be responsible for closing it.
 // Expected to be called from a go routine.
 func (r *Service) Onboard(conn io.ReadWriteCloser) {
+	opts := r.options()
+	setDeadline(conn, opts.HandshakeTimeout)
+
 	dec := wire.NewDecoder(conn)
+	enc := wire.NewEncoder(conn)
 
 	var side client.Side
+	var direct bool
 	{
 		b, err := dec.DecodeByte()
+		if err == nil && client.Side(b) == client.MsgDirect {
+			// the client can connect directly to its peer, and the usual side follows
+			direct = true
+			b, err = dec.DecodeByte()
+		}
 		if err != nil {
-			r.logger.Log("msg", "failed reading first byte", "err", err)
+			level.Warn(r.logger).Log("msg", "failed reading first byte", "err", err)
 			_ = conn.Close()
 			return
 		}
@@ -63,101 +107,505 @@ func (r *Service) Onboard(conn io.ReadWriteCloser) {
 		side = client.Side(b)
 	}
 
-	r.logger.Log("msg", "onboarding", "side", side)
+	level.Debug(r.logger).Log("msg", "onboarding", "side", side, "direct", direct)
+
+	ts := transferSide{
+		conn:   conn,
+		side:   side,
+		addr:   remoteAddr(conn),
+		direct: direct,
+	}
 
-	var secret string
+	if direct && !side.Direct() {
+		level.Warn(r.logger).Log("msg", "client side can't connect directly", "side", side)
+		_ = conn.Close()
+		return
+	}
 
 	switch side {
-	case client.MsgSend:
-		// Onboarding a sender so generate and send secret for this transfer
-		secret = r.secrets.Secret()
-		if err := wire.NewEncoder(conn).EncodeString(secret); err != nil {
-			r.logger.Log("msg", "failed sending secret", "err", err)
+	case client.MsgSend, client.MsgRecvRequest, client.MsgSessionOpen:
+		// Onboarding a sender, a receiver requesting a file, or a peer opening a session,
+		// so generate a secret for this transfer
+		ts.secret = r.secrets.Secret()
+	case client.MsgSendCode, client.MsgRecv, client.MsgSendTo, client.MsgSessionJoin:
+		// Onboarding a receiver, a sender with its own code, a sender pushing to a
+		// requesting receiver, or a peer joining a session, so read the secret for the transfer
+		var err error
+		if ts.secret, err = dec.DecodeString(); err != nil {
+			level.Warn(r.logger).Log("msg", "failed receiving secret", "err", err)
 			_ = conn.Close()
 			return
 		}
-	case client.MsgRecv:
-		// Onboarding a receiver so read the secret for the transfer
-		var err error
-		if secret, err = dec.DecodeString(); err != nil {
-			r.logger.Log("msg", "failed receiving secret", "err", err)
+		ts.custom = side == client.MsgSendCode
+	case client.MsgBroadcast:
+		// Onboarding a broadcaster, which declares its receivers and optionally its own code
+		if err := ts.decodeBroadcast(dec); err != nil {
+			level.Warn(r.logger).Log("msg", "failed receiving broadcast", "err", err)
 			_ = conn.Close()
 			return
 		}
+		if !ts.custom {
+			ts.secret = r.secrets.Secret()
+		}
+	case client.MsgStream:
+		// Onboarding a stream of a parallel transfer, which declares its role and index
+		if err := ts.decodeStream(dec); err != nil {
+			level.Warn(r.logger).Log("msg", "failed receiving stream", "err", err)
+			_ = conn.Close()
+			return
+		}
+	case client.MsgStore:
+		// Onboarding an upload, which doesn't join a transfer
+		r.onboardStore(conn, enc, dec, opts.Store)
+		return
 	default:
-		r.logger.Log("msg", "invalid client side", "side", side)
+		level.Warn(r.logger).Log("msg", "invalid client side", "side", side)
 		_ = conn.Close()
 		return
 	}
 
-	ts := transferSide{
-		conn:   conn,
-		side:   side,
-		secret: secret,
+	t, err := r.join(ts)
+
+	// generated secrets may collide with chosen codes, so try a few more
+	for attempt := 1; !ts.custom && errors.Is(err, errDuplicateSecret) && attempt < 3; attempt++ {
+		ts.secret = r.secrets.Secret()
+		t, err = r.join(ts)
+	}
+
+	var codeErr *client.CodeError
+	switch {
+	case errors.As(err, &codeErr):
+		// tell the sender why their code was rejected
+		_ = enc.EncodeByte(byte(codeErr.Status))
+		_ = conn.Close()
+		return
+	case errors.Is(err, errStored):
+		// the receiver is fetching an upload instead
+		r.fetch(ts, enc, dec, opts.Store)
+		return
+	case errors.Is(err, errUnknownSecret) && opts.Cluster != nil:
+		// the transfer may be on another relay of the cluster
+		r.forward(ts, opts.Cluster, opts.HandshakeTimeout)
+		return
+	case err != nil:
+		_ = conn.Close()
+		return
+	}
+
+	if side == client.MsgRecv || side == client.MsgSendTo || side == client.MsgSessionJoin || side == client.MsgStream {
+		// handshake is over, so clear any deadline
+		setDeadline(conn, 0)
+		return
+	}
+
+	// the transfer waits for this reply to reach the initiator before relaying
+	defer close(t.ready)
+	switch side {
+	case client.MsgSend, client.MsgRecvRequest, client.MsgSessionOpen:
+		err = enc.EncodeString(ts.secret)
+	case client.MsgSendCode:
+		err = enc.EncodeByte(byte(client.CodeAccepted))
+	case client.MsgBroadcast:
+		if err = enc.EncodeByte(byte(client.CodeAccepted)); err == nil {
+			err = enc.EncodeString(ts.secret)
+		}
+	}
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed sending secret", "transfer", t.id, "err", err)
+		r.close(t)
+		return
 	}
-	r.join(ts)
+
+	// handshake is over, so clear any deadline
+	setDeadline(conn, 0)
 }
 
+var (
+	errDuplicateSecret  = errors.New("duplicate secret")
+	errTooManyTransfers = errors.New("too many transfers")
+	errUnknownSecret    = errors.New("unknown secret")
+	errHasReceiver      = errors.New("transfer already has a receiver")
+	errHasSender        = errors.New("transfer already has a sender")
+	errHasStream        = errors.New("transfer already has the stream")
+	errInvalidSide      = errors.New("invalid client side")
+	errStored           = errors.New("secret is for a stored upload")
+)
+
 // Joins a new side of the transfer, either starting a new client for a sender or
 // connecting a receiver to an existing client.
-// If a receiver has an unknown Secret, then their connection is closed.
-func (r *Service) join(ts transferSide) {
-	r.action <- func() {
-		switch ts.side {
-		case client.MsgSend:
-			r.logger.Log("msg", "joining", "side", ts.side, "secret", ts.secret)
-			if _, ok := r.transfers[ts.secret]; ok {
-				// should be very unlikely as the Service server generates Secrets!
-				r.logger.Log("msg", "duplicate secret", "secret", ts.secret)
-				_ = ts.conn.Close()
-				return
-			}
-			r.transfers[ts.secret] = &transfer{secret: ts.secret, send: ts.conn}
-		case client.MsgRecv:
-			r.logger.Log("msg", "joining", "side", ts.side, "secret", ts.secret)
-			if _, ok := r.transfers[ts.secret]; !ok {
-				r.logger.Log("msg", "receiver provided unknown secret", "secret", ts.secret)
-				_ = ts.conn.Close()
+// Returns an error if the side can't join, such as when a receiver has an unknown Secret,
+// and closing the connection is left to the caller.
+func (r *Service) join(ts transferSide) (*transfer, error) {
+	type result struct {
+		t   *transfer
+		err error
+	}
+	results := make(chan result, 1)
+	switch ts.side {
+	case client.MsgSend, client.MsgSendCode, client.MsgBroadcast, client.MsgRecvRequest, client.MsgSessionOpen:
+		// the secret is reserved while it is registered in the cluster, outside an action as the directory may be slow
+		var c *Cluster
+		reserved := make(chan error, 1)
+		r.action <- func() {
+			c = r.opts.Cluster
+			reserved <- r.reserveSecret(ts)
+		}
+		if err := <-reserved; err != nil {
+			return nil, err
+		}
+		err := r.register(c, ts)
+		r.action <- func() {
+			delete(r.reserved, ts.secret)
+			if err != nil {
+				results <- result{err: err}
 				return
 			}
-			t := r.transfers[ts.secret]
-			t.recv = ts.conn
+			results <- result{t: r.create(ts)}
+		}
+	default:
+		r.action <- func() {
+			t, err := r.joinAction(ts)
+			results <- result{t: t, err: err}
+		}
+	}
+	res := <-results
+	return res.t, res.err
+}
+
+// reserveSecret checks a new transfer can be created for a side, and reserves its secret until the transfer is.
+// Must be called from an action.
+func (r *Service) reserveSecret(ts transferSide) error {
+	if ts.custom {
+		if !r.opts.AllowCustomCodes {
+			level.Warn(r.logger).Log("msg", "custom codes are forbidden", "addr", ts.addr)
+			return &client.CodeError{Code: ts.secret, Status: client.CodeForbidden}
+		}
+		if !validCode(ts.secret) {
+			level.Warn(r.logger).Log("msg", "invalid custom code", "addr", ts.addr)
+			return &client.CodeError{Code: ts.secret, Status: client.CodeInvalid}
+		}
+	}
+	if r.taken(ts.secret) || r.opts.Store.has(ts.secret) {
+		if ts.custom {
+			level.Warn(r.logger).Log("msg", "custom code taken", "secret", redact(ts.secret), "addr", ts.addr)
+			return &client.CodeError{Code: ts.secret, Status: client.CodeTaken}
+		}
+		// should be very unlikely as the Service server generates Secrets!
+		level.Error(r.logger).Log("msg", "duplicate secret", "secret", redact(ts.secret))
+		return errDuplicateSecret
+	}
+	if r.opts.MaxTransfers > 0 && len(r.transfers)+len(r.reserved) >= r.opts.MaxTransfers {
+		level.Warn(r.logger).Log("msg", "too many transfers", "max", r.opts.MaxTransfers, "addr", ts.addr)
+		return errTooManyTransfers
+	}
+	r.reserved[ts.secret] = struct{}{}
+	return nil
+}
+
+// taken is true if a transfer has the secret, or it is reserved for one. Must be called from an action.
+func (r *Service) taken(secret string) bool {
+	_, ok := r.transfers[secret]
+	_, reserved := r.reserved[secret]
+	return ok || reserved
+}
+
+// create the transfer for a new side, once its secret is registered. Must be called from an action.
+func (r *Service) create(ts transferSide) *transfer {
+	t := &transfer{
+		id:       newTransferID(),
+		secret:   ts.secret,
+		send:     ts.conn,
+		sendAddr: ts.addr,
+		direct:   ts.direct,
+		want:     1,
+		created:  time.Now(),
+		state:    StateWaiting,
+		ready:    make(chan struct{}),
+	}
+	switch ts.side {
+	case client.MsgRecvRequest:
+		// the receiver is waiting for a sender instead
+		t.requested = true
+		t.send = nil
+		t.sendAddr = ""
+		t.recvs = []receiver{{conn: ts.conn, addr: ts.addr, direct: ts.direct}}
+		t.direct = false
+	case client.MsgSessionOpen:
+		t.session = true
+	case client.MsgBroadcast:
+		t.want = ts.receivers
+		t.window = ts.window
+		if t.want == 0 {
+			// without a count receivers join until the window closes
+			t.want = maxReceivers
+		}
+	}
+	r.transfers[ts.secret] = t
+	if r.opts.WaitTimeout > 0 {
+		t.expiry = time.AfterFunc(r.opts.WaitTimeout, func() { r.expire(t) })
+	}
+	level.Info(r.logger).Log(
+		"msg", "joining",
+		"side", ts.side,
+		"transfer", t.id,
+		"secret", redact(ts.secret),
+		"addr", ts.addr,
+	)
+	return t
+}
+
+// joinAction updates transfers for a side joining an existing transfer. Must be called from an action.
+func (r *Service) joinAction(ts transferSide) (*transfer, error) {
+	switch ts.side {
+	case client.MsgRecv:
+		t, ok := r.transfers[ts.secret]
+		if !ok && r.opts.Store.has(ts.secret) {
+			return nil, errStored
+		}
+		if !ok || t.requested || t.session {
+			level.Warn(r.logger).Log("msg", "receiver provided unknown secret", "secret", redact(ts.secret), "addr", ts.addr)
+			return nil, errUnknownSecret
+		}
+		if t.state != StateWaiting || len(t.recvs) >= t.want {
+			level.Warn(r.logger).Log("msg", "transfer already has its receivers", "transfer", t.id, "addr", ts.addr)
+			return nil, errHasReceiver
+		}
+		t.recvs = append(t.recvs, receiver{conn: ts.conn, addr: ts.addr, direct: ts.direct})
+		level.Info(r.logger).Log("msg", "joining", "side", ts.side, "transfer", t.id, "addr", ts.addr)
+
+		switch {
+		case len(t.recvs) == t.want:
+			r.start(t)
+		case len(t.recvs) == 1 && t.window > 0:
+			// other receivers have until the window closes to join
+			time.AfterFunc(t.window, func() { r.startWindow(t) })
+		}
+		return t, nil
+	case client.MsgSendTo:
+		t, ok := r.transfers[ts.secret]
+		if !ok || !t.requested {
+			level.Warn(r.logger).Log("msg", "sender provided unknown secret", "secret", redact(ts.secret), "addr", ts.addr)
+			return nil, errUnknownSecret
+		}
+		if t.send != nil {
+			level.Warn(r.logger).Log("msg", "transfer already has a sender", "transfer", t.id, "addr", ts.addr)
+			return nil, errHasSender
+		}
+		t.send = ts.conn
+		t.sendAddr = ts.addr
+		t.direct = ts.direct
+		level.Info(r.logger).Log("msg", "joining", "side", ts.side, "transfer", t.id, "addr", ts.addr)
+		r.start(t)
+		return t, nil
+	case client.MsgSessionJoin:
+		t, ok := r.transfers[ts.secret]
+		if !ok || !t.session {
+			level.Warn(r.logger).Log("msg", "peer provided unknown secret", "secret", redact(ts.secret), "addr", ts.addr)
+			return nil, errUnknownSecret
+		}
+		if t.state != StateWaiting || len(t.recvs) > 0 {
+			level.Warn(r.logger).Log("msg", "session already has a peer", "transfer", t.id, "addr", ts.addr)
+			return nil, errHasReceiver
+		}
+		t.recvs = []receiver{{conn: ts.conn, addr: ts.addr}}
+		level.Info(r.logger).Log("msg", "joining", "side", ts.side, "transfer", t.id, "addr", ts.addr)
+		r.start(t)
+		return t, nil
+	case client.MsgStream:
+		return r.joinStream(ts)
+	default:
+		level.Error(r.logger).Log("msg", "failed join because client side is invalid", "side", ts.side)
+		return nil, errInvalidSide
+	}
+}
+
+// start relaying to the receivers that have joined. Must be called from an action.
+func (r *Service) start(t *transfer) {
+	t.state = StateActive
+	t.slowTimeout = r.opts.SlowReceiverTimeout
+	if t.expiry != nil {
+		t.expiry.Stop()
+	}
+	level.Info(r.logger).Log("msg", "starting", "transfer", t.id, "receivers", len(t.recvs))
 
-			// sender and receiver are connected so now start relaying traffic
-			go t.run(r)
-		default:
-			r.logger.Log("msg", "failed join because client side is invalid", "side", ts.side)
-			_ = ts.conn.Close()
+	// sender and receivers are connected so now start relaying traffic
+	go t.run(r)
+}
+
+// startWindow starts a broadcast when its window closes, if it hasn't already started
+func (r *Service) startWindow(t *transfer) {
+	r.action <- func() {
+		if r.transfers[t.secret] == t && t.state == StateWaiting && len(t.recvs) > 0 {
+			r.start(t)
 		}
 	}
 }
 
 // cleans up after ending a transfer for any reason
-func (r *Service) close(secret string) {
+func (r *Service) close(t *transfer) {
 	r.action <- func() {
-		r.logger.Log("msg", "closing", "secret", secret)
-		defer delete(r.transfers, secret)
-		if t, ok := r.transfers[secret]; ok {
-			if t.send != nil {
-				_ = t.send.Close()
-			}
-			if t.recv != nil {
-				_ = t.recv.Close()
-			}
+		r.teardown(t)
+	}
+}
+
+// teardown closes every connection of a transfer, counts it as completed and removes it, once however it ends.
+// Must be called from an action.
+func (r *Service) teardown(t *transfer) {
+	if t.closed {
+		return
+	}
+	t.closed = true
+	level.Info(r.logger).Log(
+		"msg", "closing",
+		"transfer", t.id,
+		"bytes", atomic.LoadInt64(&t.bytes),
+		"buffer_peak", atomic.LoadInt64(&t.memory.peak),
+	)
+	if t.expiry != nil {
+		t.expiry.Stop()
+	}
+	if t.send != nil {
+		_ = t.send.Close()
+	}
+	for _, recv := range t.recvs {
+		_ = recv.conn.Close()
+	}
+	for _, s := range t.streams {
+		s.close()
+	}
+	r.completed++
+	r.relayed += atomic.LoadInt64(&t.bytes)
+	if r.transfers[t.secret] == t {
+		delete(r.transfers, t.secret)
+		r.unregister(t.secret)
+	}
+}
+
+// Transfers returns a snapshot of the waiting and active transfers.
+func (r *Service) Transfers() []TransferInfo {
+	result := make(chan []TransferInfo)
+	r.action <- func() {
+		infos := make([]TransferInfo, 0, len(r.transfers))
+		for _, t := range r.transfers {
+			infos = append(infos, t.info())
 		}
+		result <- infos
 	}
+	return <-result
+}
+
+// Kill forcibly terminates a transfer by closing the connections of both sides.
+// Returns false if there is no transfer for the secret.
+func (r *Service) Kill(secret string) bool {
+	result := make(chan bool)
+	r.action <- func() {
+		t, ok := r.transfers[secret]
+		if ok {
+			level.Info(r.logger).Log("msg", "killing", "transfer", t.id)
+			r.teardown(t)
+		}
+		result <- ok
+	}
+	return <-result
+}
+
+// TransferInfo describes a transfer for inspection
+type TransferInfo struct {
+	ID            string    `json:"id"`
+	Secret        string    `json:"secret"`
+	State         State     `json:"state"`
+	Requested     bool      `json:"requested,omitempty"`
+	Session       bool      `json:"session,omitempty"`
+	Created       time.Time `json:"created"`
+	AgeSeconds    float64   `json:"age_seconds"`
+	Bytes         int64     `json:"bytes"`
+	BufferBytes   int64     `json:"buffer_bytes"`
+	Streams       int       `json:"streams,omitempty"`
+	SenderAddr    string    `json:"sender_addr,omitempty"`
+	ReceiverAddrs []string  `json:"receiver_addrs,omitempty"`
 }
 
 // transfer an ongoing transfer between sender and receiver
 type transfer struct {
+	// id identifies the transfer in logs, so the secret doesn't need to be logged
+	id string
+
 	// secret is a unique key for transfer
 	secret string
 
 	// send is connection from the sender
 	send io.ReadWriteCloser
 
-	// recv is the connection to the receiver
-	recv io.ReadWriteCloser
+	// recvs are the receivers that have joined
+	recvs []receiver
+
+	// requested is set when a receiver started the transfer, and is waiting for a sender
+	requested bool
+
+	// session is set for a two-way session, where the one receiver is a peer relaying back to the sender
+	session bool
+
+	// direct is set when the sender can connect directly to a receiver
+	direct bool
+
+	// want is the number of receivers to wait for
+	want int
+
+	// window after the first receiver joins for others to join, zero waits for all receivers
+	window time.Duration
+
+	// slowTimeout is how long to wait for a broadcast receiver that has fallen behind
+	slowTimeout time.Duration
+
+	// remote address of the sender, if known
+	sendAddr string
+
+	// created is when the sender joined
+	created time.Time
+
+	// state of the transfer
+	state State
+
+	// ready is closed once the sender has been sent its secret
+	ready chan struct{}
+
+	// closed is set when the transfer has been cleaned up
+	closed bool
+
+	// expiry removes the transfer if a receiver doesn't join in time
+	expiry *time.Timer
+
+	// bytes relayed from sender to receiver, and back for a session.
+	// updated atomically by the relaying go routines.
+	bytes int64
+
+	// memory of the buffers used to relay
+	memory bufferUse
+
+	// streams of a parallel transfer, by index
+	streams map[int]*stream
+}
+
+// info describes the transfer. Must be called from an action.
+func (t *transfer) info() TransferInfo {
+	var addrs []string
+	for _, recv := range t.recvs {
+		addrs = append(addrs, recv.addr)
+	}
+	return TransferInfo{
+		ID:            t.id,
+		Secret:        t.secret,
+		State:         t.state,
+		Requested:     t.requested,
+		Session:       t.session,
+		Created:       t.created,
+		AgeSeconds:    time.Since(t.created).Seconds(),
+		Bytes:         atomic.LoadInt64(&t.bytes),
+		BufferBytes:   atomic.LoadInt64(&t.memory.current),
+		Streams:       len(t.streams),
+		SenderAddr:    t.sendAddr,
+		ReceiverAddrs: addrs,
+	}
 }
 
 // transferSide a client side of a transfer
@@ -170,30 +618,180 @@ type transferSide struct {
 
 	// secret identifies transfer
 	secret string
+
+	// addr is the remote address of the client, if known
+	addr string
+
+	// custom is set when the sender chose the secret
+	custom bool
+
+	// receivers and window declared by a broadcaster
+	receivers int
+	window    time.Duration
+
+	// direct is set when the client can connect directly to its peer
+	direct bool
+
+	// role and index declared by a stream of a parallel transfer
+	role  client.Side
+	index int
+}
+
+// decodeBroadcast reads the receivers, window and optional code declared by a broadcaster
+func (ts *transferSide) decodeBroadcast(dec wire.Decoder) error {
+	b, err := dec.DecodeByte()
+	if err != nil {
+		return fmt.Errorf("receiving receivers: %w", err)
+	}
+	ts.receivers = int(b)
+
+	window, err := dec.DecodeString()
+	if err != nil {
+		return fmt.Errorf("receiving window: %w", err)
+	}
+	if window != "" {
+		if ts.window, err = time.ParseDuration(window); err != nil || ts.window < 0 {
+			return fmt.Errorf("bad window: %q", window)
+		}
+	}
+
+	if ts.secret, err = dec.DecodeString(); err != nil {
+		return fmt.Errorf("receiving code: %w", err)
+	}
+	ts.custom = ts.secret != ""
+
+	if ts.receivers == 0 && ts.window == 0 {
+		return errors.New("broadcast needs receivers or a window")
+	}
+	return nil
+}
+
+// receiver of a transfer
+type receiver struct {
+	conn io.ReadWriteCloser
+
+	// addr is the remote address of the receiver, if known
+	addr string
+
+	// direct is set when the receiver can connect directly to the sender
+	direct bool
+}
+
+// remoteAddr returns the remote address of a connection if it has one
+func remoteAddr(conn io.ReadWriteCloser) string {
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok && c.RemoteAddr() != nil {
+		return c.RemoteAddr().String()
+	}
+	return ""
+}
+
+// countingWriter counts bytes written to the underlying io.Writer
+type countingWriter struct {
+	io.Writer
+	n *int64
+}
+
+func (w countingWriter) Write(p []byte) (int, error) {
+	n, err := w.Writer.Write(p)
+	atomic.AddInt64(w.n, int64(n))
+	return n, err
 }
 
 // Copies bytes from sender to receiver
 func (t *transfer) run(r *Service) {
-	defer r.close(t.secret)
+	defer r.close(t)
+
+	<-t.ready
+
+	// peers that can connect directly are told whether to try, and the sender is told the
+	// receiver is ready with the same byte. Receivers that can't are told nothing, as before.
+	ready := client.MsgRecv
+	if t.direct && len(t.recvs) == 1 && t.recvs[0].direct {
+		ready = client.MsgDirect
+	}
+	for _, recv := range t.recvs {
+		if !recv.direct {
+			continue
+		}
+		if err := wire.NewEncoder(recv.conn).EncodeByte(byte(ready)); err != nil {
+			level.Warn(r.logger).Log(
+				"msg", "notifying receiver of sender failed",
+				"transfer", t.id,
+				"err", err,
+			)
+			return
+		}
+	}
+
+	if t.session {
+		// the peer that joined is blocked until it hears the session has started, whereas
+		// the peer that opened it may not be reading yet, so tell the joined peer first
+		if err := wire.NewEncoder(t.recvs[0].conn).EncodeByte(byte(client.MsgRecv)); err != nil {
+			level.Warn(r.logger).Log(
+				"msg", "notifying peer of session failed",
+				"transfer", t.id,
+				"err", err,
+			)
+			return
+		}
+	}
 
 	// Send "receiver is ready" message to sender so that the
 	// sender can start sending bytes.
 	enc := wire.NewEncoder(t.send)
-	if err := enc.EncodeByte(byte(client.MsgRecv)); err != nil {
-		r.logger.Log(
+	if err := enc.EncodeByte(byte(ready)); err != nil {
+		level.Warn(r.logger).Log(
 			"msg", "notifying sender of receiver failed",
-			"secret", t.secret,
+			"transfer", t.id,
 			"err", err,
 		)
 		return
 	}
 
-	// Now just pipe from sender to receiver
+	// Now just pipe between sender and receivers
 	// Note that the Service server doesn't care what messages are passed.
-	if _, err := io.Copy(t.recv, t.send); err != nil {
-		r.logger.Log(
-			"msg", "notifying sender of receiver failed",
-			"secret", t.secret,
+	if len(t.recvs) > 1 {
+		if err := t.fanout(r); err != nil {
+			level.Warn(r.logger).Log(
+				"msg", "broadcasting from sender to receivers failed",
+				"transfer", t.id,
+				"err", err,
+			)
+		}
+		return
+	}
+
+	// a single receiver replies to the sender, whether to accept the file, or the messages of a session,
+	// and peers trying to connect directly exchange addresses through the relay,
+	// carrying on through it if they can't connect
+	t.pipe(r)
+}
+
+// Copies bytes both ways between the sender and a single receiver, until either way ends.
+// Peers only close their connections once they are done in both directions,
+// so the other way is finished too, and closing the transfer ends its copy.
+func (t *transfer) pipe(r *Service) {
+	peer := t.recvs[0].conn
+	// replies from a receiver are only counted for a session, where both peers send
+	var replies int64
+	back := &replies
+	if t.session {
+		back = &t.bytes
+	}
+	errs := make(chan error, 2)
+	go func() {
+		_, err := relayCopy(peer, t.send, &t.bytes, r.buffers, &t.memory)
+		errs <- err
+	}()
+	go func() {
+		_, err := relayCopy(t.send, peer, back, r.buffers, &t.memory)
+		errs <- err
+	}()
+
+	if err := <-errs; err != nil {
+		level.Warn(r.logger).Log(
+			"msg", "relaying between peers failed",
+			"transfer", t.id,
 			"err", err,
 		)
 	}
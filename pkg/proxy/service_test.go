@@ -0,0 +1,343 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// startRelay runs a relay on an in-memory transport until the test ends
+func startRelay(t *testing.T, secrets Secrets) *transport.Memory {
+	t.Helper()
+	service := New(secrets, log.NewNopLogger())
+	go service.Run()
+	return startRelayFor(t, service)
+}
+
+// startRelayFor accepts connections for a running service on an in-memory transport
+func startRelayFor(t *testing.T, service *Service) *transport.Memory {
+	t.Helper()
+	tr := transport.NewMemory()
+	l, err := tr.Listen("relay")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go service.Onboard(conn)
+		}
+	}()
+	return tr
+}
+
+// dialConn connects to the relay
+func dialConn(t *testing.T, tr transport.Transport) net.Conn {
+	t.Helper()
+	conn, err := tr.Dial(context.Background(), "relay")
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// dialService connects a client service to the relay
+func dialService(t *testing.T, tr transport.Transport) client.Service {
+	t.Helper()
+	conn := dialConn(t, tr)
+	return client.NewService(wire.NewEncoder(conn), wire.NewDecoder(conn))
+}
+
+func TestService_EndToEnd(t *testing.T) {
+	tr := startRelay(t, NewFixedSecret("abc123"))
+
+	body := "the quick brown fox"
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   "fox.txt",
+		Length: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if send.Secret != "abc123" {
+		t.Fatalf("want abc123, got %v", send.Secret)
+	}
+
+	recv, err := dialService(t, tr).Recv(send.Secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Name != "fox.txt" {
+		t.Fatalf("want fox.txt, got %v", recv.Name)
+	}
+
+	b := &strings.Builder{}
+	if _, err := io.Copy(b, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if b.String() != body {
+		t.Fatalf("want %v, got %v", body, b.String())
+	}
+
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+}
+
+func TestService_UnknownSecret(t *testing.T) {
+	tr := startRelay(t, NewFixedSecret("abc123"))
+
+	if _, err := dialService(t, tr).Recv("nope"); err == nil {
+		t.Fatal("expected error receiving with unknown secret")
+	}
+}
+
+func TestService_CustomCodes(t *testing.T) {
+	service := New(NewRandomSecrets(6, 1), log.NewNopLogger())
+	go service.Run()
+	tr := startRelayFor(t, service)
+
+	sendCode := func(code string) (*client.SendResponse, error) {
+		return dialService(t, tr).Send(&client.SendRequest{
+			Body: strings.NewReader(""),
+			Name: "empty",
+			Code: code,
+		})
+	}
+
+	wantStatus := func(err error, status client.CodeStatus) {
+		t.Helper()
+		var codeErr *client.CodeError
+		if !errors.As(err, &codeErr) || codeErr.Status != status {
+			t.Fatalf("want %v, got %v", status, err)
+		}
+	}
+
+	// forbidden by default
+	_, err := sendCode("deploy-artifacts-42")
+	wantStatus(err, client.CodeForbidden)
+
+	service.Configure(Options{AllowCustomCodes: true})
+
+	_, err = sendCode("Not Valid!")
+	wantStatus(err, client.CodeInvalid)
+
+	send, err := sendCode("deploy-artifacts-42")
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if send.Secret != "deploy-artifacts-42" {
+		t.Fatalf("want deploy-artifacts-42, got %v", send.Secret)
+	}
+
+	_, err = sendCode("deploy-artifacts-42")
+	wantStatus(err, client.CodeTaken)
+
+	recv, err := dialService(t, tr).Recv("deploy-artifacts-42")
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Name != "empty" {
+		t.Fatalf("want empty, got %v", recv.Name)
+	}
+	// reading the body accepts the file
+	if _, err := io.ReadAll(recv.Body); err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+}
+
+func TestService_Request(t *testing.T) {
+	tr := startRelay(t, NewFixedSecret("abc123"))
+
+	request, err := dialService(t, tr).Request()
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	if request.Secret != "abc123" {
+		t.Fatalf("want abc123, got %v", request.Secret)
+	}
+
+	// a requested code is for pushing to, not receiving from
+	if _, err := dialService(t, tr).Recv(request.Secret); err == nil {
+		t.Fatal("expected error receiving with a requested code")
+	}
+
+	// pushing to an unknown code fails once the relay hangs up
+	unknown, err := dialService(t, tr).Send(&client.SendRequest{
+		Body: strings.NewReader(""),
+		Name: "empty",
+		To:   "nope",
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if err := <-unknown.Errors; err == nil {
+		t.Fatal("expected error pushing to an unknown code")
+	}
+
+	body := "the quick brown fox"
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   "fox.txt",
+		Length: int64(len(body)),
+		To:     request.Secret,
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if send.Secret != request.Secret {
+		t.Fatalf("want %v, got %v", request.Secret, send.Secret)
+	}
+
+	recv, err := request.Wait()
+	if err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if recv.Name != "fox.txt" {
+		t.Fatalf("want fox.txt, got %v", recv.Name)
+	}
+	b := &strings.Builder{}
+	if _, err := io.Copy(b, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if b.String() != body {
+		t.Fatalf("want %v, got %v", body, b.String())
+	}
+	if err := <-send.Errors; err != nil {
+		t.Fatalf("send errors: %v", err)
+	}
+}
+
+func TestService_Session(t *testing.T) {
+	tr := startRelay(t, NewFixedSecret("abc123"))
+
+	opener, err := dialService(t, tr).OpenSession()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if opener.Secret != "abc123" {
+		t.Fatalf("want abc123, got %v", opener.Secret)
+	}
+
+	// a session code is for joining, not receiving
+	if _, err := dialService(t, tr).Recv(opener.Secret); err == nil {
+		t.Fatal("expected error receiving with a session code")
+	}
+	if _, err := dialService(t, tr).JoinSession("nope"); err == nil {
+		t.Fatal("expected error joining with an unknown code")
+	}
+
+	joiner, err := dialService(t, tr).JoinSession(opener.Secret)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+
+	// exchange files both ways at once, then read what the other peer sent
+	exchange := func(s *client.Session, names ...string) <-chan []string {
+		result := make(chan []string, 1)
+		go func() {
+			for _, name := range names {
+				if err := s.Send(name, strings.NewReader(name), int64(len(name))); err != nil {
+					t.Errorf("send: %v", err)
+				}
+			}
+			if err := s.CloseSend(); err != nil {
+				t.Errorf("close send: %v", err)
+			}
+		}()
+		go func() {
+			var got []string
+			for {
+				recv, err := s.Recv()
+				if errors.Is(err, io.EOF) {
+					break
+				}
+				if err != nil {
+					t.Errorf("recv: %v", err)
+					break
+				}
+				b := &strings.Builder{}
+				if _, err := io.Copy(b, recv.Body); err != nil {
+					t.Errorf("copy: %v", err)
+				}
+				if b.String() != recv.Name {
+					t.Errorf("want %v, got %v", recv.Name, b.String())
+				}
+				got = append(got, recv.Name)
+			}
+			result <- got
+		}()
+		return result
+	}
+
+	fromJoiner := exchange(opener, "a.txt", "b.txt")
+	fromOpener := exchange(joiner, "c.txt")
+
+	if got := strings.Join(<-fromJoiner, ","); got != "c.txt" {
+		t.Fatalf("opener want c.txt, got %v", got)
+	}
+	if got := strings.Join(<-fromOpener, ","); got != "a.txt,b.txt" {
+		t.Fatalf("joiner want a.txt,b.txt, got %v", got)
+	}
+}
+
+func TestService_SessionReject(t *testing.T) {
+	tr := startRelay(t, NewFixedSecret("abc123"))
+
+	opener, err := dialService(t, tr).OpenSession()
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	joiner, err := dialService(t, tr).JoinSession(opener.Secret)
+	if err != nil {
+		t.Fatalf("join: %v", err)
+	}
+
+	go func() {
+		for _, name := range []string{"a.txt", "b.txt"} {
+			if err := opener.Send(name, strings.NewReader(name), int64(len(name))); err != nil {
+				t.Errorf("send: %v", err)
+			}
+		}
+		if err := opener.CloseSend(); err != nil {
+			t.Errorf("close send: %v", err)
+		}
+	}()
+
+	// a rejected file is skipped, and the session carries on
+	recv, err := joiner.Recv()
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if err := recv.Reject("not wanted"); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+	recv, err = joiner.Recv()
+	if err != nil {
+		t.Fatalf("recv after reject: %v", err)
+	}
+	bs, err := io.ReadAll(recv.Body)
+	if err != nil || recv.Name != "b.txt" || string(bs) != "b.txt" {
+		t.Fatalf("want b.txt, got %v with %s: %v", recv.Name, bs, err)
+	}
+	if _, err := joiner.Recv(); !errors.Is(err, io.EOF) {
+		t.Fatalf("want EOF, got %v", err)
+	}
+}
@@ -0,0 +1,494 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errTooLarge      = errors.New("upload is larger than allowed")
+	errQuotaExceeded = errors.New("store quota exceeded")
+)
+
+// StoreOptions limit what a Store keeps
+type StoreOptions struct {
+	// Quota is the total bytes of stored uploads, zero is unlimited
+	Quota int64
+
+	// MaxSize is the largest upload, zero is unlimited
+	MaxSize int64
+
+	// Retention is how long uploads are kept for a receiver to fetch, zero keeps them until fetched
+	Retention time.Duration
+}
+
+// Store spools uploads to a directory, so receivers can fetch them after the sender has gone.
+// Each upload is kept in a file named by a hash of its secret, next to a JSON file describing it,
+// so uploads survive the relay restarting while the secrets stay private.
+type Store struct {
+	dir  string
+	opts StoreOptions
+
+	// guards blobs and used
+	sync.Mutex
+
+	// blobs by key, including uploads in progress
+	blobs map[string]*blob
+
+	// used is the bytes of stored and reserved uploads
+	used int64
+
+	logger log.Logger
+}
+
+// blob is a stored upload
+type blob struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+
+	// stored is set once the upload is complete
+	stored bool
+
+	// fetching is set while a receiver is fetching the upload
+	fetching bool
+
+	// expiry removes the upload once its retention has passed
+	expiry *time.Timer
+}
+
+// NewStore opens a Store in dir, creating dir if needed and loading uploads kept from before.
+// Incomplete uploads, and uploads past their retention, are removed.
+func NewStore(dir string, opts StoreOptions, logger log.Logger) (*Store, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("creating store: %w", err)
+	}
+	s := &Store{
+		dir:    dir,
+		opts:   opts,
+		blobs:  make(map[string]*blob),
+		logger: logger,
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load the uploads already in the directory
+func (s *Store) load() error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return fmt.Errorf("reading store: %w", err)
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, ".part"):
+			// the relay stopped part way through an upload
+			_ = os.Remove(filepath.Join(s.dir, name))
+		case strings.HasSuffix(name, ".json"):
+			key := strings.TrimSuffix(name, ".json")
+			b, err := s.readMeta(key)
+			if err != nil {
+				level.Warn(s.logger).Log("msg", "removing unreadable stored upload", "key", key, "err", err)
+				s.removeFiles(key)
+				continue
+			}
+			b.stored = true
+			s.blobs[key] = b
+			s.used += b.Size
+			s.retain(key, b)
+		}
+	}
+	return nil
+}
+
+// readMeta reads the description of an upload, checking its file is complete
+func (s *Store) readMeta(key string) (*blob, error) {
+	bs, err := os.ReadFile(s.path(key, ".json"))
+	if err != nil {
+		return nil, err
+	}
+	var b blob
+	if err := json.Unmarshal(bs, &b); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(s.path(key, ".blob"))
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() != b.Size {
+		return nil, fmt.Errorf("want %v bytes, found %v", b.Size, info.Size())
+	}
+	return &b, nil
+}
+
+// storeKey names the files of an upload without revealing its secret
+func storeKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *Store) path(key string, ext string) string {
+	return filepath.Join(s.dir, key+ext)
+}
+
+// has checks if there is an upload for the secret, stored or in progress.
+// A nil Store has nothing.
+func (s *Store) has(secret string) bool {
+	if s == nil {
+		return false
+	}
+	defer s.Unlock()
+	s.Lock()
+	_, ok := s.blobs[storeKey(secret)]
+	return ok
+}
+
+// reserve room for an upload, before it is written
+func (s *Store) reserve(secret string, name string, size int64) error {
+	defer s.Unlock()
+	s.Lock()
+	key := storeKey(secret)
+	if _, ok := s.blobs[key]; ok {
+		return errDuplicateSecret
+	}
+	if s.opts.MaxSize > 0 && size > s.opts.MaxSize {
+		return errTooLarge
+	}
+	if s.opts.Quota > 0 && s.used+size > s.opts.Quota {
+		return errQuotaExceeded
+	}
+	s.blobs[key] = &blob{Name: name, Size: size, Created: time.Now()}
+	s.used += size
+	return nil
+}
+
+// write a reserved upload of exactly its reserved size to disk, copying it through buf.
+// The upload is only visible to receivers once it is complete, and is released if writing fails.
+func (s *Store) write(secret string, r io.Reader, buf []byte) error {
+	key := storeKey(secret)
+	s.Lock()
+	b := s.blobs[key]
+	s.Unlock()
+
+	if err := s.writeFiles(key, b, r, buf); err != nil {
+		s.removeFiles(key)
+		s.release(key, b)
+		return err
+	}
+
+	defer s.Unlock()
+	s.Lock()
+	b.stored = true
+	s.retain(key, b)
+	return nil
+}
+
+func (s *Store) writeFiles(key string, b *blob, r io.Reader, buf []byte) error {
+	part := s.path(key, ".part")
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating upload: %w", err)
+	}
+	// like io.CopyN, hiding the file's ReadFrom which would copy with a buffer of its own
+	n, err := io.CopyBuffer(writerOnly{f}, io.LimitReader(r, b.Size), buf)
+	if err == nil && n < b.Size {
+		err = io.EOF
+	}
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("writing upload: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("syncing upload: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("closing upload: %w", err)
+	}
+
+	meta, err := json.Marshal(b)
+	if err != nil {
+		return fmt.Errorf("encoding upload: %w", err)
+	}
+	if err := os.WriteFile(s.path(key, ".json"), meta, 0600); err != nil {
+		return fmt.Errorf("writing upload: %w", err)
+	}
+	if err := os.Rename(part, s.path(key, ".blob")); err != nil {
+		return fmt.Errorf("renaming upload: %w", err)
+	}
+	return nil
+}
+
+// retain schedules removing an upload once its retention has passed. Must hold the lock.
+func (s *Store) retain(key string, b *blob) {
+	if s.opts.Retention <= 0 {
+		return
+	}
+	b.expiry = time.AfterFunc(time.Until(b.Created.Add(s.opts.Retention)), func() {
+		level.Info(s.logger).Log("msg", "expiring stored upload", "key", key[:8])
+		s.remove(key)
+	})
+}
+
+// open a stored upload for a receiver, which must then either remove or release it.
+// Only one receiver can fetch an upload at a time.
+func (s *Store) open(secret string) (*blob, *os.File, error) {
+	key := storeKey(secret)
+	defer s.Unlock()
+	s.Lock()
+	b, ok := s.blobs[key]
+	if !ok || !b.stored || b.fetching {
+		return nil, nil, errUnknownSecret
+	}
+	f, err := os.Open(s.path(key, ".blob"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening upload: %w", err)
+	}
+	b.fetching = true
+	return b, f, nil
+}
+
+// fetched removes an upload once a receiver has it, or releases it for another try if fetching failed
+func (s *Store) fetched(secret string, ok bool) {
+	key := storeKey(secret)
+	if ok {
+		s.remove(key)
+		return
+	}
+	defer s.Unlock()
+	s.Lock()
+	if b, ok := s.blobs[key]; ok {
+		b.fetching = false
+	}
+}
+
+// remove an upload and its files
+func (s *Store) remove(key string) {
+	s.Lock()
+	b, ok := s.blobs[key]
+	if ok && b.expiry != nil {
+		b.expiry.Stop()
+	}
+	s.Unlock()
+	if !ok {
+		return
+	}
+	s.removeFiles(key)
+	s.release(key, b)
+}
+
+// release the room taken by an upload
+func (s *Store) release(key string, b *blob) {
+	defer s.Unlock()
+	s.Lock()
+	if s.blobs[key] == b {
+		delete(s.blobs, key)
+		s.used -= b.Size
+	}
+}
+
+func (s *Store) removeFiles(key string) {
+	for _, ext := range []string{".part", ".json", ".blob"} {
+		_ = os.Remove(s.path(key, ext))
+	}
+}
+
+// Used is the bytes of stored uploads, including those still being uploaded
+func (s *Store) Used() int64 {
+	defer s.Unlock()
+	s.Lock()
+	return s.used
+}
+
+// onboardStore spools an upload from a sender to the store, for a receiver to fetch later.
+// The sender is told the secret before uploading, and is sent CodeAccepted again once the upload is stored.
+func (r *Service) onboardStore(conn io.ReadWriteCloser, enc wire.Encoder, dec wire.Decoder, store *Store) {
+	defer conn.Close()
+	addr := remoteAddr(conn)
+
+	name, err := dec.DecodeLongString()
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed receiving upload name", "err", err)
+		return
+	}
+	length, err := dec.DecodeString()
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed receiving upload size", "err", err)
+		return
+	}
+	size, err := strconv.ParseInt(length, 10, 64)
+	if err != nil || size < 0 {
+		level.Warn(r.logger).Log("msg", "bad upload size", "size", length, "addr", addr)
+		return
+	}
+
+	if store == nil {
+		level.Warn(r.logger).Log("msg", "store is disabled", "addr", addr)
+		_ = enc.EncodeByte(byte(client.CodeForbidden))
+		return
+	}
+
+	secret := r.secrets.Secret()
+	err = r.reserve(store, secret, name, size)
+	for attempt := 1; errors.Is(err, errDuplicateSecret) && attempt < 3; attempt++ {
+		secret = r.secrets.Secret()
+		err = r.reserve(store, secret, name, size)
+	}
+	switch {
+	case errors.Is(err, errTooLarge), errors.Is(err, errQuotaExceeded):
+		level.Warn(r.logger).Log("msg", "rejecting upload", "size", size, "addr", addr, "err", err)
+		_ = enc.EncodeByte(byte(client.CodeTooLarge))
+		return
+	case err != nil:
+		level.Error(r.logger).Log("msg", "failed reserving upload", "err", err)
+		return
+	}
+
+	id := newTransferID()
+	level.Info(r.logger).Log("msg", "storing", "transfer", id, "secret", redact(secret), "size", size, "addr", addr)
+
+	if err := enc.EncodeByte(byte(client.CodeAccepted)); err == nil {
+		err = enc.EncodeString(secret)
+	}
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed sending secret", "transfer", id, "err", err)
+		store.remove(storeKey(secret))
+		return
+	}
+
+	// handshake is over, so clear any deadline
+	setDeadline(conn, 0)
+
+	// the upload is copied through a buffer from the pool, so the relay's buffer memory includes it
+	var use bufferUse
+	buf := r.buffers.get(&use)
+	defer r.buffers.put(&use, buf)
+	body, err := dec.DecodeReader()
+	if err == nil {
+		err = store.write(secret, body, buf)
+	}
+	if err == nil {
+		// the stream must be exactly the size that was reserved
+		if n, _ := io.Copy(io.Discard, io.LimitReader(body, 1)); n > 0 {
+			store.remove(storeKey(secret))
+			err = errTooLarge
+		}
+	}
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed storing upload", "transfer", id, "err", err)
+		return
+	}
+
+	level.Info(r.logger).Log("msg", "stored", "transfer", id, "bytes", size)
+	_ = enc.EncodeByte(byte(client.CodeAccepted))
+}
+
+// reserve room in the store for an upload, making sure its secret isn't used by a transfer
+func (r *Service) reserve(store *Store, secret string, name string, size int64) error {
+	result := make(chan error, 1)
+	r.action <- func() {
+		if r.taken(secret) {
+			result <- errDuplicateSecret
+			return
+		}
+		result <- store.reserve(secret, name, size)
+	}
+	return <-result
+}
+
+// fetch sends a stored upload to a receiver, and removes it once the receiver has confirmed it has it all.
+// The upload is announced like a live transfer, so the receiver can reject it and fetch it again later.
+func (r *Service) fetch(ts transferSide, enc wire.Encoder, dec wire.Decoder, store *Store) {
+	conn, secret := ts.conn, ts.secret
+	defer conn.Close()
+
+	b, f, err := store.open(secret)
+	if err != nil {
+		level.Warn(r.logger).Log("msg", "failed fetching stored upload", "secret", redact(secret), "err", err)
+		return
+	}
+	defer f.Close()
+
+	// handshake is over, so clear any deadline
+	setDeadline(conn, 0)
+
+	id := newTransferID()
+	level.Info(r.logger).Log("msg", "fetching", "transfer", id, "secret", redact(secret), "addr", remoteAddr(conn))
+
+	if ts.direct {
+		// the relay is the only peer, so the receiver doesn't try to connect directly
+		err = enc.EncodeByte(byte(client.MsgRecv))
+	}
+	if err == nil {
+		err = enc.EncodeLongString(b.Name)
+	}
+	if err == nil {
+		// the upload is copied through a buffer from the pool, so the relay's buffer memory includes it
+		var use bufferUse
+		buf := r.buffers.get(&use)
+		err = sendStored(wire.NewEncoder(conn, wire.WithBuffer(buf)), dec, f, b.Size)
+		r.buffers.put(&use, buf)
+	}
+	store.fetched(secret, err == nil)
+	var rejected *client.RejectedError
+	switch {
+	case errors.As(err, &rejected):
+		level.Info(r.logger).Log("msg", "receiver rejected stored upload", "transfer", id, "reason", rejected.Reason)
+		return
+	case err != nil:
+		level.Warn(r.logger).Log("msg", "failed sending stored upload", "transfer", id, "err", err)
+		return
+	}
+	level.Info(r.logger).Log("msg", "fetched", "transfer", id, "bytes", b.Size)
+}
+
+// sendStored announces a stored upload of size bytes, and sends it once the receiver accepts it.
+// Returns once the receiver confirms it has the whole upload.
+func sendStored(enc wire.Encoder, dec wire.Decoder, f io.Reader, size int64) error {
+	if err := enc.Encode(client.FileHeader{Length: size, Confirm: true}); err != nil {
+		return fmt.Errorf("announcing upload: %w", err)
+	}
+	b, err := dec.DecodeByte()
+	if err != nil {
+		return fmt.Errorf("waiting for receiver to accept: %w", err)
+	}
+	switch b {
+	case client.AcceptFile:
+	case client.RejectFile:
+		reason, err := dec.DecodeLongString()
+		if err != nil {
+			return fmt.Errorf("receiving rejection: %w", err)
+		}
+		return &client.RejectedError{Reason: reason}
+	default:
+		return fmt.Errorf("bad reply from receiver [%v]", b)
+	}
+
+	if err := enc.EncodeReader(f, size); err != nil {
+		return fmt.Errorf("sending upload: %w", err)
+	}
+	if b, err = dec.DecodeByte(); err != nil {
+		return fmt.Errorf("waiting for receiver to confirm: %w", err)
+	}
+	if b != client.ReceivedFile {
+		return fmt.Errorf("bad confirmation from receiver [%v]", b)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// storingRelay runs a relay that stores uploads in dir
+func storingRelay(t *testing.T, dir string, opts StoreOptions) (*Store, *transport.Memory) {
+	t.Helper()
+	store, err := NewStore(dir, opts, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	service := New(NewRandomSecrets(6, 1), log.NewNopLogger())
+	go service.Run()
+	service.Configure(Options{Store: store})
+	return store, startRelayFor(t, service)
+}
+
+// upload a body and wait for it to be stored
+func upload(t *testing.T, tr transport.Transport, name string, body string) (string, error) {
+	t.Helper()
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   name,
+		Length: int64(len(body)),
+		Store:  true,
+	})
+	if err != nil {
+		return "", err
+	}
+	return send.Secret, <-send.Errors
+}
+
+func TestService_Store(t *testing.T) {
+	store, tr := storingRelay(t, t.TempDir(), StoreOptions{})
+
+	body := "the quick brown fox"
+	secret, err := upload(t, tr, "fox.txt", body)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if store.Used() != int64(len(body)) {
+		t.Fatalf("want %v used, got %v", len(body), store.Used())
+	}
+
+	// the sender has gone, and the receiver fetches the upload later
+	recv, err := dialService(t, tr).Recv(secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Name != "fox.txt" {
+		t.Fatalf("want fox.txt, got %v", recv.Name)
+	}
+	b := &strings.Builder{}
+	if _, err := io.Copy(b, recv.Body); err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if b.String() != body {
+		t.Fatalf("want %v, got %v", body, b.String())
+	}
+
+	// uploads can only be fetched once
+	if _, err := dialService(t, tr).Recv(secret); err == nil {
+		t.Fatal("expected error fetching twice")
+	}
+	if store.Used() != 0 {
+		t.Fatalf("want nothing used, got %v", store.Used())
+	}
+}
+
+func TestService_StoreBuffers(t *testing.T) {
+	store, err := NewStore(t.TempDir(), StoreOptions{}, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("new store: %v", err)
+	}
+	service := New(NewRandomSecrets(6, 1), log.NewNopLogger())
+	go service.Run()
+	service.Configure(Options{Store: store})
+	tr := startRelayFor(t, service)
+
+	// uploads and fetches are copied through buffers from the pool
+	body := strings.Repeat("fox", 100000)
+	secret, err := upload(t, tr, "fox.txt", body)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	if peak := atomic.LoadInt64(&service.buffers.used.peak); peak != DefaultBufferSize {
+		t.Fatalf("want a buffer used uploading, got a peak of %v", peak)
+	}
+	recv, err := dialService(t, tr).Recv(secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if n := service.Stats().BufferBytes; n != DefaultBufferSize {
+		t.Fatalf("want a buffer used fetching, got %v", n)
+	}
+	if n, err := io.Copy(io.Discard, recv.Body); err != nil || n != int64(len(body)) {
+		t.Fatalf("want %v bytes, got %v: %v", len(body), n, err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for service.Stats().BufferBytes != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want no buffers in use, got %v bytes", service.Stats().BufferBytes)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestService_StoreUnfinished(t *testing.T) {
+	_, tr := storingRelay(t, t.TempDir(), StoreOptions{})
+
+	body := "kept until received"
+	secret, err := upload(t, tr, "kept.txt", body)
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	// a receiver that rejects the upload leaves it to be fetched later
+	recv, err := dialService(t, tr).Recv(secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Length != int64(len(body)) {
+		t.Fatalf("want %v announced, got %v", len(body), recv.Length)
+	}
+	if err := recv.Reject("no room"); err != nil {
+		t.Fatalf("reject: %v", err)
+	}
+
+	// as does one that goes before it has the whole upload
+	recv, conn := refetch(t, tr, secret)
+	if _, err := recv.Body.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	conn.Close()
+
+	recv, _ = refetch(t, tr, secret)
+	b, err := io.ReadAll(recv.Body)
+	if err != nil || string(b) != body {
+		t.Fatalf("want %v, got %q: %v", body, b, err)
+	}
+}
+
+// refetch waits for a stored upload to be released by an earlier receiver, and fetches it
+func refetch(t *testing.T, tr transport.Transport, secret string) (*client.RecvResponse, net.Conn) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for {
+		conn := dialConn(t, tr)
+		recv, err := client.NewService(wire.NewEncoder(conn), wire.NewDecoder(conn)).Recv(secret)
+		if err == nil {
+			return recv, conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("recv: %v", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestService_StoreLimits(t *testing.T) {
+	store, tr := storingRelay(t, t.TempDir(), StoreOptions{Quota: 10, MaxSize: 8})
+
+	wantStatus := func(err error, status client.CodeStatus) {
+		t.Helper()
+		var codeErr *client.CodeError
+		if !errors.As(err, &codeErr) || codeErr.Status != status {
+			t.Fatalf("want %v, got %v", status, err)
+		}
+	}
+
+	_, err := upload(t, tr, "big", "123456789")
+	wantStatus(err, client.CodeTooLarge)
+
+	if _, err := upload(t, tr, "first", "123456"); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+	_, err = upload(t, tr, "second", "123456")
+	wantStatus(err, client.CodeTooLarge)
+
+	if store.Used() != 6 {
+		t.Fatalf("want 6 used, got %v", store.Used())
+	}
+
+	// uploads are forbidden without a store
+	_, err = upload(t, startRelay(t, NewFixedSecret("abc123")), "empty", "")
+	wantStatus(err, client.CodeForbidden)
+}
+
+func TestStore_Reload(t *testing.T) {
+	dir := t.TempDir()
+	_, tr := storingRelay(t, dir, StoreOptions{})
+
+	secret, err := upload(t, tr, "kept.txt", "kept")
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	// a relay restarted on the same directory still has the upload
+	store, tr := storingRelay(t, dir, StoreOptions{})
+	if !store.has(secret) || store.Used() != 4 {
+		t.Fatalf("upload not reloaded, %v used", store.Used())
+	}
+	recv, err := dialService(t, tr).Recv(secret)
+	if err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+	if recv.Name != "kept.txt" {
+		t.Fatalf("want kept.txt, got %v", recv.Name)
+	}
+}
+
+func TestStore_Retention(t *testing.T) {
+	store, tr := storingRelay(t, t.TempDir(), StoreOptions{Retention: 20 * time.Millisecond})
+
+	secret, err := upload(t, tr, "brief.txt", "brief")
+	if err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for store.has(secret) {
+		if time.Now().After(deadline) {
+			t.Fatal("upload not expired")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if _, err := dialService(t, tr).Recv(secret); err == nil {
+		t.Fatal("expected error fetching an expired upload")
+	}
+}
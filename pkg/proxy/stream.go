@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/go-kit/log/level"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/wire"
+	"io"
+)
+
+// stream of a parallel transfer, pairing a connection from the sender with one from the receiver
+type stream struct {
+	send io.ReadWriteCloser
+	recv io.ReadWriteCloser
+}
+
+// close the connections of the stream
+func (s *stream) close() {
+	if s.send != nil {
+		_ = s.send.Close()
+	}
+	if s.recv != nil {
+		_ = s.recv.Close()
+	}
+}
+
+// decodeStream reads the role and index declared by a stream of a parallel transfer
+func (ts *transferSide) decodeStream(dec wire.Decoder) error {
+	var err error
+	if ts.secret, err = dec.DecodeString(); err != nil {
+		return fmt.Errorf("receiving secret: %w", err)
+	}
+	b, err := dec.DecodeByte()
+	if err != nil {
+		return fmt.Errorf("receiving role: %w", err)
+	}
+	ts.role = client.Side(b)
+	if ts.role != client.MsgSend && ts.role != client.MsgRecv {
+		return fmt.Errorf("bad role: %v", ts.role)
+	}
+	if b, err = dec.DecodeByte(); err != nil {
+		return fmt.Errorf("receiving index: %w", err)
+	}
+	ts.index = int(b)
+	if ts.index >= client.MaxStreams {
+		return fmt.Errorf("bad index: %v", ts.index)
+	}
+	return nil
+}
+
+// joinStream adds a stream connection to the active transfer with one receiver that it belongs to,
+// and starts relaying the stream once both peers have joined it. Must be called from an action.
+func (r *Service) joinStream(ts transferSide) (*transfer, error) {
+	t, ok := r.transfers[ts.secret]
+	if !ok || t.session || t.state != StateActive || len(t.recvs) != 1 {
+		level.Warn(r.logger).Log("msg", "stream provided unknown secret", "secret", redact(ts.secret), "addr", ts.addr)
+		return nil, errUnknownSecret
+	}
+	if t.streams == nil {
+		t.streams = make(map[int]*stream)
+	}
+	s, ok := t.streams[ts.index]
+	if !ok {
+		s = &stream{}
+		t.streams[ts.index] = s
+	}
+	conn := &s.recv
+	if ts.role == client.MsgSend {
+		conn = &s.send
+	}
+	if *conn != nil {
+		level.Warn(r.logger).Log("msg", "transfer already has the stream", "transfer", t.id, "index", ts.index, "addr", ts.addr)
+		return nil, errHasStream
+	}
+	*conn = ts.conn
+	level.Info(r.logger).Log("msg", "joining", "side", ts.side, "transfer", t.id, "role", ts.role, "index", ts.index, "addr", ts.addr)
+
+	if s.send != nil && s.recv != nil {
+		go t.relayStream(r, ts.index, s)
+	}
+	return t, nil
+}
+
+// ackSize is the buffer for relaying acknowledgements from the receiver of a stream, which are a single frame
+const ackSize = 16
+
+// streamBufferSize is the size of the buffer relaying each stream of a transfer, when the relay's buffers are size
+// bytes. Every stream of a transfer may be relayed at once, alongside the transfer's own connection which has a
+// buffer each way, so streams get smaller buffers than the relay's when that would pass MaxTransferMemory.
+func streamBufferSize(size int64) int64 {
+	if limit := (MaxTransferMemory - 2*size) / client.MaxStreams; limit < size {
+		return limit
+	}
+	return size
+}
+
+// relayStream copies a range from the sender to the receiver, counting it in the transfer's bytes,
+// and the receiver's acknowledgement back. Only the range takes a buffer from the pool.
+// The stream ends when either peer closes it, or the transfer closes.
+func (t *transfer) relayStream(r *Service, index int, s *stream) {
+	defer s.close()
+	errs := make(chan error, 2)
+	go func() {
+		_, err := relayCopySize(s.recv, s.send, &t.bytes, r.buffers, &t.memory, streamBufferSize(r.buffers.currentSize()))
+		errs <- err
+	}()
+	go func() {
+		var ack [ackSize]byte
+		_, err := io.CopyBuffer(writerOnly{s.send}, readerOnly{s.recv}, ack[:])
+		errs <- err
+	}()
+	if err := <-errs; err != nil {
+		level.Warn(r.logger).Log(
+			"msg", "relaying stream failed",
+			"transfer", t.id,
+			"index", index,
+			"err", err,
+		)
+	}
+}
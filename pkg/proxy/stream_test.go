@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"github.com/go-kit/log"
+	"go-storj-solution/pkg/client"
+	"go-storj-solution/pkg/transport"
+	"go-storj-solution/pkg/wire"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// joinStream connects a stream of a parallel transfer to the relay
+func joinStream(t *testing.T, tr transport.Transport, secret string, role client.Side, index int) net.Conn {
+	t.Helper()
+	conn := dialConn(t, tr)
+	enc := wire.NewEncoder(conn)
+	for _, err := range []error{
+		enc.EncodeByte(byte(client.MsgStream)),
+		enc.EncodeString(secret),
+		enc.EncodeByte(byte(role)),
+		enc.EncodeByte(byte(index)),
+	} {
+		if err != nil {
+			t.Fatalf("joining stream: %v", err)
+		}
+	}
+	return conn
+}
+
+// closed checks the relay closed a connection without sending anything
+func closed(t *testing.T, conn net.Conn) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("want connection closed, got %v bytes: %v", n, err)
+	}
+}
+
+func TestService_Streams(t *testing.T) {
+	service := New(NewFixedSecret("abc123"), log.NewNopLogger())
+	go service.Run()
+	tr := startRelayFor(t, service)
+
+	// streams can't join a transfer until it is active
+	closed(t, joinStream(t, tr, "abc123", client.MsgSend, 0))
+
+	body := "header"
+	send, err := dialService(t, tr).Send(&client.SendRequest{
+		Body:   strings.NewReader(body),
+		Name:   "data.bin",
+		Length: int64(len(body)),
+	})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	closed(t, joinStream(t, tr, send.Secret, client.MsgSend, 0))
+	if _, err := dialService(t, tr).Recv(send.Secret); err != nil {
+		t.Fatalf("recv: %v", err)
+	}
+
+	sender := joinStream(t, tr, send.Secret, client.MsgSend, 1)
+	receiver := joinStream(t, tr, send.Secret, client.MsgRecv, 1)
+
+	// the pair is relayed both ways
+	if _, err := sender.Write([]byte("range")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(receiver, got); err != nil || string(got) != "range" {
+		t.Fatalf("want range, got %q: %v", got, err)
+	}
+	if _, err := receiver.Write([]byte{byte(client.MsgRecv)}); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := io.ReadFull(sender, got[:1]); err != nil || client.Side(got[0]) != client.MsgRecv {
+		t.Fatalf("want acknowledgement, got %q: %v", got[:1], err)
+	}
+
+	// a stream has one connection from each peer, checked once the pair has joined
+	closed(t, joinStream(t, tr, send.Secret, client.MsgRecv, 1))
+
+	infos := service.Transfers()
+	if len(infos) != 1 || infos[0].Streams != 1 {
+		t.Fatalf("want a transfer with 1 stream, got %+v", infos)
+	}
+
+	// the streams end with the transfer
+	service.Kill(send.Secret)
+	closed(t, sender)
+	closed(t, receiver)
+	// and a killed transfer is counted like any other that has ended
+	if s := service.Stats(); s.Completed != 1 || s.Active != 0 {
+		t.Fatalf("want the transfer completed, got %+v", s)
+	}
+}
+
+func TestRelayStream_Memory(t *testing.T) {
+	service := New(NewFixedSecret("abc123"), log.NewNopLogger())
+	go service.Run()
+	service.Configure(Options{BufferSize: MaxBufferSize})
+
+	// every stream of a transfer relayed at once, with the largest buffers
+	tr := &transfer{id: "streams"}
+	rng := make([]byte, 64<<10)
+	ack := []byte{'b', byte(client.MsgRecv)}
+	var wg sync.WaitGroup
+	for i := 0; i < client.MaxStreams; i++ {
+		sender, src := net.Pipe()
+		dst, receiver := net.Pipe()
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			tr.relayStream(service, i, &stream{send: src, recv: dst})
+		}(i)
+		go func() {
+			defer wg.Done()
+			defer sender.Close()
+			_, _ = sender.Write(rng)
+			_, _ = io.ReadFull(sender, make([]byte, len(ack)))
+		}()
+		go func() {
+			defer wg.Done()
+			defer receiver.Close()
+			_, _ = io.ReadFull(receiver, make([]byte, len(rng)))
+			_, _ = receiver.Write(ack)
+		}()
+	}
+	wg.Wait()
+
+	// the streams leave room for the transfer's own connection within its memory
+	if peak := atomic.LoadInt64(&tr.memory.peak); peak > MaxTransferMemory-2*MaxBufferSize {
+		t.Fatalf("want at most %v bytes of buffers, got %v", MaxTransferMemory-2*MaxBufferSize, peak)
+	}
+	// and only the ranges are counted, not the acknowledgements
+	if want := int64(client.MaxStreams * len(rng)); atomic.LoadInt64(&tr.bytes) != want {
+		t.Fatalf("want %v bytes relayed, got %v", want, tr.bytes)
+	}
+}
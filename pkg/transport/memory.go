@@ -0,0 +1,111 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ErrClosed is returned when accepting from a closed in-memory listener
+var ErrClosed = errors.New("transport: listener closed")
+
+// Memory is an in-process Transport where connections are pairs of net.Pipe ends.
+// Useful for running a relay and its clients in a single process, such as in tests.
+type Memory struct {
+	// guards listeners
+	sync.Mutex
+
+	// listeners by address
+	listeners map[string]*memoryListener
+}
+
+// NewMemory returns a Transport that never leaves the current process
+func NewMemory() *Memory {
+	return &Memory{
+		listeners: make(map[string]*memoryListener),
+	}
+}
+
+func (m *Memory) Listen(addr string) (net.Listener, error) {
+	defer m.Unlock()
+	m.Lock()
+	if _, ok := m.listeners[addr]; ok {
+		return nil, fmt.Errorf("transport.Listen: address in use: %v", addr)
+	}
+	l := &memoryListener{
+		memory: m,
+		addr:   memoryAddr(addr),
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+	}
+	m.listeners[addr] = l
+	return l, nil
+}
+
+func (m *Memory) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	m.Lock()
+	l, ok := m.listeners[addr]
+	m.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("transport.Dial: connection refused: %v", addr)
+	}
+
+	server, client := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, fmt.Errorf("transport.Dial: connection refused: %v", addr)
+	case <-ctx.Done():
+		return nil, fmt.Errorf("transport.Dial: %w", ctx.Err())
+	}
+}
+
+// memoryListener accepts connections dialed through a Memory transport
+type memoryListener struct {
+	memory *Memory
+	addr   memoryAddr
+
+	// conns delivers server side of dialed connections
+	conns chan net.Conn
+
+	// done is closed when the listener is closed
+	done chan struct{}
+	once sync.Once
+}
+
+func (l *memoryListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	}
+}
+
+func (l *memoryListener) Close() error {
+	l.once.Do(func() {
+		close(l.done)
+		l.memory.Lock()
+		delete(l.memory.listeners, string(l.addr))
+		l.memory.Unlock()
+	})
+	return nil
+}
+
+func (l *memoryListener) Addr() net.Addr {
+	return l.addr
+}
+
+// memoryAddr is the address of an in-memory listener
+type memoryAddr string
+
+func (a memoryAddr) Network() string {
+	return "memory"
+}
+
+func (a memoryAddr) String() string {
+	return string(a)
+}
@@ -0,0 +1,23 @@
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// tcp is a Transport over TCP/IP
+type tcp struct{}
+
+// NewTCP returns a Transport for TCP connections
+func NewTCP() Transport {
+	return tcp{}
+}
+
+func (tcp) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcp) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
@@ -0,0 +1,27 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// tlsTransport is a Transport over TLS on TCP
+type tlsTransport struct {
+	config *tls.Config
+}
+
+// NewTLS returns a Transport for TLS connections.
+// Listening requires the config to have certificates, dialing can use an empty config.
+func NewTLS(config *tls.Config) Transport {
+	return tlsTransport{config: config}
+}
+
+func (t tlsTransport) Listen(addr string) (net.Listener, error) {
+	return tls.Listen("tcp", addr, t.config)
+}
+
+func (t tlsTransport) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	d := tls.Dialer{Config: t.config}
+	return d.DialContext(ctx, "tcp", addr)
+}
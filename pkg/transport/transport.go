@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+)
+
+// Transport creates listeners for the relay and connections for clients.
+type Transport interface {
+	// Listen announces on the local address.
+	Listen(addr string) (net.Listener, error)
+
+	// Dial connects to the address.
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+}
+
+// Parse selects a Transport for an address.
+// Addresses may be prefixed with a scheme, such as "tcp://", "tls://" or "unix://", and
+// without a scheme TCP is assumed. The returned address has the scheme removed,
+// except for WebSocket URLs which are returned whole.
+func Parse(addr string) (Transport, string) {
+	switch {
+	case strings.HasPrefix(addr, "ws://"), strings.HasPrefix(addr, "wss://"):
+		return NewWebSocket(), addr
+	case strings.HasPrefix(addr, "unix://"):
+		return NewUnix(), strings.TrimPrefix(addr, "unix://")
+	case strings.HasPrefix(addr, "tls://"):
+		return NewTLS(&tls.Config{}), strings.TrimPrefix(addr, "tls://")
+	case strings.HasPrefix(addr, "tcp://"):
+		return NewTCP(), strings.TrimPrefix(addr, "tcp://")
+	default:
+		return NewTCP(), addr
+	}
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		t    Transport
+		addr string
+	}{
+		{"no scheme", "localhost:1234", tcp{}, "localhost:1234"},
+		{"tcp scheme", "tcp://localhost:1234", tcp{}, "localhost:1234"},
+		{"tls scheme", "tls://localhost:1234", tlsTransport{}, "localhost:1234"},
+		{"unix scheme", "unix:///tmp/relay.sock", unix{}, "/tmp/relay.sock"},
+		{"ws scheme", "ws://localhost:1234/relay", websocket{}, "ws://localhost:1234/relay"},
+		{"wss scheme", "wss://localhost/relay", websocket{}, "wss://localhost/relay"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, addr := Parse(tt.in)
+			if reflect.TypeOf(tr) != reflect.TypeOf(tt.t) {
+				t.Fatalf("want %T, got %T", tt.t, tr)
+			}
+			if addr != tt.addr {
+				t.Fatalf("want %v, got %v", tt.addr, addr)
+			}
+		})
+	}
+}
+
+func TestTransports(t *testing.T) {
+	tests := []struct {
+		name string
+		t    Transport
+		addr string
+	}{
+		{"memory", NewMemory(), "relay"},
+		{"tcp", NewTCP(), "127.0.0.1:0"},
+		{"unix", NewUnix(), filepath.Join(t.TempDir(), "relay.sock")},
+		{"websocket", NewWebSocket(), "ws://127.0.0.1:0/relay"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l, err := tt.t.Listen(tt.addr)
+			if err != nil {
+				t.Fatalf("listen: %v", err)
+			}
+			defer l.Close()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+
+			conn, err := tt.t.Dial(context.Background(), l.Addr().String())
+			if err != nil {
+				t.Fatalf("dial: %v", err)
+			}
+			defer conn.Close()
+
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatalf("write: %v", err)
+			}
+			bs := make([]byte, 4)
+			if _, err := io.ReadFull(conn, bs); err != nil {
+				t.Fatalf("read: %v", err)
+			}
+			if string(bs) != "ping" {
+				t.Fatalf("want ping, got %v", string(bs))
+			}
+		})
+	}
+}
+
+func TestMemory_DialUnknown(t *testing.T) {
+	m := NewMemory()
+	if _, err := m.Dial(context.Background(), "nowhere"); err == nil {
+		t.Fatal("expected error dialing unknown address")
+	}
+}
+
+func TestMemory_AcceptClosed(t *testing.T) {
+	m := NewMemory()
+	l, err := m.Listen("relay")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	l.Close()
+	if _, err := l.Accept(); err != ErrClosed {
+		t.Fatalf("want %v, got %v", ErrClosed, err)
+	}
+	if _, err := m.Listen("relay"); err != nil {
+		t.Fatalf("address not released: %v", err)
+	}
+}
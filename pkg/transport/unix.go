@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"context"
+	"net"
+)
+
+// unix is a Transport over Unix domain sockets
+type unix struct{}
+
+// NewUnix returns a Transport for Unix domain socket connections.
+// Addresses are file system paths.
+func NewUnix() Transport {
+	return unix{}
+}
+
+func (unix) Listen(addr string) (net.Listener, error) {
+	return net.Listen("unix", addr)
+}
+
+func (unix) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, "unix", addr)
+}
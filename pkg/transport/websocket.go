@@ -0,0 +1,508 @@
+package transport
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// websocketGUID is appended to a client key to compute the accept key, see RFC 6455
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// websocketHeaderTimeout limits how long a client has to send the headers of its upgrade request,
+// so clients that connect and send nothing don't hold connections open
+const websocketHeaderTimeout = 10 * time.Second
+
+// websocketCloseTimeout limits how long Close waits to send a close frame to a peer that isn't reading
+const websocketCloseTimeout = 100 * time.Millisecond
+
+// WebSocket frame opcodes
+const (
+	opContinuation byte = 0x0
+	opText         byte = 0x1
+	opBinary       byte = 0x2
+	opClose        byte = 0x8
+	opPing         byte = 0x9
+	opPong         byte = 0xA
+)
+
+// websocket is a Transport that tunnels connections through WebSocket upgrades.
+// Addresses are URLs such as "ws://relay.example.com:8080/relay".
+// Bytes are carried in binary messages, so a connection behaves as a plain byte stream.
+type websocket struct{}
+
+// NewWebSocket returns a Transport for WebSocket connections.
+// The relay listens on plain HTTP, and is expected to be behind a TLS terminating proxy for "wss".
+func NewWebSocket() Transport {
+	return websocket{}
+}
+
+func (w websocket) Listen(addr string) (net.Listener, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("transport.Listen: %w", err)
+	}
+	if u.Scheme != "ws" {
+		return nil, fmt.Errorf("transport.Listen: unsupported scheme: %v", u.Scheme)
+	}
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	inner, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &websocketListener{
+		inner:  inner,
+		path:   path,
+		conns:  make(chan net.Conn),
+		done:   make(chan struct{}),
+		served: make(chan struct{}),
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, l.upgrade)
+	l.server = &http.Server{Handler: mux, ReadHeaderTimeout: websocketHeaderTimeout}
+	go func() {
+		l.serveErr = l.server.Serve(inner)
+		close(l.served)
+	}()
+	return l, nil
+}
+
+func (w websocket) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("transport.Dial: %w", err)
+	}
+
+	host := u.Host
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+	default:
+		return nil, fmt.Errorf("transport.Dial: unsupported scheme: %v", u.Scheme)
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if u.Scheme == "wss" {
+		tc := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tc.Handshake(); err != nil {
+			_ = conn.Close()
+			return nil, fmt.Errorf("transport.Dial: tls handshake: %w", err)
+		}
+		conn = tc
+	}
+
+	wc, err := handshake(conn, u)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("transport.Dial: %w", err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return wc, nil
+}
+
+// handshake performs the client side of the WebSocket opening handshake
+func handshake(conn net.Conn, u *url.URL) (net.Conn, error) {
+	bs := make([]byte, 16)
+	if _, err := rand.Read(bs); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(bs)
+
+	path := u.RequestURI()
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawQuery: u.RawQuery},
+		Host:       u.Host,
+		Header:     make(http.Header),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	_, err := fmt.Fprintf(conn,
+		"GET %s HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n\r\n",
+		path, u.Host, key)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, fmt.Errorf("websocket upgrade refused: %v", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		return nil, errors.New("websocket upgrade: bad accept key")
+	}
+	return newWebsocketConn(conn, br, true), nil
+}
+
+// acceptKey computes the Sec-WebSocket-Accept value for a client key
+func acceptKey(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// websocketListener accepts connections upgraded by an HTTP server
+type websocketListener struct {
+	inner  net.Listener
+	path   string
+	server *http.Server
+
+	// conns delivers upgraded connections
+	conns chan net.Conn
+
+	// done is closed when the listener is closed
+	done chan struct{}
+	once sync.Once
+
+	// served is closed when the HTTP server stops, with the reason in serveErr
+	served   chan struct{}
+	serveErr error
+}
+
+// upgrade is the HTTP handler that upgrades requests to WebSocket connections
+func (l *websocketListener) upgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet ||
+		!strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContains(r.Header, "Connection", "upgrade") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusBadRequest)
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket upgrade unsupported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return
+	}
+
+	_, err = fmt.Fprintf(conn,
+		"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Accept: %s\r\n\r\n",
+		acceptKey(key))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	wc := newWebsocketConn(conn, brw.Reader, false)
+	select {
+	case l.conns <- wc:
+	case <-l.done:
+		_ = wc.Close()
+	}
+}
+
+// headerContains checks if a comma separated header contains a token
+func headerContains(h http.Header, name string, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (l *websocketListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, ErrClosed
+	case <-l.served:
+		select {
+		case <-l.done:
+			return nil, ErrClosed
+		default:
+			// the server failed, so no more connections will be accepted
+			return nil, fmt.Errorf("transport.Accept: %w", l.serveErr)
+		}
+	}
+}
+
+func (l *websocketListener) Close() error {
+	var err error
+	l.once.Do(func() {
+		close(l.done)
+		err = l.server.Close()
+	})
+	return err
+}
+
+func (l *websocketListener) Addr() net.Addr {
+	return websocketAddr{host: l.inner.Addr().String(), path: l.path}
+}
+
+// websocketAddr is the URL of a WebSocket listener
+type websocketAddr struct {
+	host string
+	path string
+}
+
+func (a websocketAddr) Network() string {
+	return "websocket"
+}
+
+func (a websocketAddr) String() string {
+	return "ws://" + a.host + a.path
+}
+
+// websocketConn adapts a WebSocket connection to a byte stream.
+// Each Write is sent as a single binary message, and Read returns the payloads
+// of data frames in order, so message boundaries aren't preserved.
+type websocketConn struct {
+	net.Conn
+
+	// br buffers reads from the connection, and may hold bytes read during the handshake
+	br *bufio.Reader
+
+	// client connections mask the frames they send
+	client bool
+
+	// wlock guards writes, which happen from Read when answering pings and closes. It is held by sending to it,
+	// so Close can tell a write is in progress without waiting for it.
+	wlock chan struct{}
+
+	// remaining payload bytes of the current data frame
+	remaining int64
+
+	// mask of the current data frame, and position in the mask
+	masked bool
+	mask   [4]byte
+	pos    int
+
+	// closed is set when a close frame has been received
+	closed bool
+}
+
+func newWebsocketConn(conn net.Conn, br *bufio.Reader, client bool) *websocketConn {
+	return &websocketConn{
+		Conn:   conn,
+		br:     br,
+		client: client,
+		wlock:  make(chan struct{}, 1),
+	}
+}
+
+func (c *websocketConn) Read(p []byte) (int, error) {
+	for c.remaining == 0 {
+		if c.closed {
+			return 0, io.EOF
+		}
+		if err := c.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.br.Read(p)
+	if c.masked {
+		for i := 0; i < n; i++ {
+			p[i] ^= c.mask[c.pos%4]
+			c.pos++
+		}
+	}
+	c.remaining -= int64(n)
+	return n, err
+}
+
+// nextFrame reads frame headers, handling control frames, until a data frame is found
+func (c *websocketConn) nextFrame() error {
+	header := []byte{0, 0}
+	if _, err := io.ReadFull(c.br, header); err != nil {
+		return err
+	}
+	opcode := header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := int64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var l uint16
+		if err := binary.Read(c.br, binary.BigEndian, &l); err != nil {
+			return err
+		}
+		length = int64(l)
+	case 127:
+		var l uint64
+		if err := binary.Read(c.br, binary.BigEndian, &l); err != nil {
+			return err
+		}
+		if l > 1<<63-1 {
+			return errors.New("websocket: frame too large")
+		}
+		length = int64(l)
+	}
+
+	// clients mask every frame they send, and servers never mask theirs, see RFC 6455
+	if masked == c.client {
+		if c.client {
+			return errors.New("websocket: masked frame from server")
+		}
+		return errors.New("websocket: unmasked frame from client")
+	}
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return err
+		}
+	}
+
+	switch opcode {
+	case opContinuation, opText, opBinary:
+		c.remaining = length
+		c.masked = masked
+		c.mask = mask
+		c.pos = 0
+		return nil
+	case opClose, opPing, opPong:
+		if length > 125 {
+			return errors.New("websocket: control frame too large")
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(c.br, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case opClose:
+			c.closed = true
+			_ = c.writeFrame(opClose, payload)
+		case opPing:
+			return c.writeFrame(opPong, payload)
+		}
+		return nil
+	default:
+		return fmt.Errorf("websocket: unknown opcode: %v", opcode)
+	}
+}
+
+func (c *websocketConn) Write(p []byte) (int, error) {
+	if err := c.writeFrame(opBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame writes a single final frame, masked if this is the client side
+func (c *websocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.wlock <- struct{}{}
+	defer func() { <-c.wlock }()
+	return c.writeFrameLocked(opcode, payload)
+}
+
+// writeFrameLocked writes a frame while holding wlock
+func (c *websocketConn) writeFrameLocked(opcode byte, payload []byte) error {
+	header := make([]byte, 0, 14)
+	header = append(header, 0x80|opcode)
+
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	length := len(payload)
+	switch {
+	case length <= 125:
+		header = append(header, maskBit|byte(length))
+	case length <= 0xFFFF:
+		header = append(header, maskBit|126, 0, 0)
+		binary.BigEndian.PutUint16(header[2:], uint16(length))
+	default:
+		header = append(header, maskBit|127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(header[2:], uint64(length))
+	}
+
+	if !c.client {
+		if _, err := c.Conn.Write(header); err != nil {
+			return err
+		}
+		_, err := c.Conn.Write(payload)
+		return err
+	}
+
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	header = append(header, mask[:]...)
+	frame := make([]byte, len(header)+length)
+	copy(frame, header)
+	for i, b := range payload {
+		frame[len(header)+i] = b ^ mask[i%4]
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame, on a best effort basis, and closes the connection.
+// It doesn't block on a peer that has stopped reading: the close frame is skipped while another write
+// is in progress, as that write may be stuck, and is only given a short time to be sent otherwise.
+func (c *websocketConn) Close() error {
+	select {
+	case c.wlock <- struct{}{}:
+		_ = c.Conn.SetWriteDeadline(time.Now().Add(websocketCloseTimeout))
+		_ = c.writeFrameLocked(opClose, []byte{0x03, 0xE8}) // 1000, normal closure
+		<-c.wlock
+	default:
+	}
+	return c.Conn.Close()
+}
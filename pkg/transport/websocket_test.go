@@ -0,0 +1,168 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebSocket_LargeWrites(t *testing.T) {
+	tr := NewWebSocket()
+	l, err := tr.Listen("ws://127.0.0.1:0/")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	// sizes cover the 7-bit, 16-bit and 64-bit payload length encodings
+	sizes := []int{1, 125, 126, 65535, 65536, 1 << 20}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := tr.Dial(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer conn.Close()
+
+	for _, size := range sizes {
+		want := bytes.Repeat([]byte{'x'}, size)
+		if _, err := conn.Write(want); err != nil {
+			t.Fatalf("write %v: %v", size, err)
+		}
+		got := make([]byte, size)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatalf("read %v: %v", size, err)
+		}
+		if !bytes.Equal(want, got) {
+			t.Fatalf("payload of size %v mismatch", size)
+		}
+	}
+}
+
+func TestWebSocket_RejectsPlainHTTP(t *testing.T) {
+	l, err := NewWebSocket().Listen("ws://127.0.0.1:0/relay")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	url := "http://" + strings.TrimPrefix(l.Addr().String(), "ws://")
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("want %v, got %v", http.StatusUpgradeRequired, resp.StatusCode)
+	}
+}
+
+func TestWebSocket_CloseStalledWrite(t *testing.T) {
+	tr := NewWebSocket()
+	l, err := tr.Listen("ws://127.0.0.1:0/")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	// the client never reads, so the server's writes stall once the socket buffers are full
+	client, err := tr.Dial(context.Background(), l.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	defer client.Close()
+	conn := <-accepted
+	if conn == nil {
+		t.Fatal("accept failed")
+	}
+
+	stalled := make(chan error, 1)
+	go func() {
+		chunk := make([]byte, 1<<20)
+		for {
+			if _, err := conn.Write(chunk); err != nil {
+				stalled <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close blocked by a stalled write")
+	}
+	if err := <-stalled; err == nil {
+		t.Fatal("want the stalled write to fail")
+	}
+}
+
+func TestWebSocket_Masking(t *testing.T) {
+	for _, tt := range []struct {
+		client bool
+		frame  []byte
+	}{
+		// a server must reject unmasked frames from a client
+		{false, []byte{0x82, 0x01, 'x'}},
+		// and a client masked frames from a server
+		{true, []byte{0x82, 0x81, 1, 2, 3, 4, 'x' ^ 1}},
+	} {
+		local, remote := net.Pipe()
+		conn := newWebsocketConn(local, bufio.NewReader(local), tt.client)
+		go func() {
+			_, _ = remote.Write(tt.frame)
+		}()
+		if _, err := conn.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "masked") {
+			t.Fatalf("client %v: want frame rejected, got %v", tt.client, err)
+		}
+		local.Close()
+		remote.Close()
+	}
+}
+
+func TestWebSocket_AcceptServeError(t *testing.T) {
+	l, err := NewWebSocket().Listen("ws://127.0.0.1:0/")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+
+	// the HTTP server stops if its listener fails, and Accept reports why rather than blocking
+	_ = l.(*websocketListener).inner.Close()
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := l.Accept()
+		accepted <- err
+	}()
+	select {
+	case err := <-accepted:
+		if err == nil || errors.Is(err, ErrClosed) {
+			t.Fatalf("want the server's error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("accept blocked after the server failed")
+	}
+}
@@ -0,0 +1,457 @@
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// maxDepth limits how deeply lists, maps and records can be nested, so a peer can't exhaust the stack
+const maxDepth = 32
+
+// Encode encodes v as a single frame, choosing the frame type from the type of v:
+//
+//	bool                     bool frame
+//	int, int8 ... int64      int64 frame
+//	uint, uint8 ... uint64   uvarint frame
+//	string, []byte           bytes frame
+//	slice                    list frame of the elements
+//	map                      map frame, ordered by encoded key so the encoding is stable
+//	struct                   record frame of the fields tagged with `wire:"<tag>"`
+//	pointer                  the value pointed to, nil pointer fields of a record are left out
+//
+// Record fields are identified by their tag number rather than their name or order, so fields
+// can be added to a message and decoders that don't know them skip them.
+// Untagged fields, and fields tagged `wire:"-"`, are not encoded.
+func (enc *encoder) Encode(v interface{}) error {
+	// encode the whole value before writing it, rather than writing each frame separately
+	b := &bytes.Buffer{}
+	if err := encodeValue(&encoder{Writer: b, config: enc.config}, reflect.ValueOf(v), 0); err != nil {
+		return fmt.Errorf("wire.Encode: %w", err)
+	}
+	if _, err := enc.Write(b.Bytes()); err != nil {
+		return fmt.Errorf("wire.Encode: %w", err)
+	}
+	return nil
+}
+
+// Decode decodes a frame encoded by Encode into the value v points to.
+// Record fields with tags that aren't in the struct are skipped, and fields that weren't sent are left as they are.
+func (dec *decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("wire.Decode: need a non-nil pointer, got %T", v)
+	}
+	if err := dec.decodeValue(rv.Elem(), 0); err != nil {
+		return fmt.Errorf("wire.Decode: %w", err)
+	}
+	return nil
+}
+
+func encodeValue(enc *encoder, v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return enc.EncodeBool(v.Bool())
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return enc.EncodeInt64(v.Int())
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return enc.EncodeUvarint(v.Uint())
+
+	case reflect.String:
+		return enc.EncodeBytes([]byte(v.String()))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return enc.EncodeBytes(v.Bytes())
+		}
+		if err := enc.EncodeList(v.Len()); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeValue(enc, v.Index(i), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		return encodeMap(enc, v, depth)
+
+	case reflect.Struct:
+		return encodeRecord(enc, v, depth)
+
+	case reflect.Ptr:
+		if v.IsNil() {
+			return fmt.Errorf("nil %v", v.Type())
+		}
+		return encodeValue(enc, v.Elem(), depth)
+	}
+	return fmt.Errorf("unsupported type %v", v.Type())
+}
+
+// encodeMap encodes entries ordered by their encoded keys, as map iteration order is random
+func encodeMap(enc *encoder, v reflect.Value, depth int) error {
+	type entry struct {
+		key   []byte
+		value reflect.Value
+	}
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		b := &bytes.Buffer{}
+		if err := encodeValue(&encoder{Writer: b, config: enc.config}, iter.Key(), depth+1); err != nil {
+			return err
+		}
+		entries = append(entries, entry{key: b.Bytes(), value: iter.Value()})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].key, entries[j].key) < 0
+	})
+
+	if err := enc.EncodeMap(len(entries)); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if _, err := enc.Write(e.key); err != nil {
+			return err
+		}
+		if err := encodeValue(enc, e.value, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encodeRecord(enc *encoder, v reflect.Value, depth int) error {
+	fields, err := recordFields(v.Type())
+	if err != nil {
+		return err
+	}
+
+	// nil pointers are left out
+	var present []field
+	for _, f := range fields {
+		if fv := v.Field(f.index); fv.Kind() == reflect.Ptr && fv.IsNil() {
+			continue
+		}
+		present = append(present, f)
+	}
+
+	if _, err := enc.Write(appendUvarint([]byte{recordType}, uint64(len(present)))); err != nil {
+		return err
+	}
+	for _, f := range present {
+		if _, err := enc.Write(appendUvarint(nil, f.tag)); err != nil {
+			return err
+		}
+		if err := encodeValue(enc, v.Field(f.index), depth+1); err != nil {
+			return fmt.Errorf("%v.%v: %w", v.Type(), v.Type().Field(f.index).Name, err)
+		}
+	}
+	return nil
+}
+
+// field of a struct that is encoded in a record
+type field struct {
+	tag   uint64
+	index int
+}
+
+// recordFields returns the tagged fields of a struct type
+func recordFields(t reflect.Type) ([]field, error) {
+	var fields []field
+	seen := make(map[uint64]bool)
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		name, ok := sf.Tag.Lookup("wire")
+		if !ok || name == "-" {
+			continue
+		}
+		if sf.PkgPath != "" {
+			return nil, fmt.Errorf("%v.%v: tagged field isn't exported", t, sf.Name)
+		}
+		tag, err := strconv.ParseUint(name, 10, 64)
+		if err != nil || tag == 0 {
+			return nil, fmt.Errorf("%v.%v: bad tag %q", t, sf.Name, name)
+		}
+		if seen[tag] {
+			return nil, fmt.Errorf("%v.%v: duplicate tag %v", t, sf.Name, tag)
+		}
+		seen[tag] = true
+		fields = append(fields, field{tag: tag, index: i})
+	}
+	return fields, nil
+}
+
+// decodeValue reads a frame into v
+func (dec *decoder) decodeValue(v reflect.Value, depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	typ, err := dec.readByte()
+	if err != nil {
+		return err
+	}
+
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		v = v.Elem()
+	}
+
+	want := frameType(v.Type())
+	if want == 0 {
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	if typ != want {
+		return fmt.Errorf("bad type %v for %v", typ, v.Type())
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		b, err := dec.bool()
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := dec.int64()
+		if err != nil {
+			return err
+		}
+		if v.OverflowInt(n) {
+			return fmt.Errorf("%v overflows %v", n, v.Type())
+		}
+		v.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := dec.uvarint()
+		if err != nil {
+			return err
+		}
+		if v.OverflowUint(n) {
+			return fmt.Errorf("%v overflows %v", n, v.Type())
+		}
+		v.SetUint(n)
+
+	case reflect.String:
+		bs, err := dec.bytes()
+		if err != nil {
+			return err
+		}
+		v.SetString(string(bs))
+
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			bs, err := dec.bytes()
+			if err != nil {
+				return err
+			}
+			v.SetBytes(bs)
+			return nil
+		}
+		n, err := dec.count()
+		if err != nil {
+			return err
+		}
+		s := reflect.MakeSlice(v.Type(), 0, 0)
+		for i := 0; i < n; i++ {
+			e := reflect.New(v.Type().Elem()).Elem()
+			if err := dec.decodeValue(e, depth+1); err != nil {
+				return err
+			}
+			s = reflect.Append(s, e)
+		}
+		v.Set(s)
+
+	case reflect.Map:
+		n, err := dec.count()
+		if err != nil {
+			return err
+		}
+		m := reflect.MakeMap(v.Type())
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := dec.decodeValue(key, depth+1); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := dec.decodeValue(value, depth+1); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		v.Set(m)
+
+	case reflect.Struct:
+		return dec.decodeRecord(v, depth)
+	}
+	return nil
+}
+
+// decodeRecord reads the fields of a record frame into the struct v, skipping fields it doesn't have
+func (dec *decoder) decodeRecord(v reflect.Value, depth int) error {
+	fields, err := recordFields(v.Type())
+	if err != nil {
+		return err
+	}
+	byTag := make(map[uint64]int, len(fields))
+	for _, f := range fields {
+		byTag[f.tag] = f.index
+	}
+
+	n, err := dec.count()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		tag, err := dec.uvarint()
+		if err != nil {
+			return err
+		}
+		index, ok := byTag[tag]
+		if !ok {
+			// a field added by a newer peer
+			if err := dec.skip(depth + 1); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := dec.decodeValue(v.Field(index), depth+1); err != nil {
+			return fmt.Errorf("%v.%v: %w", v.Type(), v.Type().Field(index).Name, err)
+		}
+	}
+	return nil
+}
+
+// frameType is the type of frame a Go type is encoded as, or zero if it isn't supported
+func frameType(t reflect.Type) byte {
+	switch t.Kind() {
+	case reflect.Bool:
+		return boolType
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int64Type
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return uvarintType
+	case reflect.String:
+		return bytesType
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return bytesType
+		}
+		return listType
+	case reflect.Map:
+		return mapType
+	case reflect.Struct:
+		return recordType
+	}
+	return 0
+}
+
+// skip reads a whole frame of any known type and discards it
+func (dec *decoder) skip(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	typ, err := dec.readByte()
+	if err != nil {
+		return err
+	}
+
+	var discard int64
+	switch typ {
+	case byteType, boolType:
+		discard = 1
+	case int64Type:
+		discard = 8
+	case stringType:
+		length, err := dec.readByte()
+		if err != nil {
+			return err
+		}
+		discard = int64(length)
+	case longType:
+		length, err := dec.uvarint()
+		if err != nil {
+			return err
+		}
+		if length > uint64(dec.maxLongString) {
+			return fmt.Errorf("too long %v", length)
+		}
+		discard = int64(length)
+	case streamType:
+		if discard, err = dec.int64(); err != nil {
+			return err
+		}
+	case uvarintType:
+		_, err := dec.uvarint()
+		return err
+	case unsizedType:
+		for {
+			length, err := dec.uvarint()
+			if err != nil || length == 0 {
+				return err
+			}
+			if length > MaxBytes {
+				return fmt.Errorf("chunk too long %v", length)
+			}
+			if _, err := io.CopyN(io.Discard, dec, int64(length)); err != nil {
+				if err == io.EOF {
+					return io.ErrUnexpectedEOF
+				}
+				return err
+			}
+		}
+	case bytesType:
+		length, err := dec.uvarint()
+		if err != nil {
+			return err
+		}
+		if length > MaxBytes {
+			return fmt.Errorf("too long %v", length)
+		}
+		discard = int64(length)
+	case listType, mapType, recordType:
+		n, err := dec.count()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if typ == recordType {
+				if _, err := dec.uvarint(); err != nil {
+					return err
+				}
+			}
+			if typ == mapType {
+				if err := dec.skip(depth + 1); err != nil {
+					return err
+				}
+			}
+			if err := dec.skip(depth + 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("bad type: %v", typ)
+	}
+
+	if _, err := io.CopyN(io.Discard, dec, discard); err != nil {
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package wire
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type file struct {
+	Name string `wire:"1"`
+	Size int64  `wire:"2"`
+	Mode uint32 `wire:"3"`
+}
+
+type offer struct {
+	Files    []file            `wire:"1"`
+	Labels   map[string]string `wire:"2"`
+	Checksum []byte            `wire:"3"`
+	Resume   *file             `wire:"4"`
+	Store    bool              `wire:"5"`
+
+	// not sent
+	local string
+	Cache string `wire:"-"`
+}
+
+// offerV2 is offer with a field added by a newer peer
+type offerV2 struct {
+	Files    []file            `wire:"1"`
+	Labels   map[string]string `wire:"2"`
+	Checksum []byte            `wire:"3"`
+	Resume   *file             `wire:"4"`
+	Store    bool              `wire:"5"`
+	Extra    map[string][]file `wire:"6"`
+}
+
+func roundTrip(t *testing.T, in interface{}, out interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(in); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	dec := NewDecoder(&buf)
+	if err := dec.Decode(out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%v bytes left over", buf.Len())
+	}
+}
+
+func TestCodec_RoundTrip(t *testing.T) {
+	in := offer{
+		Files:    []file{{Name: "a.txt", Size: 10, Mode: 0644}, {Name: strings.Repeat("long/", 100), Size: -1}},
+		Labels:   map[string]string{"b": "2", "a": "1"},
+		Checksum: []byte{1, 2, 3},
+		Store:    true,
+		local:    "local",
+		Cache:    "cache",
+	}
+	var out offer
+	roundTrip(t, in, &out)
+
+	in.local, in.Cache = "", ""
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("want %+v, got %+v", in, out)
+	}
+
+	in.Resume = &file{Name: "partial"}
+	out = offer{}
+	roundTrip(t, in, &out)
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("want %+v, got %+v", in, out)
+	}
+}
+
+func TestCodec_Stable(t *testing.T) {
+	// maps are ordered by key, so the same value always encodes the same
+	labels := map[string]string{"c": "3", "a": "1", "b": "2"}
+	var first bytes.Buffer
+	if err := NewEncoder(&first).Encode(labels); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(labels); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if !bytes.Equal(first.Bytes(), buf.Bytes()) {
+			t.Fatalf("want %v, got %v", first.Bytes(), buf.Bytes())
+		}
+	}
+}
+
+func TestCodec_UnknownFields(t *testing.T) {
+	in := offerV2{
+		Files: []file{{Name: "a.txt", Size: 10}},
+		Extra: map[string][]file{"x": {{Name: "b.txt"}}},
+		Store: true,
+	}
+
+	// the older peer skips the new field, and reads the following frame
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.Encode(in); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeString("next"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	dec := NewDecoder(&buf)
+	var out offer
+	if err := dec.Decode(&out); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if !reflect.DeepEqual(out.Files, in.Files) || !out.Store {
+		t.Fatalf("want %+v, got %+v", in, out)
+	}
+	if s, err := dec.DecodeString(); s != "next" || err != nil {
+		t.Fatalf("want next, got %v: %v", s, err)
+	}
+}
+
+func TestCodec_Primitives(t *testing.T) {
+	// values encoded by Encode can be decoded by the primitive methods
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	for _, v := range []interface{}{uint16(7), int8(-7), true, "hi", []int{1}} {
+		if err := enc.Encode(v); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	if v, err := dec.DecodeUvarint(); v != 7 || err != nil {
+		t.Fatalf("want 7, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeInt64(); v != -7 || err != nil {
+		t.Fatalf("want -7, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeBool(); !v || err != nil {
+		t.Fatalf("want true, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeBytes(); string(v) != "hi" || err != nil {
+		t.Fatalf("want hi, got %v: %v", v, err)
+	}
+	if n, err := dec.DecodeList(); n != 1 || err != nil {
+		t.Fatalf("want 1, got %v: %v", n, err)
+	}
+	if v, err := dec.DecodeInt64(); v != 1 || err != nil {
+		t.Fatalf("want 1, got %v: %v", v, err)
+	}
+}
+
+func TestCodec_Errors(t *testing.T) {
+	encode := func(v interface{}) []byte {
+		var buf bytes.Buffer
+		if err := NewEncoder(&buf).Encode(v); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		return buf.Bytes()
+	}
+
+	t.Run("unsupported type", func(t *testing.T) {
+		if err := NewEncoder(&bytes.Buffer{}).Encode(1.5); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("bad tag", func(t *testing.T) {
+		v := struct {
+			A int `wire:"a"`
+		}{}
+		if err := NewEncoder(&bytes.Buffer{}).Encode(v); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("duplicate tag", func(t *testing.T) {
+		v := struct {
+			A int `wire:"1"`
+			B int `wire:"1"`
+		}{}
+		if err := NewEncoder(&bytes.Buffer{}).Encode(v); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("not a pointer", func(t *testing.T) {
+		var f file
+		if err := NewDecoder(bytes.NewReader(encode(f))).Decode(f); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("wrong type", func(t *testing.T) {
+		var s string
+		if err := NewDecoder(bytes.NewReader(encode(42))).Decode(&s); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("overflow", func(t *testing.T) {
+		var b int8
+		if err := NewDecoder(bytes.NewReader(encode(300))).Decode(&b); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("truncated", func(t *testing.T) {
+		bs := encode(file{Name: "a.txt", Size: 10})
+		var f file
+		if err := NewDecoder(bytes.NewReader(bs[:len(bs)-1])).Decode(&f); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+	t.Run("nested too deeply", func(t *testing.T) {
+		// an unknown field of lists nested in lists
+		bs := bytes.Repeat([]byte{'l', 1}, maxDepth+2)
+		var f file
+		unknown := append([]byte{'r', 1, 9}, bs...)
+		if err := NewDecoder(bytes.NewReader(unknown)).Decode(&f); err == nil {
+			t.Fatal("expected error")
+		}
+	})
+}
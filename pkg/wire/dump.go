@@ -0,0 +1,201 @@
+package wire
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// dumpPrefix is how many bytes of a stream or bytes frame are shown by Dump
+const dumpPrefix = 32
+
+// Dump decodes every frame read from r, such as a captured connection, and writes a line describing each to w.
+// Each line is the offset of the frame, then its type and value. The elements of lists, maps and records are
+// indented beneath them. Dump stops at the end of r, and fails if r ends within a frame or has an unknown frame.
+func Dump(w io.Writer, r io.Reader) error {
+	cr := &countingReader{r: r}
+	d := &dumper{w: w, dec: &decoder{Reader: cr, config: newConfig(nil)}, r: cr}
+	for {
+		if _, err := d.dec.Peek(); errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err := d.frame(0, ""); err != nil {
+			return fmt.Errorf("wire.Dump: at offset %v: %w", d.offset, err)
+		}
+	}
+}
+
+// countingReader counts the bytes read from r
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type dumper struct {
+	w   io.Writer
+	dec *decoder
+	r   *countingReader
+
+	// offset of the frame being dumped
+	offset int64
+}
+
+// frame dumps the next frame at depth, with label before its type
+func (d *dumper) frame(depth int, label string) error {
+	if depth > maxDepth {
+		return fmt.Errorf("nested too deeply")
+	}
+	typ, err := d.dec.Peek()
+	if err != nil {
+		return err
+	}
+	// the frame type has been read by Peek
+	d.offset = d.r.n - 1
+
+	line := func(format string, args ...interface{}) error {
+		_, err := fmt.Fprintf(d.w, "%08d  %v%v%v %v\n",
+			d.offset, strings.Repeat("  ", depth), label, typ, fmt.Sprintf(format, args...))
+		return err
+	}
+
+	switch typ {
+	case FrameByte:
+		b, err := d.dec.DecodeByte()
+		if err != nil {
+			return err
+		}
+		if b >= ' ' && b <= '~' {
+			return line("%q (%v)", b, b)
+		}
+		return line("%v", b)
+
+	case FrameString, FrameLongString:
+		s, err := d.dec.DecodeLongString()
+		if err != nil {
+			return err
+		}
+		return line("%q", s)
+
+	case FrameStream:
+		r, err := d.dec.DecodeReader()
+		if err != nil {
+			return err
+		}
+		length := r.(*streamReader).n
+		prefix := make([]byte, dumpPrefix)
+		n, err := io.ReadFull(r, prefix)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if err := line("%v bytes %q%v", length, prefix[:n], ellipsis(int64(n) < length)); err != nil {
+			return err
+		}
+		if _, err := io.Copy(io.Discard, r); err != nil {
+			return err
+		}
+		if r.(*streamReader).n > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		return nil
+
+	case FrameUnsizedStream:
+		r, err := d.dec.DecodeReader()
+		if err != nil {
+			return err
+		}
+		prefix := make([]byte, dumpPrefix)
+		n, err := io.ReadFull(r, prefix)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		// the length is only known once the whole stream has been read
+		rest, err := io.Copy(io.Discard, r)
+		if err != nil {
+			return err
+		}
+		return line("%v bytes %q%v", int64(n)+rest, prefix[:n], ellipsis(rest > 0))
+
+	case FrameUvarint:
+		v, err := d.dec.DecodeUvarint()
+		if err != nil {
+			return err
+		}
+		return line("%v", v)
+
+	case FrameInt64:
+		v, err := d.dec.DecodeInt64()
+		if err != nil {
+			return err
+		}
+		return line("%v", v)
+
+	case FrameBool:
+		v, err := d.dec.DecodeBool()
+		if err != nil {
+			return err
+		}
+		return line("%v", v)
+
+	case FrameBytes:
+		bs, err := d.dec.DecodeBytes()
+		if err != nil {
+			return err
+		}
+		shown := bs
+		if len(shown) > dumpPrefix {
+			shown = shown[:dumpPrefix]
+		}
+		return line("%v bytes %x%v", len(bs), shown, ellipsis(len(shown) < len(bs)))
+
+	case FrameList, FrameMap, FrameRecord:
+		return d.elements(typ, depth, line)
+	}
+	return fmt.Errorf("bad type: %v", byte(typ))
+}
+
+// elements dumps a list, map or record and then each of its elements
+func (d *dumper) elements(typ FrameType, depth int, line func(format string, args ...interface{}) error) error {
+	if _, err := d.dec.readByte(); err != nil {
+		return err
+	}
+	n, err := d.dec.count()
+	if err != nil {
+		return err
+	}
+	if err := line("%v", n); err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		switch typ {
+		case FrameList:
+			err = d.frame(depth+1, "")
+		case FrameMap:
+			if err = d.frame(depth+1, "key "); err == nil {
+				err = d.frame(depth+1, "value ")
+			}
+		case FrameRecord:
+			var tag uint64
+			if tag, err = d.dec.uvarint(); err == nil {
+				err = d.frame(depth+1, fmt.Sprintf("field %v: ", tag))
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func ellipsis(more bool) string {
+	if more {
+		return "..."
+	}
+	return ""
+}
@@ -0,0 +1,58 @@
+package wire
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDump(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.EncodeByte('S'); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeString("abc123"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeReader(strings.NewReader(strings.Repeat("x", 40)), 40); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.Encode(struct {
+		Name  string   `wire:"1"`
+		Sizes []uint64 `wire:"2"`
+	}{Name: "a", Sizes: []uint64{5}}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeUnsizedReader(strings.NewReader("tar")); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	want := `00000000  byte 'S' (83)
+00000002  string "abc123"
+00000010  stream 40 bytes "xxxxxxxxxxxxxxxxxxxxxxxxxxxxxxxx"...
+00000059  record 2
+00000062    field 1: bytes 1 bytes 61
+00000066    field 2: list 1
+00000068      uvarint 5
+00000070  unsized stream 3 bytes "tar"
+`
+	var out strings.Builder
+	if err := Dump(&out, &buf); err != nil {
+		t.Fatalf("dump: %v", err)
+	}
+	if out.String() != want {
+		t.Fatalf("want\n%v\ngot\n%v", want, out.String())
+	}
+}
+
+func TestDump_Truncated(t *testing.T) {
+	var out strings.Builder
+	err := Dump(&out, bytes.NewReader([]byte{'b', 'S', 's', 6, 'a'}))
+	if err == nil || !strings.Contains(err.Error(), "offset 2") {
+		t.Fatalf("want error at offset 2, got %v", err)
+	}
+	if out.String() != "00000000  byte 'S' (83)\n" {
+		t.Fatalf("want the frames before the error, got %v", out.String())
+	}
+}
@@ -7,41 +7,202 @@ import (
 	"io"
 )
 
-const byteType byte = 'b'   // single byte
-const streamType byte = 'B' // arbitrary stream of bytes
-const stringType byte = 's' // short string of up to 256 bytes
+const byteType byte = 'b'    // single byte
+const streamType byte = 'B'  // arbitrary stream of bytes
+const stringType byte = 's'  // short string of up to 256 bytes
+const longType byte = 'S'    // varint length followed by a string of up to the maximum long string length
+const uvarintType byte = 'u' // unsigned varint
+const int64Type byte = 'i'   // signed 64 bit big endian integer
+const boolType byte = 'o'    // single byte of 0 or 1
+const bytesType byte = 'y'   // varint length followed by up to MaxBytes bytes
+const listType byte = 'l'    // varint count followed by that many frames
+const mapType byte = 'm'     // varint count followed by that many pairs of key and value frames
+const recordType byte = 'r'  // varint count followed by that many pairs of varint tag and value frame
+const unsizedType byte = 'C' // stream of unknown length, as chunks of a varint length and that many bytes, ending with an empty chunk
+
+// FrameType is the type of a frame, the first byte of every frame
+type FrameType byte
+
+const (
+	FrameByte       = FrameType(byteType)
+	FrameString     = FrameType(stringType)
+	FrameLongString = FrameType(longType)
+	FrameStream     = FrameType(streamType)
+	FrameUvarint    = FrameType(uvarintType)
+	FrameInt64      = FrameType(int64Type)
+	FrameBool       = FrameType(boolType)
+	FrameBytes      = FrameType(bytesType)
+	FrameList       = FrameType(listType)
+	FrameMap        = FrameType(mapType)
+	FrameRecord     = FrameType(recordType)
+
+	FrameUnsizedStream = FrameType(unsizedType)
+)
+
+func (t FrameType) String() string {
+	switch t {
+	case FrameByte:
+		return "byte"
+	case FrameString:
+		return "string"
+	case FrameLongString:
+		return "long string"
+	case FrameStream:
+		return "stream"
+	case FrameUvarint:
+		return "uvarint"
+	case FrameInt64:
+		return "int64"
+	case FrameBool:
+		return "bool"
+	case FrameBytes:
+		return "bytes"
+	case FrameList:
+		return "list"
+	case FrameMap:
+		return "map"
+	case FrameRecord:
+		return "record"
+	case FrameUnsizedStream:
+		return "unsized stream"
+	default:
+		return fmt.Sprintf("unknown(%v)", byte(t))
+	}
+}
+
+// UnsizedChunk is the most bytes sent in each chunk of an unsized stream.
+// Chunks of up to MaxBytes are decoded.
+const UnsizedChunk = 32 * 1024
+
+// MaxBytes is the longest bytes frame that will be decoded, so a peer can't exhaust memory
+const MaxBytes = 1 << 20
+
+// DefaultMaxLongString is the longest long string that will be encoded or decoded, unless changed
+// with WithMaxLongString. It is long enough for any path on common file systems.
+const DefaultMaxLongString = 4096
+
+// Option configures an Encoder or Decoder
+type Option func(*config)
+
+type config struct {
+	// maxLongString limits long strings
+	maxLongString int
+
+	// buffer copies the bytes of sized streams, when set
+	buffer []byte
+}
+
+func newConfig(opts []Option) config {
+	c := config{maxLongString: DefaultMaxLongString}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// WithMaxLongString changes the longest long string, in bytes, that will be encoded or decoded
+func WithMaxLongString(n int) Option {
+	return func(c *config) {
+		c.maxLongString = n
+	}
+}
+
+// WithBuffer has an Encoder copy sized streams through buf, rather than a buffer of its own,
+// so the caller can account for the memory. buf must not be used by anything else while encoding.
+func WithBuffer(buf []byte) Option {
+	return func(c *config) {
+		c.buffer = buf
+	}
+}
 
 // Encoder encodes data types to an underlying io.Writer
 type Encoder interface {
 	EncodeByte(b byte) error
 	EncodeString(s string) error
+
+	// EncodeLongString encodes a string that may be longer than 255 bytes, such as a file name or an error message.
+	// Strings that fit are sent as short strings, so peers that only decode short strings still understand them.
+	EncodeLongString(s string) error
+
 	EncodeReader(r io.Reader, length int64) error
+
+	// EncodeUnsizedReader encodes a stream of r until it ends, for bodies whose length isn't known up front,
+	// such as an archive written as it is sent. It is decoded with DecodeReader like any other stream.
+	EncodeUnsizedReader(r io.Reader) error
+
+	EncodeUvarint(v uint64) error
+	EncodeInt64(v int64) error
+	EncodeBool(v bool) error
+	EncodeBytes(bs []byte) error
+
+	// EncodeList starts a list of n elements, which must each be encoded next
+	EncodeList(n int) error
+
+	// EncodeMap starts a map of n entries, which must each be encoded next as a key then a value
+	EncodeMap(n int) error
+
+	// Encode encodes a value of a supported type in one call, see Encode in codec.go
+	Encode(v interface{}) error
 }
 
 // Decoder Decodes data types from an underlying io.Reader
 type Decoder interface {
 	DecodeByte() (byte, error)
 	DecodeString() (string, error)
+
+	// DecodeLongString decodes either a long string or a short string
+	DecodeLongString() (string, error)
+
+	// DecodeReader decodes a stream, sized or unsized, returning a reader of its bytes.
+	// The reader has a Len() int64 method reporting how many bytes remain, or -1 for an unsized stream.
 	DecodeReader() (io.Reader, error)
+	DecodeUvarint() (uint64, error)
+	DecodeInt64() (int64, error)
+	DecodeBool() (bool, error)
+	DecodeBytes() ([]byte, error)
+
+	// DecodeList starts a list, returning the number of elements to decode next
+	DecodeList() (int, error)
+
+	// DecodeMap starts a map, returning the number of entries to decode next as a key then a value
+	DecodeMap() (int, error)
+
+	// Decode decodes into the value v points to in one call, see Decode in codec.go
+	Decode(v interface{}) error
+
+	// Peek returns the type of the next frame without consuming it, so optional or unknown frames can be handled
+	Peek() (FrameType, error)
+
+	// Skip reads the next frame, of any known type, and discards it.
+	// A stream frame is read to its end, so a stream returned by DecodeReader must not be read afterwards.
+	Skip() error
 }
 
 type encoder struct {
 	io.Writer
+	config
 }
 
 type decoder struct {
 	io.Reader
+	config
+
+	// peeked is set when next is a frame type read by Peek that hasn't been consumed yet
+	peeked bool
+	next   byte
 }
 
-func NewEncoder(w io.Writer) Encoder {
+func NewEncoder(w io.Writer, opts ...Option) Encoder {
 	return &encoder{
 		Writer: w,
+		config: newConfig(opts),
 	}
 }
 
-func NewDecoder(r io.Reader) Decoder {
+func NewDecoder(r io.Reader, opts ...Option) Decoder {
 	return &decoder{
 		Reader: r,
+		config: newConfig(opts),
 	}
 }
 
@@ -67,6 +228,27 @@ func (enc *encoder) EncodeString(s string) error {
 	return nil
 }
 
+func (enc *encoder) EncodeLongString(s string) error {
+	if len(s) <= 255 {
+		return enc.EncodeString(s)
+	}
+	if len(s) > enc.maxLongString {
+		return fmt.Errorf("wire.EncodeLongString: too long %v", len(s))
+	}
+	if _, err := enc.Write(append(appendUvarint([]byte{longType}, uint64(len(s))), s...)); err != nil {
+		return fmt.Errorf("wire.EncodeLongString: %w", err)
+	}
+	return nil
+}
+
+// LongStringLength is the number of bytes s takes when encoded with EncodeLongString
+func LongStringLength(s string) int64 {
+	if len(s) <= 255 {
+		return int64(2 + len(s))
+	}
+	return int64(len(appendUvarint([]byte{longType}, uint64(len(s)))) + len(s))
+}
+
 func (enc *encoder) EncodeReader(r io.Reader, length int64) error {
 	if _, err := enc.Write([]byte{streamType}); err != nil {
 		return fmt.Errorf("wire.EncodeReader: %w", err)
@@ -74,12 +256,46 @@ func (enc *encoder) EncodeReader(r io.Reader, length int64) error {
 	if err := binary.Write(enc, binary.BigEndian, length); err != nil {
 		return fmt.Errorf("wire.EncodeReader: %w", err)
 	}
-	if _, err := io.CopyN(enc, r, length); err != nil {
+	// like io.CopyN, with the buffer if there is one
+	n, err := io.CopyBuffer(enc, io.LimitReader(r, length), enc.buffer)
+	if err == nil && n < length {
+		err = io.EOF
+	}
+	if err != nil {
 		return fmt.Errorf("wire.EncodeReader: %w", err)
 	}
 	return nil
 }
 
+func (enc *encoder) EncodeUnsizedReader(r io.Reader) error {
+	if _, err := enc.Write([]byte{unsizedType}); err != nil {
+		return fmt.Errorf("wire.EncodeUnsizedReader: %w", err)
+	}
+	chunk := make([]byte, UnsizedChunk)
+	frame := make([]byte, 0, binary.MaxVarintLen64+UnsizedChunk)
+	for {
+		// fill whole chunks, as small reads would make small chunks
+		n, err := io.ReadFull(r, chunk)
+		if n > 0 {
+			frame = append(appendUvarint(frame[:0], uint64(n)), chunk[:n]...)
+			if _, err := enc.Write(frame); err != nil {
+				return fmt.Errorf("wire.EncodeUnsizedReader: %w", err)
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("wire.EncodeUnsizedReader: %w", err)
+		}
+	}
+	// the empty chunk ends the stream
+	if _, err := enc.Write([]byte{0}); err != nil {
+		return fmt.Errorf("wire.EncodeUnsizedReader: %w", err)
+	}
+	return nil
+}
+
 func (dec *decoder) DecodeByte() (byte, error) {
 	bs := []byte{0, 0}
 	_, err := io.ReadFull(dec, bs)
@@ -110,12 +326,47 @@ func (dec *decoder) DecodeString() (string, error) {
 	return string(bs), nil
 }
 
+func (dec *decoder) DecodeLongString() (string, error) {
+	typ, err := dec.readByte()
+	if err != nil {
+		return "", fmt.Errorf("wire.DecodeLongString: %w", err)
+	}
+
+	var length uint64
+	switch typ {
+	case stringType:
+		b, err := dec.readByte()
+		if err != nil {
+			return "", fmt.Errorf("wire.DecodeLongString: %w", err)
+		}
+		length = uint64(b)
+	case longType:
+		if length, err = dec.uvarint(); err != nil {
+			return "", fmt.Errorf("wire.DecodeLongString: %w", err)
+		}
+		if length > uint64(dec.maxLongString) {
+			return "", fmt.Errorf("wire.DecodeLongString: too long %v", length)
+		}
+	default:
+		return "", fmt.Errorf("wire.DecodeLongString: bad type: %v", typ)
+	}
+
+	bs := make([]byte, length)
+	if _, err := io.ReadFull(dec, bs); err != nil {
+		return "", fmt.Errorf("wire.DecodeLongString: %w", err)
+	}
+	return string(bs), nil
+}
+
 func (dec *decoder) DecodeReader() (io.Reader, error) {
 	bs := []byte{0}
 	_, err := io.ReadFull(dec, bs)
 	if err != nil {
 		return nil, fmt.Errorf("wire.DecodeReader: %w", err)
 	}
+	if bs[0] == unsizedType {
+		return &unsizedReader{dec: dec}, nil
+	}
 	if bs[0] != streamType {
 		return nil, fmt.Errorf("wire.DecodeReader bad type: %v", bs[0])
 	}
@@ -125,5 +376,325 @@ func (dec *decoder) DecodeReader() (io.Reader, error) {
 		return nil, fmt.Errorf("wire.DecodeReader: %w", err)
 	}
 
-	return io.LimitReader(dec, length), nil
+	return &streamReader{r: dec, n: length}, nil
+}
+
+func (enc *encoder) EncodeUvarint(v uint64) error {
+	if _, err := enc.Write(appendUvarint([]byte{uvarintType}, v)); err != nil {
+		return fmt.Errorf("wire.EncodeUvarint: %w", err)
+	}
+	return nil
+}
+
+func (enc *encoder) EncodeInt64(v int64) error {
+	bs := make([]byte, 9)
+	bs[0] = int64Type
+	binary.BigEndian.PutUint64(bs[1:], uint64(v))
+	if _, err := enc.Write(bs); err != nil {
+		return fmt.Errorf("wire.EncodeInt64: %w", err)
+	}
+	return nil
+}
+
+func (enc *encoder) EncodeBool(v bool) error {
+	b := byte(0)
+	if v {
+		b = 1
+	}
+	if _, err := enc.Write([]byte{boolType, b}); err != nil {
+		return fmt.Errorf("wire.EncodeBool: %w", err)
+	}
+	return nil
+}
+
+func (enc *encoder) EncodeBytes(bs []byte) error {
+	if len(bs) > MaxBytes {
+		return fmt.Errorf("wire.EncodeBytes: too long %v", len(bs))
+	}
+	if _, err := enc.Write(append(appendUvarint([]byte{bytesType}, uint64(len(bs))), bs...)); err != nil {
+		return fmt.Errorf("wire.EncodeBytes: %w", err)
+	}
+	return nil
+}
+
+func (enc *encoder) EncodeList(n int) error {
+	if _, err := enc.Write(appendUvarint([]byte{listType}, uint64(n))); err != nil {
+		return fmt.Errorf("wire.EncodeList: %w", err)
+	}
+	return nil
+}
+
+func (enc *encoder) EncodeMap(n int) error {
+	if _, err := enc.Write(appendUvarint([]byte{mapType}, uint64(n))); err != nil {
+		return fmt.Errorf("wire.EncodeMap: %w", err)
+	}
+	return nil
+}
+
+func (dec *decoder) DecodeUvarint() (uint64, error) {
+	if err := dec.expect(uvarintType); err != nil {
+		return 0, fmt.Errorf("wire.DecodeUvarint: %w", err)
+	}
+	v, err := dec.uvarint()
+	if err != nil {
+		return 0, fmt.Errorf("wire.DecodeUvarint: %w", err)
+	}
+	return v, nil
+}
+
+func (dec *decoder) DecodeInt64() (int64, error) {
+	if err := dec.expect(int64Type); err != nil {
+		return 0, fmt.Errorf("wire.DecodeInt64: %w", err)
+	}
+	v, err := dec.int64()
+	if err != nil {
+		return 0, fmt.Errorf("wire.DecodeInt64: %w", err)
+	}
+	return v, nil
+}
+
+func (dec *decoder) DecodeBool() (bool, error) {
+	if err := dec.expect(boolType); err != nil {
+		return false, fmt.Errorf("wire.DecodeBool: %w", err)
+	}
+	v, err := dec.bool()
+	if err != nil {
+		return false, fmt.Errorf("wire.DecodeBool: %w", err)
+	}
+	return v, nil
+}
+
+func (dec *decoder) DecodeBytes() ([]byte, error) {
+	if err := dec.expect(bytesType); err != nil {
+		return nil, fmt.Errorf("wire.DecodeBytes: %w", err)
+	}
+	bs, err := dec.bytes()
+	if err != nil {
+		return nil, fmt.Errorf("wire.DecodeBytes: %w", err)
+	}
+	return bs, nil
+}
+
+func (dec *decoder) DecodeList() (int, error) {
+	if err := dec.expect(listType); err != nil {
+		return 0, fmt.Errorf("wire.DecodeList: %w", err)
+	}
+	n, err := dec.count()
+	if err != nil {
+		return 0, fmt.Errorf("wire.DecodeList: %w", err)
+	}
+	return n, nil
+}
+
+func (dec *decoder) DecodeMap() (int, error) {
+	if err := dec.expect(mapType); err != nil {
+		return 0, fmt.Errorf("wire.DecodeMap: %w", err)
+	}
+	n, err := dec.count()
+	if err != nil {
+		return 0, fmt.Errorf("wire.DecodeMap: %w", err)
+	}
+	return n, nil
+}
+
+// appendUvarint appends v encoded as a varint to bs
+func appendUvarint(bs []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(bs, buf[:binary.PutUvarint(buf, v)]...)
+}
+
+// Read reads from the underlying reader, after any byte read by Peek
+func (dec *decoder) Read(p []byte) (int, error) {
+	if dec.peeked && len(p) > 0 {
+		p[0] = dec.next
+		dec.peeked = false
+		return 1, nil
+	}
+	return dec.Reader.Read(p)
+}
+
+func (dec *decoder) Peek() (FrameType, error) {
+	if !dec.peeked {
+		bs := []byte{0}
+		if _, err := io.ReadFull(dec.Reader, bs); err != nil {
+			return 0, fmt.Errorf("wire.Peek: %w", err)
+		}
+		dec.next = bs[0]
+		dec.peeked = true
+	}
+	return FrameType(dec.next), nil
+}
+
+func (dec *decoder) Skip() error {
+	if err := dec.skip(0); err != nil {
+		return fmt.Errorf("wire.Skip: %w", err)
+	}
+	return nil
+}
+
+// readByte reads a single byte, without a frame type
+func (dec *decoder) readByte() (byte, error) {
+	bs := []byte{0}
+	if _, err := io.ReadFull(dec, bs); err != nil {
+		return 0, err
+	}
+	return bs[0], nil
+}
+
+// expect reads a frame type, failing if it isn't typ
+func (dec *decoder) expect(typ byte) error {
+	b, err := dec.readByte()
+	if err != nil {
+		return err
+	}
+	if b != typ {
+		return fmt.Errorf("bad type: %v", b)
+	}
+	return nil
+}
+
+// uvarint reads a varint, without a frame type
+func (dec *decoder) uvarint() (uint64, error) {
+	v, err := binary.ReadUvarint(byteReader{dec})
+	if err == io.EOF {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return v, err
+}
+
+// int64 reads the body of an int64 frame
+func (dec *decoder) int64() (int64, error) {
+	bs := make([]byte, 8)
+	if _, err := io.ReadFull(dec, bs); err != nil {
+		return 0, err
+	}
+	return int64(binary.BigEndian.Uint64(bs)), nil
+}
+
+// bool reads the body of a bool frame
+func (dec *decoder) bool() (bool, error) {
+	b, err := dec.readByte()
+	if err != nil {
+		return false, err
+	}
+	if b > 1 {
+		return false, fmt.Errorf("bad bool: %v", b)
+	}
+	return b == 1, nil
+}
+
+// bytes reads the body of a bytes frame
+func (dec *decoder) bytes() ([]byte, error) {
+	length, err := dec.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if length > MaxBytes {
+		return nil, fmt.Errorf("too long %v", length)
+	}
+	bs := make([]byte, length)
+	if _, err := io.ReadFull(dec, bs); err != nil {
+		return nil, err
+	}
+	return bs, nil
+}
+
+// count reads the number of elements of a list, map or record
+func (dec *decoder) count() (int, error) {
+	n, err := dec.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	// every element is at least one byte, so this only limits nonsense
+	if n > MaxBytes {
+		return 0, fmt.Errorf("too many elements %v", n)
+	}
+	return int(n), nil
+}
+
+// byteReader reads single bytes from a decoder, which doesn't buffer
+type byteReader struct {
+	dec *decoder
+}
+
+func (r byteReader) ReadByte() (byte, error) {
+	return r.dec.readByte()
+}
+
+// streamReader reads a stream of known length, failing if the stream ends early
+type streamReader struct {
+	r io.Reader
+
+	// n bytes remaining
+	n int64
+}
+
+// Len is the number of bytes of the stream remaining
+func (s *streamReader) Len() int64 {
+	return s.n
+}
+
+func (s *streamReader) Read(p []byte) (int, error) {
+	if s.n <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.r.Read(p)
+	s.n -= int64(n)
+	if err == io.EOF && s.n > 0 {
+		return n, fmt.Errorf("wire.DecodeReader: %w", io.ErrUnexpectedEOF)
+	}
+	if err == io.EOF {
+		// the stream is complete, even if the underlying reader isn't
+		err = nil
+	}
+	return n, err
+}
+
+// unsizedReader reads the chunks of an unsized stream, failing if the stream ends before its empty chunk
+type unsizedReader struct {
+	dec *decoder
+
+	// n bytes remaining of the current chunk
+	n uint64
+
+	// done once the empty chunk has been read
+	done bool
+}
+
+// Len is unknown for an unsized stream, so -1
+func (s *unsizedReader) Len() int64 {
+	return -1
+}
+
+func (s *unsizedReader) Read(p []byte) (int, error) {
+	for s.n == 0 {
+		if s.done {
+			return 0, io.EOF
+		}
+		n, err := s.dec.uvarint()
+		if err != nil {
+			return 0, fmt.Errorf("wire.DecodeReader: %w", err)
+		}
+		if n == 0 {
+			s.done = true
+			return 0, io.EOF
+		}
+		if n > MaxBytes {
+			return 0, fmt.Errorf("wire.DecodeReader: chunk too long %v", n)
+		}
+		s.n = n
+	}
+	if uint64(len(p)) > s.n {
+		p = p[:s.n]
+	}
+	n, err := s.dec.Read(p)
+	s.n -= uint64(n)
+	if err == io.EOF {
+		// the stream isn't complete until its empty chunk
+		return n, fmt.Errorf("wire.DecodeReader: %w", io.ErrUnexpectedEOF)
+	}
+	return n, err
 }
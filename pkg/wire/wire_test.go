@@ -2,10 +2,12 @@ package wire
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"reflect"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestEncodeString(t *testing.T) {
@@ -91,6 +93,27 @@ func TestEncodeReader(t *testing.T) {
 	}
 }
 
+func TestEncodeReader_Buffer(t *testing.T) {
+	var buf bytes.Buffer
+	copying := make([]byte, 2)
+	enc := NewEncoder(&buf, WithBuffer(copying))
+	// the stream is copied through the buffer a couple of bytes at a time
+	if err := enc.EncodeReader(strings.NewReader("a b c"), 5); err != nil {
+		t.Fatalf("failed encode: %v", err)
+	}
+	want := []byte{'B', 0, 0, 0, 0, 0, 0, 0, 5, 'a', ' ', 'b', ' ', 'c'}
+	if !reflect.DeepEqual(want, buf.Bytes()) {
+		t.Fatalf("wanted %v, got %v", want, buf.Bytes())
+	}
+	if string(copying) != "c " {
+		t.Fatalf("want the last bytes copied left in the buffer, got %q", copying)
+	}
+
+	if err := enc.EncodeReader(strings.NewReader("ab"), 3); !errors.Is(err, io.EOF) {
+		t.Fatalf("want EOF encoding a short reader, got %v", err)
+	}
+}
+
 func TestDecodeReader(t *testing.T) {
 	tests := []struct {
 		name string
@@ -109,6 +132,9 @@ func TestDecodeReader(t *testing.T) {
 			if err != nil {
 				t.Fatalf("err: %v", err)
 			}
+			if n := r.(interface{ Len() int64 }).Len(); n != int64(len(tt.s)) {
+				t.Fatalf("want length %v, got %v", len(tt.s), n)
+			}
 
 			b := &strings.Builder{}
 			io.Copy(b, r)
@@ -119,3 +145,278 @@ func TestDecodeReader(t *testing.T) {
 		})
 	}
 }
+
+func TestDecodeReader_Truncated(t *testing.T) {
+	bs := []byte{'B', 0, 0, 0, 0, 0, 0, 0, 5, 'a', 'b'}
+	r, err := NewDecoder(bytes.NewReader(bs)).DecodeReader()
+	if err != nil {
+		t.Fatalf("err: %v", err)
+	}
+
+	_, err = io.Copy(io.Discard, r)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("want %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestUnsizedReader(t *testing.T) {
+	for _, length := range []int{0, 1, UnsizedChunk, 2*UnsizedChunk + 7} {
+		body := bytes.Repeat([]byte("0123456789"), length/10+1)[:length]
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		// a reader that only gives a few bytes at a time still makes whole chunks
+		if err := enc.EncodeUnsizedReader(iotest.OneByteReader(bytes.NewReader(body))); err != nil {
+			t.Fatalf("%v: encode: %v", length, err)
+		}
+		if err := enc.EncodeString("after"); err != nil {
+			t.Fatalf("%v: encode: %v", length, err)
+		}
+		chunks := (length + UnsizedChunk - 1) / UnsizedChunk
+		if want := 1 + length + chunks*3 + 1 + 7; length > 0 && buf.Len() > want {
+			t.Fatalf("%v: want at most %v bytes, got %v", length, want, buf.Len())
+		}
+
+		dec := NewDecoder(&buf)
+		if typ, err := dec.Peek(); typ != FrameUnsizedStream || err != nil {
+			t.Fatalf("%v: want %v, got %v: %v", length, FrameUnsizedStream, typ, err)
+		}
+		r, err := dec.DecodeReader()
+		if err != nil {
+			t.Fatalf("%v: decode: %v", length, err)
+		}
+		if n := r.(interface{ Len() int64 }).Len(); n != -1 {
+			t.Fatalf("%v: want length -1, got %v", length, n)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || !bytes.Equal(got, body) {
+			t.Fatalf("%v: want %v bytes, got %v: %v", length, length, len(got), err)
+		}
+		// the stream ends at its empty chunk, leaving the next frame
+		if s, err := dec.DecodeString(); s != "after" || err != nil {
+			t.Fatalf("%v: want after, got %v: %v", length, s, err)
+		}
+	}
+}
+
+func TestUnsizedReader_Truncated(t *testing.T) {
+	for _, bs := range [][]byte{
+		{'C', 5, 'a', 'b'},
+		// a complete chunk, but no empty chunk to end the stream
+		{'C', 2, 'a', 'b'},
+	} {
+		r, err := NewDecoder(bytes.NewReader(bs)).DecodeReader()
+		if err != nil {
+			t.Fatalf("err: %v", err)
+		}
+		if _, err = io.Copy(io.Discard, r); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%q: want %v, got %v", bs, io.ErrUnexpectedEOF, err)
+		}
+	}
+}
+
+func TestEncodePrimitives(t *testing.T) {
+	tests := []struct {
+		name   string
+		encode func(enc Encoder) error
+		bs     []byte
+	}{
+		{"uvarint", func(enc Encoder) error { return enc.EncodeUvarint(300) }, []byte{'u', 0xac, 0x02}},
+		{"int64", func(enc Encoder) error { return enc.EncodeInt64(-2) }, []byte{'i', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}},
+		{"bool", func(enc Encoder) error { return enc.EncodeBool(true) }, []byte{'o', 1}},
+		{"bytes", func(enc Encoder) error { return enc.EncodeBytes([]byte("ab")) }, []byte{'y', 2, 'a', 'b'}},
+		{"list", func(enc Encoder) error { return enc.EncodeList(3) }, []byte{'l', 3}},
+		{"map", func(enc Encoder) error { return enc.EncodeMap(1) }, []byte{'m', 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.encode(NewEncoder(&buf)); err != nil {
+				t.Fatalf("failed encode: %v", err)
+			}
+			if !reflect.DeepEqual(tt.bs, buf.Bytes()) {
+				t.Fatalf("wanted %v, got %v", tt.bs, buf.Bytes())
+			}
+		})
+	}
+}
+
+func TestDecodePrimitives(t *testing.T) {
+	dec := NewDecoder(bytes.NewReader([]byte{
+		'u', 0xac, 0x02,
+		'i', 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe,
+		'o', 1,
+		'y', 2, 'a', 'b',
+		'l', 3,
+		'm', 1,
+	}))
+
+	if v, err := dec.DecodeUvarint(); v != 300 || err != nil {
+		t.Fatalf("want 300, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeInt64(); v != -2 || err != nil {
+		t.Fatalf("want -2, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeBool(); !v || err != nil {
+		t.Fatalf("want true, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeBytes(); string(v) != "ab" || err != nil {
+		t.Fatalf("want ab, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeList(); v != 3 || err != nil {
+		t.Fatalf("want 3, got %v: %v", v, err)
+	}
+	if v, err := dec.DecodeMap(); v != 1 || err != nil {
+		t.Fatalf("want 1, got %v: %v", v, err)
+	}
+}
+
+func TestDecodePrimitives_Bad(t *testing.T) {
+	tests := []struct {
+		name   string
+		bs     []byte
+		decode func(dec Decoder) error
+	}{
+		{"wrong type", []byte{'b', 1}, func(dec Decoder) error { _, err := dec.DecodeBool(); return err }},
+		{"bad bool", []byte{'o', 2}, func(dec Decoder) error { _, err := dec.DecodeBool(); return err }},
+		{"truncated uvarint", []byte{'u', 0x80}, func(dec Decoder) error { _, err := dec.DecodeUvarint(); return err }},
+		{"truncated bytes", []byte{'y', 3, 'a'}, func(dec Decoder) error { _, err := dec.DecodeBytes(); return err }},
+		{"too long bytes", []byte{'y', 0x81, 0x80, 0x80, 0x01}, func(dec Decoder) error { _, err := dec.DecodeBytes(); return err }},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.decode(NewDecoder(bytes.NewReader(tt.bs))); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}
+
+func TestEncodeLongString(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		name string
+		s    string
+		bs   []byte
+	}{
+		{"short strings are short frames", "ab", []byte{'s', 2, 'a', 'b'}},
+		{"longest short string", strings.Repeat("a", 255), append([]byte{'s', 255}, strings.Repeat("a", 255)...)},
+		{"long string", long, append([]byte{'S', 0xac, 0x02}, long...)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).EncodeLongString(tt.s); err != nil {
+				t.Fatalf("failed encode: %v", err)
+			}
+			if !reflect.DeepEqual(tt.bs, buf.Bytes()) {
+				t.Fatalf("wanted %v, got %v", tt.bs, buf.Bytes())
+			}
+			if LongStringLength(tt.s) != int64(buf.Len()) {
+				t.Fatalf("want length %v, got %v", buf.Len(), LongStringLength(tt.s))
+			}
+
+			s, err := NewDecoder(&buf).DecodeLongString()
+			if err != nil {
+				t.Fatalf("failed decode: %v", err)
+			}
+			if s != tt.s {
+				t.Fatalf("want %v, got %v", tt.s, s)
+			}
+		})
+	}
+}
+
+func TestLongString_Max(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	if err := NewEncoder(io.Discard, WithMaxLongString(299)).EncodeLongString(long); err == nil {
+		t.Fatal("expected error encoding too long a string")
+	}
+	if err := NewEncoder(io.Discard).EncodeLongString(strings.Repeat("a", DefaultMaxLongString+1)); err == nil {
+		t.Fatal("expected error encoding more than the default")
+	}
+
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).EncodeLongString(long); err != nil {
+		t.Fatalf("failed encode: %v", err)
+	}
+	if _, err := NewDecoder(bytes.NewReader(buf.Bytes()), WithMaxLongString(299)).DecodeLongString(); err == nil {
+		t.Fatal("expected error decoding too long a string")
+	}
+	if _, err := NewDecoder(bytes.NewReader(buf.Bytes()), WithMaxLongString(300)).DecodeLongString(); err != nil {
+		t.Fatalf("failed decode: %v", err)
+	}
+	if _, err := NewDecoder(bytes.NewReader(buf.Bytes())).DecodeString(); err == nil {
+		t.Fatal("expected error decoding a long string as a short string")
+	}
+}
+
+func TestDecoder_PeekSkip(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	if err := enc.EncodeByte('x'); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeReader(strings.NewReader("skipped"), 7); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.Encode(map[string][]int{"a": {1, 2}}); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeUnsizedReader(strings.NewReader("unsized")); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeLongString(strings.Repeat("a", 300)); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	if err := enc.EncodeString("last"); err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+
+	dec := NewDecoder(&buf)
+	for _, want := range []FrameType{FrameByte, FrameStream, FrameMap, FrameUnsizedStream, FrameLongString} {
+		// peeking twice doesn't consume the frame
+		for i := 0; i < 2; i++ {
+			if typ, err := dec.Peek(); typ != want || err != nil {
+				t.Fatalf("want %v, got %v: %v", want, typ, err)
+			}
+		}
+		if want == FrameByte {
+			// the peeked frame can still be decoded
+			if b, err := dec.DecodeByte(); b != 'x' || err != nil {
+				t.Fatalf("want x, got %v: %v", b, err)
+			}
+			continue
+		}
+		if err := dec.Skip(); err != nil {
+			t.Fatalf("skip %v: %v", want, err)
+		}
+	}
+	if s, err := dec.DecodeString(); s != "last" || err != nil {
+		t.Fatalf("want last, got %v: %v", s, err)
+	}
+	if _, err := dec.Peek(); !errors.Is(err, io.EOF) {
+		t.Fatalf("want %v, got %v", io.EOF, err)
+	}
+}
+
+func TestDecoder_SkipBad(t *testing.T) {
+	tests := []struct {
+		name string
+		bs   []byte
+	}{
+		{"unknown type", []byte{'?', 1}},
+		{"truncated stream", []byte{'B', 0, 0, 0, 0, 0, 0, 0, 5, 'a'}},
+		{"truncated unsized stream", []byte{'C', 2, 'a', 'b'}},
+		{"truncated list", []byte{'l', 2, 'o', 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := NewDecoder(bytes.NewReader(tt.bs)).Skip(); err == nil {
+				t.Fatal("expected error")
+			}
+		})
+	}
+}